@@ -0,0 +1,317 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// configAnnotationVersion is the current version of the imago-config-spec
+// annotation format. Annotations without version were written by imago
+// before versioning was introduced and are version 1.
+const configAnnotationVersion = 2
+
+// configAnnotationMigrations convert a raw annotation from version i+1 to
+// version i+2, they are applied in order when reading older annotations
+var configAnnotationMigrations = []func(raw map[string]interface{}) error{
+	// 1 -> 2: only add the version field
+	func(raw map[string]interface{}) error {
+		return nil
+	},
+}
+
+// parseConfigAnnotation read an imago-config-spec annotation written by any
+// imago version and return it in the current format
+func parseConfigAnnotation(rawConfig string) (*configAnnotation, error) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(rawConfig), &raw); err != nil {
+		return nil, err
+	}
+	version := 1
+	if v, ok := raw["version"]; ok {
+		number, ok := v.(float64)
+		if !ok || number < 1 || number != float64(int(number)) {
+			return nil, fmt.Errorf("invalid %s version %v", imagoConfigAnnotation, v)
+		}
+		version = int(number)
+	}
+	if version > configAnnotationVersion {
+		return nil, fmt.Errorf("%s version %d was written by a newer imago version (supported version: %d)", imagoConfigAnnotation, version, configAnnotationVersion)
+	}
+	for ; version < configAnnotationVersion; version++ {
+		if err := configAnnotationMigrations[version-1](raw); err != nil {
+			return nil, fmt.Errorf("unable to migrate %s from version %d: %s", imagoConfigAnnotation, version, err)
+		}
+	}
+	raw["version"] = configAnnotationVersion
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	config := configAnnotation{}
+	if err := json.Unmarshal(migrated, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// maxConfigAnnotationSize is the size above which the imago-config-spec
+// content is stored in a companion ConfigMap, the workload annotation then
+// only point to it
+const maxConfigAnnotationSize = 64 * 1024
+
+// configMapName return the name of the ConfigMap holding imago state of given
+// workload when it doesn't fit in the annotation
+func configMapName(kind string, name string) string {
+	return fmt.Sprintf("imago-%s-%s", strings.ToLower(kind), name)
+}
+
+var kindAPIVersions = map[string]string{
+	"Deployment":  "apps/v1",
+	"DaemonSet":   "apps/v1",
+	"StatefulSet": "apps/v1",
+	"CronJob":     "batch/v1beta1",
+}
+
+// loadConfigAnnotation return the imago-config-spec stored on given workload,
+// either in the annotation or in the ConfigMap it points to, or nil
+func (c *Config) loadConfigAnnotation(meta *metav1.ObjectMeta) (*configAnnotation, error) {
+	rawConfig := meta.GetAnnotations()[imagoConfigAnnotation]
+	if len(rawConfig) == 0 {
+		return nil, nil
+	}
+	config, err := parseConfigAnnotation(rawConfig)
+	if err != nil || config.ConfigMap == "" {
+		return config, err
+	}
+	var cm *v1.ConfigMap
+	err = retryTransient(func() (err error) {
+		cm, err = c.cluster.CoreV1().ConfigMaps(meta.Namespace).Get(c.context, config.ConfigMap, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	config, err = parseConfigAnnotation(cm.Data[imagoConfigAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ConfigMap %s/%s: %w", meta.Namespace, cm.Name, err)
+	}
+	return config, nil
+}
+
+// storeConfigAnnotation write the imago-config-spec of given workload in its
+// annotation, or in a companion ConfigMap if it's too large
+func (c *Config) storeConfigAnnotation(kind string, meta *metav1.ObjectMeta, config *configAnnotation) error {
+	jsonConfig, err := encodeConfigAnnotation(config)
+	if err != nil {
+		return err
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	if len(jsonConfig) <= maxConfigAnnotationSize {
+		if err := c.deleteConfigMap(kind, meta); err != nil {
+			return err
+		}
+		meta.Annotations[imagoConfigAnnotation] = string(jsonConfig)
+		return nil
+	}
+	name := configMapName(kind, meta.Name)
+	log.Printf("storing %s in ConfigMap %s/%s", imagoConfigAnnotation, meta.Namespace, name)
+	client := c.cluster.CoreV1().ConfigMaps(meta.Namespace)
+	cm, err := client.Get(c.context, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		isController := true
+		cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: meta.Namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: kindAPIVersions[kind],
+				Kind:       kind,
+				Name:       meta.Name,
+				UID:        meta.UID,
+				Controller: &isController,
+			}},
+		}, Data: map[string]string{imagoConfigAnnotation: string(jsonConfig)}}
+		_, err = client.Create(c.context, cm, metav1.CreateOptions{})
+	} else if err == nil {
+		cm.Data = map[string]string{imagoConfigAnnotation: string(jsonConfig)}
+		_, err = client.Update(c.context, cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	pointer, err := json.Marshal(&configAnnotation{Version: configAnnotationVersion, ConfigMap: name})
+	if err != nil {
+		return err
+	}
+	meta.Annotations[imagoConfigAnnotation] = string(pointer)
+	return nil
+}
+
+// encodeConfigAnnotation return the imago-config-spec of given config
+func encodeConfigAnnotation(config *configAnnotation) ([]byte, error) {
+	config.Version = configAnnotationVersion
+	config.ConfigMap = ""
+	return json.Marshal(config)
+}
+
+// deleteConfigMap delete the companion ConfigMap of given workload if any
+func (c *Config) deleteConfigMap(kind string, meta *metav1.ObjectMeta) error {
+	rawConfig := meta.GetAnnotations()[imagoConfigAnnotation]
+	if rawConfig == "" {
+		return nil
+	}
+	config, err := parseConfigAnnotation(rawConfig)
+	if err != nil || config.ConfigMap == "" {
+		// nothing we can clean up
+		return nil
+	}
+	log.Printf("deleting ConfigMap %s/%s", meta.Namespace, config.ConfigMap)
+	err = c.cluster.CoreV1().ConfigMaps(meta.Namespace).Delete(c.context, config.ConfigMap, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// pruneConfigContainers remove entries of containers which are not in the
+// pod spec anymore (e.g. renamed containers) and duplicated entries, return
+// kept entries and a description of removed ones
+func pruneConfigContainers(entries []configAnnotationImageSpec, containers []v1.Container) ([]configAnnotationImageSpec, []string) {
+	names := make(map[string]bool)
+	for _, container := range containers {
+		names[container.Name] = true
+	}
+	kept := make([]configAnnotationImageSpec, 0, len(entries))
+	pruned := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		switch {
+		case !names[entry.Name]:
+			pruned = append(pruned, fmt.Sprintf("%s (%s) is not in spec", entry.Name, entry.Image))
+		case seen[entry.Name]:
+			pruned = append(pruned, fmt.Sprintf("%s (%s) is a duplicate entry", entry.Name, entry.Image))
+		default:
+			seen[entry.Name] = true
+			kept = append(kept, entry)
+		}
+	}
+	return kept, pruned
+}
+
+// pruneConfigAnnotation remove stale entries of config for given pod spec,
+// return a description of removed entries
+func pruneConfigAnnotation(config *configAnnotation, spec *v1.PodSpec) []string {
+	var prunedContainers, prunedInitContainers []string
+	config.Containers, prunedContainers = pruneConfigContainers(config.Containers, spec.Containers)
+	config.InitContainers, prunedInitContainers = pruneConfigContainers(config.InitContainers, spec.InitContainers)
+	pruned := make([]string, 0, len(prunedContainers)+len(prunedInitContainers))
+	for _, p := range prunedContainers {
+		pruned = append(pruned, "container "+p)
+	}
+	for _, p := range prunedInitContainers {
+		pruned = append(pruned, "init container "+p)
+	}
+	return pruned
+}
+
+// repositoryName return the normalized repository of given image reference,
+// without tag nor digest
+func (c *Config) repositoryName(image string) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	return c.normalizeImage(reference.TrimNamed(ref).String()), nil
+}
+
+// verifyConfigContainers check entries of the stored config against spec
+// containers, inconsistent entries are fixed in the returned entries
+func (c *Config) verifyConfigContainers(entries []configAnnotationImageSpec, containers []v1.Container) ([]configAnnotationImageSpec, []string) {
+	specImages := make(map[string]string)
+	for _, container := range containers {
+		specImages[container.Name] = container.Image
+	}
+	fixed := make([]configAnnotationImageSpec, 0, len(entries))
+	problems := make([]string, 0)
+	for _, entry := range entries {
+		specImage := specImages[entry.Name]
+		source, err := reference.ParseNormalizedNamed(entry.Image)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid recorded image %s: %s", entry.Name, entry.Image, err))
+			continue
+		}
+		if _, ok := source.(reference.Canonical); ok {
+			problems = append(problems, fmt.Sprintf("%s: recorded image %s is not a tag", entry.Name, entry.Image))
+			continue
+		}
+		if !strings.Contains(specImage, "@") {
+			if !c.sameImage(entry.Image, specImage) {
+				problems = append(problems, fmt.Sprintf("%s: image was changed from %s to %s", entry.Name, entry.Image, specImage))
+				entry.Image = specImage
+			}
+			fixed = append(fixed, entry)
+			continue
+		}
+		ref, err := reference.ParseNormalizedNamed(specImage)
+		if err == nil {
+			if canonical, ok := ref.(reference.Canonical); !ok {
+				err = fmt.Errorf("missing digest")
+			} else {
+				err = canonical.Digest().Validate()
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: malformed pinned image %s: %s", entry.Name, specImage, err))
+			fixed = append(fixed, entry)
+			continue
+		}
+		specRepository, _ := c.repositoryName(specImage)
+		sourceRepository, _ := c.repositoryName(entry.Image)
+		if specRepository != sourceRepository {
+			// the digest was set by hand, keep it as a fixed digest
+			problems = append(problems, fmt.Sprintf("%s: pinned image %s doesn't match recorded image %s", entry.Name, specImage, entry.Image))
+			continue
+		}
+		fixed = append(fixed, entry)
+	}
+	return fixed, problems
+}
+
+// verifyConfigAnnotation check config is consistent with given pod spec,
+// return a description of inconsistencies which are fixed in config
+func (c *Config) verifyConfigAnnotation(config *configAnnotation, spec *v1.PodSpec) []string {
+	problems := pruneConfigAnnotation(config, spec)
+	var containerProblems, initContainerProblems []string
+	config.Containers, containerProblems = c.verifyConfigContainers(config.Containers, spec.Containers)
+	config.InitContainers, initContainerProblems = c.verifyConfigContainers(config.InitContainers, spec.InitContainers)
+	for _, p := range containerProblems {
+		problems = append(problems, "container "+p)
+	}
+	for _, p := range initContainerProblems {
+		problems = append(problems, "init container "+p)
+	}
+	return problems
+}
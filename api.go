@@ -0,0 +1,246 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiTokenEnv is the environment variable holding the bearer token of the
+// status API and the gRPC API
+const apiTokenEnv = "IMAGO_API_TOKEN"
+
+// apiContainer is the outcome of the last run for a container
+type apiContainer struct {
+	Name string `json:"name"`
+	// Image is the image in spec, Source the image followed, CurrentDigest
+	// the digest it runs and LatestDigest the digest Source resolve to
+	Image         string `json:"image,omitempty"`
+	Source        string `json:"source,omitempty"`
+	CurrentDigest string `json:"currentDigest,omitempty"`
+	LatestDigest  string `json:"latestDigest,omitempty"`
+	Action        string `json:"action"`
+	NewImage      string `json:"newImage,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// apiWorkload is the outcome of the last run for a workload
+type apiWorkload struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	// Error is an error of the whole workload
+	Error      string         `json:"error,omitempty"`
+	Containers []apiContainer `json:"containers"`
+}
+
+// apiImage is a source image followed by containers of the last run
+type apiImage struct {
+	Image        string `json:"image"`
+	LatestDigest string `json:"latestDigest,omitempty"`
+	// Containers is the number of containers following the image, Outdated
+	// those having an update available
+	Containers int      `json:"containers"`
+	Outdated   int      `json:"outdated"`
+	Workloads  []string `json:"workloads"`
+}
+
+// apiStatus is the outcome of the last run served by the status API
+type apiStatus struct {
+	Run       string        `json:"run"`
+	Finished  time.Time     `json:"finished"`
+	ExitCode  int           `json:"exitCode"`
+	Errors    []reportError `json:"errors"`
+	Workloads []apiWorkload `json:"workloads"`
+	Images    []apiImage    `json:"images"`
+}
+
+// apiStatus return the status API view of the run
+func (r *Report) apiStatus() *apiStatus {
+	report := r.runReport()
+	status := &apiStatus{Run: report.Run, Finished: report.Finished, ExitCode: report.ExitCode, Errors: report.Errors, Workloads: make([]apiWorkload, 0), Images: make([]apiImage, 0)}
+	tracked := make(map[string]trackedImage)
+	for _, t := range r.tracked {
+		tracked[t.resource+" "+t.container] = t
+	}
+	workloads := make(map[string]int)
+	images := make(map[string]int)
+	for _, res := range r.results() {
+		// workloads are namespace/kind/name
+		parts := strings.SplitN(res.Workload, "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		i, ok := workloads[res.Workload]
+		if !ok {
+			i = len(status.Workloads)
+			workloads[res.Workload] = i
+			status.Workloads = append(status.Workloads, apiWorkload{Namespace: parts[0], Kind: parts[1], Name: parts[2], Containers: make([]apiContainer, 0)})
+		}
+		w := &status.Workloads[i]
+		if res.Container == "" {
+			w.Error = res.Error
+			continue
+		}
+		t := tracked[res.Workload+" "+res.Container]
+		w.Containers = append(w.Containers, apiContainer{res.Container, res.Image, t.source, t.currentDigest, res.Digest, res.Action, res.NewImage, res.Error})
+		if t.source == "" {
+			continue
+		}
+		j, ok := images[t.source]
+		if !ok {
+			j = len(status.Images)
+			images[t.source] = j
+			status.Images = append(status.Images, apiImage{Image: t.source, LatestDigest: t.latestDigest, Workloads: make([]string, 0)})
+		}
+		image := &status.Images[j]
+		image.Containers++
+		if res.Action == actionAvailable {
+			image.Outdated++
+		}
+		if n := len(image.Workloads); n == 0 || image.Workloads[n-1] != res.Workload {
+			image.Workloads = append(image.Workloads, res.Workload)
+		}
+	}
+	sort.Slice(status.Workloads, func(i, j int) bool {
+		a, b := status.Workloads[i], status.Workloads[j]
+		return fmt.Sprintf("%s/%s/%s", a.Namespace, a.Kind, a.Name) < fmt.Sprintf("%s/%s/%s", b.Namespace, b.Kind, b.Name)
+	})
+	sort.Slice(status.Images, func(i, j int) bool { return status.Images[i].Image < status.Images[j].Image })
+	return status
+}
+
+// apiUser is the basic auth user name of the dashboard, the token is the
+// password
+const apiUser = "imago"
+
+// statusAPI serve the outcome of the last run as JSON to clients
+// presenting the bearer token
+type statusAPI struct {
+	token  string
+	health *healthServer
+}
+
+// authorized return true if the request has the token, as bearer token or
+// as basic auth password of the apiUser for browsers
+func (a *statusAPI) authorized(req *http.Request) bool {
+	var token string
+	if user, password, ok := req.BasicAuth(); ok {
+		if user != apiUser {
+			return false
+		}
+		token = password
+	} else if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// serve answer with the status of the last run, filtered by the namespace
+// query parameter, or the part of it selected by fn
+func (a *statusAPI) serve(fn func(s *apiStatus, namespace string) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !a.authorized(req) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="imago"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		status := a.health.lastStatus()
+		if status == nil {
+			http.Error(w, "first run in progress", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(fn(status, req.URL.Query().Get("namespace"))); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// apiWorkloads return workloads of given namespace, all when empty
+func apiWorkloads(s *apiStatus, namespace string) interface{} {
+	workloads := make([]apiWorkload, 0)
+	for _, w := range s.Workloads {
+		if namespace == "" || w.Namespace == namespace {
+			workloads = append(workloads, w)
+		}
+	}
+	return map[string]interface{}{"run": s.Run, "finished": s.Finished, "workloads": workloads}
+}
+
+// apiImages return images followed by workloads of given namespace, all
+// when empty
+func apiImages(s *apiStatus, namespace string) interface{} {
+	images := make([]apiImage, 0)
+	for _, image := range s.Images {
+		for _, w := range image.Workloads {
+			if namespace == "" || strings.HasPrefix(w, namespace+"/") {
+				images = append(images, image)
+				break
+			}
+		}
+	}
+	return map[string]interface{}{"run": s.Run, "finished": s.Finished, "images": images}
+}
+
+// register serve the status API and the dashboard on given mux
+func (a *statusAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("/", a.dashboard)
+	mux.HandleFunc("/api/v1/workloads", a.serve(apiWorkloads))
+	mux.HandleFunc("/api/v1/images", a.serve(apiImages))
+}
+
+// listenAPI serve the status API and the dashboard on given address, over
+// TLS when a certificate is given
+func listenAPI(addr string, token string, certFile string, keyFile string, h *healthServer) error {
+	mux := http.NewServeMux()
+	(&statusAPI{token: token, health: h}).register(mux)
+	server := &http.Server{Handler: mux}
+	if certFile != "" {
+		cert := &servingCertificate{certFile: certFile, keyFile: keyFile}
+		if _, err := cert.load(); err != nil {
+			return fmt.Errorf("unable to load the status API certificate: %s", err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: cert.GetCertificate}
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to serve the status API: %s", err)
+	}
+	go func() {
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(l, "", "")
+		} else {
+			err = server.Serve(l)
+		}
+		log.Printf("unable to serve the status API: %s", err)
+	}()
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authHTTPClient is used to request tokens from cloud identity services
+var authHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// authProvider get short lived registry credentials from the environment
+// imago runs in, for registries the docker config has no credentials for
+type authProvider interface {
+	// matches return whether the provider has credentials for given host
+	matches(host string) bool
+	credentials(ctx context.Context, host string) (*DockerRegistryCredentials, error)
+	String() string
+}
+
+// authProviders are providers available with -auth-provider, by name
+var authProviders = map[string]func() authProvider{
+	"azure":  func() authProvider { return &azureAuthProvider{} },
+	"gcp":    func() authProvider { return &gcpAuthProvider{} },
+	"github": func() authProvider { return &githubAuthProvider{} },
+}
+
+// newAuthProvider return the provider of given name
+func newAuthProvider(name string) (authProvider, error) {
+	newProvider, ok := authProviders[name]
+	if !ok {
+		names := make([]string, 0, len(authProviders))
+		for name := range authProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown auth provider %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return newProvider(), nil
+}
+
+// cachedToken keep an access token until shortly before it expires
+type cachedToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// get return the cached token or a new one from fetch
+func (t *cachedToken) get(fetch func() (string, time.Time, error)) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expires) {
+		return t.token, nil
+	}
+	token, expires, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	t.token, t.expires = token, expires
+	return token, nil
+}
+
+// hostCredentials return the credentials to use for given registry host or
+// nil, from docker config first, then from given image pull secrets of a
+// workload and finally from auth providers
+func (c *Config) hostCredentials(host string, pullSecrets *dockerConfig) (*DockerRegistryCredentials, error) {
+	for _, config := range []*dockerConfig{c.dockerConfig, pullSecrets} {
+		if config == nil {
+			continue
+		}
+		auth, err := config.lookup(host)
+		if auth != nil || err != nil {
+			return auth, err
+		}
+	}
+	p := c.authProviderOf(host)
+	if p == nil {
+		return nil, nil
+	}
+	auth, err := p.credentials(c.context, host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get credentials of %s from %s: %w", host, p, err)
+	}
+	return auth, nil
+}
+
+// authProviderOf return the auth provider of given host or nil
+func (c *Config) authProviderOf(host string) authProvider {
+	for _, p := range c.authProviders {
+		if p.matches(host) {
+			return p
+		}
+	}
+	return nil
+}
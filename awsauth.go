@@ -0,0 +1,194 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsCredentials are AWS access keys, with a session token for temporary
+// credentials
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// awsRegion return the region of AWS_REGION or AWS_DEFAULT_REGION,
+// us-east-1 by default
+func awsRegion() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// awsEnvCredentials return credentials of AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or of the role of
+// AWS_ROLE_ARN assumed with the web identity token of
+// AWS_WEB_IDENTITY_TOKEN_FILE (EKS IAM roles for service accounts). Other
+// sources of the AWS SDKs, such as shared credentials files, profiles and
+// instance metadata, aren't supported.
+func awsEnvCredentials(ctx context.Context) (*awsCredentials, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey != "" && secretKey != "" {
+		return &awsCredentials{accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN != "" && tokenFile != "" {
+		return assumeRoleWithWebIdentity(ctx, roleARN, tokenFile)
+	}
+	return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE must be set, other AWS credential sources aren't supported")
+}
+
+// assumeRoleWithWebIdentity exchange the web identity token of given file
+// for temporary credentials of given role with the regional STS endpoint,
+// or AWS_ENDPOINT_URL_STS
+func assumeRoleWithWebIdentity(ctx context.Context, roleARN string, tokenFile string) (*awsCredentials, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "imago"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_STS")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", awsRegion())
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to assume role %s: %s", roleARN, err)
+	}
+	defer closeResource(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to assume role %s: %s", roleARN, resp.Status)
+	}
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to assume role %s: %s", roleARN, err)
+	}
+	creds := result.Credentials
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("unable to assume role %s: no credentials in STS response", roleARN)
+	}
+	return &awsCredentials{creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken}, nil
+}
+
+// awsURIEncode encode given string as required by AWS signature version 4:
+// every byte except unreserved characters of RFC 3986, and slashes unless
+// encodeSlash is false
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signAWSv4 sign given request with AWS signature version 4 for given
+// region and service, with the hex SHA-256 of the payload. The request
+// path is sent encoded as signed, host and all headers set are signed.
+func signAWSv4(req *http.Request, creds *awsCredentials, region string, service string, payloadHash string, now time.Time) {
+	amzDate, day := now.UTC().Format("20060102T150405Z"), now.UTC().Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	canonicalURI := awsURIEncode(req.URL.Path, false)
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	req.URL.RawPath = canonicalURI
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	signed := make([]string, 0, len(headers))
+	for name := range headers {
+		signed = append(signed, name)
+	}
+	sort.Strings(signed)
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonicalRequest := strings.Join([]string{req.Method, canonicalURI, strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", day, region, service)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest)))}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+creds.secretKey), day)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const azureResource = "https://management.azure.com/"
+
+// Endpoints of Azure identity services, replaced in tests
+var (
+	azureIMDSURL      = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureAuthorityURL = "https://login.microsoftonline.com"
+	acrExchangeURL    = "https://%s/oauth2/exchange"
+)
+
+// acrUsername is the user name docker login use with ACR refresh tokens
+const acrUsername = "00000000-0000-0000-0000-000000000000"
+
+// acrRefreshTokenLifetime is how long ACR refresh tokens are reused, they
+// are valid for 3 hours
+const acrRefreshTokenLifetime = time.Hour
+
+// azureAuthProvider get refresh tokens of Azure Container Registry from an
+// Azure AD token of the service principal of AZURE_CLIENT_ID,
+// AZURE_TENANT_ID and AZURE_CLIENT_SECRET, of AKS workload identity
+// (AZURE_FEDERATED_TOKEN_FILE) or of the managed identity of the node
+type azureAuthProvider struct {
+	token cachedToken
+	mu    sync.Mutex
+	// registryTokens are ACR refresh tokens by registry host
+	registryTokens map[string]*cachedToken
+}
+
+func (p *azureAuthProvider) String() string {
+	return "azure identity"
+}
+
+func (p *azureAuthProvider) matches(host string) bool {
+	return strings.HasSuffix(host, ".azurecr.io")
+}
+
+func (p *azureAuthProvider) credentials(ctx context.Context, host string) (*DockerRegistryCredentials, error) {
+	p.mu.Lock()
+	if p.registryTokens == nil {
+		p.registryTokens = make(map[string]*cachedToken)
+	}
+	registryToken, ok := p.registryTokens[host]
+	if !ok {
+		registryToken = &cachedToken{}
+		p.registryTokens[host] = registryToken
+	}
+	p.mu.Unlock()
+	token, err := registryToken.get(func() (string, time.Time, error) {
+		accessToken, err := p.token.get(func() (string, time.Time, error) {
+			return azureAccessToken(ctx)
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		refreshToken, err := acrRefreshToken(ctx, host, accessToken)
+		return refreshToken, time.Now().Add(acrRefreshTokenLifetime), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DockerRegistryCredentials{Username: acrUsername, Password: token}, nil
+}
+
+// azureAccessToken return an Azure AD access token of the Azure resource
+// manager and its expiration time
+func azureAccessToken(ctx context.Context) (string, time.Time, error) {
+	clientID, tenantID := os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_TENANT_ID")
+	form := url.Values{}
+	switch {
+	case clientID != "" && tenantID != "" && os.Getenv("AZURE_CLIENT_SECRET") != "":
+		form.Set("client_secret", os.Getenv("AZURE_CLIENT_SECRET"))
+	case clientID != "" && tenantID != "" && os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "":
+		assertion, err := ioutil.ReadFile(os.Getenv("AZURE_FEDERATED_TOKEN_FILE"))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	default:
+		// managed identity, AZURE_CLIENT_ID select a user assigned
+		// identity
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureResource}}
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureIMDSURL+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Metadata", "true")
+		return requestAccessToken(req)
+	}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("scope", azureResource+".default")
+	u := fmt.Sprintf("%s/%s/oauth2/v2.0/token", azureAuthorityURL, url.PathEscape(tenantID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return requestAccessToken(req)
+}
+
+// acrRefreshToken exchange an Azure AD access token for a refresh token of
+// given registry
+func acrRefreshToken(ctx context.Context, host string, accessToken string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"access_token": {accessToken},
+	}
+	if tenantID := os.Getenv("AZURE_TENANT_ID"); tenantID != "" {
+		form.Set("tenant", tenantID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(acrExchangeURL, host), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer closeResource(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("%s token exchange: %s %s", host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&exchange); err != nil {
+		return "", err
+	}
+	if exchange.RefreshToken == "" {
+		return "", fmt.Errorf("%s token exchange: no refresh token in response", host)
+	}
+	return exchange.RefreshToken, nil
+}
@@ -0,0 +1,426 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagoChannelAnnotation select the release channel followed by containers
+// of a workload, either "channel" for all containers or
+// "container=channel,...". The imago/channel.<container> annotation select
+// the channel of a container, its whole value being the channel.
+const imagoChannelAnnotation = "imago/channel"
+
+// semverRe match tags like 1, 1.24, v1.24.3 or 1.24.3-rc.1+build
+var semverRe = regexp.MustCompile(`^v?(0|[1-9][0-9]*)(?:\.(0|[1-9][0-9]*))?(?:\.(0|[1-9][0-9]*))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// semver is a version parsed from an image tag
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+// parseSemver parse given tag as a semantic version
+func parseSemver(tag string) (*semver, bool) {
+	match := semverRe.FindStringSubmatch(tag)
+	if match == nil {
+		return nil, false
+	}
+	v := &semver{prerelease: match[4]}
+	v.major, _ = strconv.Atoi(match[1])
+	if match[2] != "" {
+		v.minor, _ = strconv.Atoi(match[2])
+	}
+	if match[3] != "" {
+		v.patch, _ = strconv.Atoi(match[3])
+	}
+	return v, true
+}
+
+// compare return -1, 0 or 1 if v is lower, equal or greater than other,
+// prereleases are compared lexically
+func (v *semver) compare(other *semver) int {
+	for _, d := range []int{v.major - other.major, v.minor - other.minor, v.patch - other.patch} {
+		if d < 0 {
+			return -1
+		} else if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	case v.prerelease < other.prerelease:
+		return -1
+	}
+	return 1
+}
+
+// channel track the highest non prerelease version matching a version
+// prefix or range
+type channel struct {
+	name string
+	// prefix hold the major and minor versions required, if any
+	prefix []int
+	// rule and bounds are the version range of semver: channels
+	rule   string
+	bounds []semverBound
+	// pattern select tags of regex: channels, which track the most
+	// recently created image instead of the highest version
+	pattern *regexp.Regexp
+}
+
+// parseChannel parse a channel definition like "stable=*" or "lts=1.24"
+func parseChannel(name string, rule string) (*channel, error) {
+	if strings.HasPrefix(rule, semverChannelPrefix) {
+		return parseSemverChannel(name, strings.TrimPrefix(rule, semverChannelPrefix))
+	}
+	if strings.HasPrefix(rule, regexChannelPrefix) {
+		return parseRegexChannel(name, strings.TrimPrefix(rule, regexChannelPrefix))
+	}
+	c := &channel{name: name}
+	if rule == "*" {
+		return c, nil
+	}
+	parts := strings.Split(rule, ".")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid channel %s=%s, expected * or a major[.minor] version", name, rule)
+	}
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid channel %s=%s, expected * or a major[.minor] version", name, rule)
+		}
+		c.prefix = append(c.prefix, n)
+	}
+	return c, nil
+}
+
+func (c *channel) String() string {
+	switch {
+	case c.rule == c.name:
+		// channel defined in an annotation
+		return c.name
+	case c.rule != "":
+		return c.name + "=" + c.rule
+	}
+	if len(c.prefix) == 0 {
+		return c.name + "=*"
+	}
+	parts := make([]string, len(c.prefix))
+	for i, n := range c.prefix {
+		parts[i] = strconv.Itoa(n)
+	}
+	return c.name + "=" + strings.Join(parts, ".")
+}
+
+func (c *channel) match(v *semver) bool {
+	if v.prerelease != "" {
+		return false
+	}
+	versions := []int{v.major, v.minor}
+	for i, n := range c.prefix {
+		if versions[i] != n {
+			return false
+		}
+	}
+	for _, b := range c.bounds {
+		if !b.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates return tags of given tags in the channel, highest version
+// first. Tags of regex: channels are in reverse natural order (numbers
+// compared by value), they are ordered by creation date afterward.
+func (c *channel) candidates(tags []string) []string {
+	if c.pattern != nil {
+		matching := make([]string, 0)
+		for _, tag := range tags {
+			if c.pattern.MatchString(tag) {
+				matching = append(matching, tag)
+			}
+		}
+		sort.Slice(matching, func(i, j int) bool {
+			return naturalLess(matching[j], matching[i])
+		})
+		return matching
+	}
+	type version struct {
+		tag string
+		v   *semver
+	}
+	versions := make([]version, 0)
+	for _, tag := range tags {
+		if v, ok := parseSemver(tag); ok && c.match(v) {
+			versions = append(versions, version{tag, v})
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if cmp := versions[i].v.compare(versions[j].v); cmp != 0 {
+			return cmp > 0
+		}
+		return versions[i].tag < versions[j].tag
+	})
+	result := make([]string, len(versions))
+	for i, v := range versions {
+		result[i] = v.tag
+	}
+	return result
+}
+
+// latest return the highest tag of given tags in the channel
+func (c *channel) latest(tags []string) (string, error) {
+	candidates := c.candidates(tags)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no tag in channel %s", c)
+	}
+	return candidates[0], nil
+}
+
+// workloadChannels return the channel followed by each container of given
+// workload, "" is the channel of containers not explicitly listed
+func (c *Config) workloadChannels(meta *metav1.ObjectMeta) (map[string]*channel, error) {
+	annotations := meta.GetAnnotations()
+	result := make(map[string]*channel)
+	rest := annotations[imagoChannelAnnotation]
+	for rest != "" {
+		// a regex: channel may contain commas, it takes the rest of
+		// the annotation
+		item := rest
+		rest = ""
+		if i := strings.Index(item, ","); i >= 0 {
+			if _, rule := splitChannelItem(item[:i]); !strings.HasPrefix(rule, regexChannelPrefix) {
+				item, rest = item[:i], item[i+1:]
+			}
+		}
+		container, rule := splitChannelItem(item)
+		ch, err := c.annotationChannel(rule, imagoChannelAnnotation)
+		if err != nil {
+			return nil, err
+		}
+		result[container] = ch
+	}
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, imagoChannelAnnotation+".") {
+			continue
+		}
+		ch, err := c.annotationChannel(strings.TrimSpace(value), key)
+		if err != nil {
+			return nil, err
+		}
+		result[strings.TrimPrefix(key, imagoChannelAnnotation+".")] = ch
+	}
+	return result, nil
+}
+
+// splitChannelItem split a container=channel item of imagoChannelAnnotation,
+// the container is empty for items without container
+func splitChannelItem(item string) (string, string) {
+	item = strings.TrimSpace(item)
+	if strings.HasPrefix(item, semverChannelPrefix) || strings.HasPrefix(item, regexChannelPrefix) {
+		return "", item
+	}
+	if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+		return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	}
+	return "", item
+}
+
+// annotationChannel return the channel of given rule of annotation key,
+// the name of a -channel or an inline semver: or regex: channel
+func (c *Config) annotationChannel(rule string, key string) (*channel, error) {
+	if strings.HasPrefix(rule, semverChannelPrefix) || strings.HasPrefix(rule, regexChannelPrefix) {
+		ch, err := parseChannel(rule, rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s annotation", err, key)
+		}
+		return ch, nil
+	}
+	ch, ok := c.channels[rule]
+	if !ok {
+		return nil, fmt.Errorf("unknown channel %s in %s annotation", rule, key)
+	}
+	return ch, nil
+}
+
+// channelImage return the image of the highest tag of given channel, in the
+// repository of given image
+func (c *Config) channelImage(image string, ch *channel, auth *DockerRegistryCredentials) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	ref = reference.TrimNamed(ref)
+	tags, err := c.reg.ListTags(c.context, ref, auth)
+	if err != nil {
+		return "", err
+	}
+	candidates := ch.candidates(tags)
+	if ch.pattern != nil {
+		candidates = c.newestFirst(ref, candidates, auth)
+	}
+	skipped := 0
+	for _, tag := range candidates {
+		tagged, err := reference.WithTag(ref, tag)
+		if err != nil {
+			return "", err
+		}
+		if pattern := c.deniedTag(tag); pattern != "" {
+			log.Printf("    skipping %s: denied by %s", reference.FamiliarString(tagged), pattern)
+			skipped++
+			continue
+		}
+		if c.minTagAge > 0 {
+			if err := c.checkTagAge(tagged, auth); err != nil {
+				log.Printf("    skipping %s: %s", reference.FamiliarString(tagged), err)
+				skipped++
+				continue
+			}
+		}
+		return reference.FamiliarString(tagged), nil
+	}
+	if skipped > 0 {
+		return "", fmt.Errorf("no tag in channel %s (%d denied or too recent tags skipped)", ch, skipped)
+	}
+	return "", fmt.Errorf("no tag in channel %s", ch)
+}
+
+// deniedTag return the denylist pattern matching given tag, or ""
+func (c *Config) deniedTag(tag string) string {
+	for _, pattern := range c.denyTags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// checkTagAge return an error if the image of given tag was created less
+// than minTagAge ago
+func (c *Config) checkTagAge(tagged reference.NamedTagged, auth *DockerRegistryCredentials) error {
+	created, err := c.tagCreated(tagged, auth)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(created); age < c.minTagAge {
+		return fmt.Errorf("created %s ago, less than %s", age.Truncate(time.Minute), c.minTagAge)
+	}
+	return nil
+}
+
+// parseAge parse a duration which can also be given in days, like 7d
+func parseAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid age %s", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// updateReason describe why the digest of given image changed: a new version
+// was released under a more specific tag (e.g. 1.2.5 for 1.2 or latest) or
+// the tag was re-pointed without any new version tag
+func (c *Config) updateReason(image string, digest string, ch *channel, auth *DockerRegistryCredentials) string {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "digest changed"
+	}
+	tagged, ok := reference.TagNameOnly(ref).(reference.NamedTagged)
+	if !ok {
+		return "digest changed"
+	}
+	tag := tagged.Tag()
+	if ch != nil {
+		return fmt.Sprintf("%s is the latest tag of channel %s", tag, ch.name)
+	}
+	retagged := fmt.Sprintf("tag %s re-pointed, no new version tag", tag)
+	versions := &channel{name: tag}
+	if v := semverRe.FindStringSubmatch(tag); v != nil {
+		if v[3] != "" || v[4] != "" {
+			// a complete version has no more specific tag
+			return retagged
+		}
+		versions.prefix, _ = versionPrefix(v)
+	}
+	if c.reg == nil {
+		// digests resolved without registry client, tags can't be listed
+		return fmt.Sprintf("tag %s changed", tag)
+	}
+	tags, err := c.reg.ListTags(c.context, reference.TrimNamed(ref), auth)
+	if err != nil {
+		log.Printf("    unable to look for new version tags of %s: %s", image, err)
+		return fmt.Sprintf("tag %s changed", tag)
+	}
+	others := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t != tag {
+			others = append(others, t)
+		}
+	}
+	latest, err := versions.latest(others)
+	if err != nil {
+		return retagged
+	}
+	latestImage, err := reference.WithTag(reference.TrimNamed(ref), latest)
+	if err != nil {
+		return retagged
+	}
+	latestDigest, err := c.reg.GetDigest(c.context, latestImage.String(), auth)
+	if err != nil {
+		log.Printf("    unable to get digest of %s: %s", latestImage, err)
+		return fmt.Sprintf("tag %s changed", tag)
+	}
+	if latestDigest == digest {
+		return fmt.Sprintf("new version %s", latest)
+	}
+	return retagged
+}
+
+// versionPrefix return the major and minor versions given in a semver match
+func versionPrefix(match []string) ([]int, error) {
+	prefix := make([]int, 0, 2)
+	for _, part := range match[1:3] {
+		if part == "" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		prefix = append(prefix, n)
+	}
+	return prefix, nil
+}
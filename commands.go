@@ -0,0 +1,372 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type command struct {
+	description string
+	run         func(args []string)
+}
+
+// commands are the imago subcommands, running imago without a command
+// check (and update) images
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"controller":   {"reconcile ImagoPolicy resources, checking or updating workloads they select on their schedule", controllerCommand},
+		"explain":      {"explain why containers of a workload are updated or not", explainCommand},
+		"prune":        {"remove imago metadata from workloads, images are left untouched", pruneCommand},
+		"prune-config": {"remove stale entries from imago-config-spec annotations", pruneConfigCommand},
+		"report":       {"compare two run reports: changed images, newly outdated workloads and resolved errors", reportCommand},
+		"restore":      {"restore images of workloads recorded in a snapshot", restoreCommand},
+		"rollback":     {"restore images a workload ran before its last update by imago", rollbackCommand},
+		"snapshot":     {"record image digests of workloads in a file, to be restored later", snapshotCommand},
+		"status":       {"show pinned images of workloads with their current and latest digests, nothing is modified", statusCommand},
+		"unpin":        {"restore tags recorded in imago-config-spec annotations and remove imago metadata from workloads", unpinCommand},
+		"verify":       {"check imago-config-spec annotations are consistent with workloads", verifyCommand},
+		"webhook":      {"run a mutating admission webhook pinning images of admitted workloads to their digest", webhookCommand},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(out, "  %s [flags]\n", os.Args[0])
+	fmt.Fprintf(out, "  %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// newCommandFlags return the flag set of given command, with workload
+// selection flags registered
+func newCommandFlags(name string, selection *selectionFlags) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s %s: %s\n", os.Args[0], name, commands[name].description)
+		flags.PrintDefaults()
+	}
+	selection.register(flags)
+	return flags
+}
+
+// forEachWorkload call fn for each workload selected by given flags, errors
+// are recorded in the report
+func forEachWorkload(selection *selectionFlags, report *Report, fn func(c *Config, w workload) error) {
+	configs, err := selection.configs("", false, report)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	for _, c := range configs {
+		workloads, listErrors := c.listWorkloads(selection.fieldSelector, selection.labelSelector)
+		for _, err := range listErrors {
+			log.Print(err)
+			report.AddError(classifyError(err), err)
+		}
+		for _, w := range workloads {
+			if err := fn(c, w); err != nil {
+				err = fmt.Errorf("%s/%s/%s: %w", w.meta.Namespace, w.kind, w.meta.Name, err)
+				log.Print(err)
+				report.AddError(classifyError(err), err)
+			}
+		}
+	}
+}
+
+// finish print the report summary and exit with matching code
+func finish(report *Report) {
+	writeReport(report)
+	os.Exit(report.ExitCode())
+}
+
+// writeReport log the summary of the run and write its reports
+func writeReport(report *Report) {
+	for _, line := range report.Summary() {
+		log.Print(line)
+	}
+	if report.output != "" {
+		if err := report.writeOutput(os.Stdout, report.output); err != nil {
+			log.Printf("unable to write run output: %s", err)
+		}
+	}
+	if err := report.githubActions(); err != nil {
+		log.Printf("unable to write GitHub Actions job summary: %s", err)
+	}
+	if report.exportDependencies != "" {
+		if err := report.writeDependencies(report.exportDependencies); err != nil {
+			log.Printf("unable to write dependencies export: %s", err)
+		}
+	}
+	if report.history != "" {
+		if err := report.appendHistory(report.history); err != nil {
+			log.Printf("unable to write history: %s", err)
+		}
+	}
+	if report.historyDSN != "" {
+		if err := report.recordHistory(context.Background(), report.historyDSN); err != nil {
+			log.Printf("unable to record history: %s", err)
+		}
+	}
+	for _, destination := range report.uploads {
+		if err := report.upload(context.Background(), destination); err != nil {
+			log.Printf("unable to upload run report to %s: %s", report.uploadKey(destination), err)
+		}
+	}
+	for _, destination := range report.auditUploads {
+		if err := report.uploadAuditLog(context.Background(), destination); err != nil {
+			log.Printf("unable to upload audit log to %s: %s", report.uploadKey(destination), err)
+		}
+	}
+	for _, u := range report.notifyURLs {
+		if err := report.notify(context.Background(), u, os.Getenv(notifySecretEnv)); err != nil {
+			log.Printf("unable to send run output: %s", err)
+		}
+	}
+	if report.pushgateway != "" {
+		if err := report.pushMetrics(context.Background(), report.pushgateway); err != nil {
+			log.Printf("unable to push metrics: %s", err)
+		}
+	}
+	if report.gitlabCodeQuality != "" {
+		if err := report.writeGitLabCodeQuality(report.gitlabCodeQuality); err != nil {
+			log.Printf("unable to write GitLab code quality report: %s", err)
+		}
+	}
+}
+
+func pruneConfigCommand(args []string) {
+	var selection selectionFlags
+	var dryRun bool
+	flags := newCommandFlags("prune-config", &selection)
+	flags.BoolVar(&dryRun, "dry-run", false, "only show entries that would be removed (default false)")
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	report := NewReport()
+	forEachWorkload(&selection, report, func(c *Config, w workload) error {
+		config, err := c.loadConfigAnnotation(w.meta)
+		if err != nil || config == nil {
+			return err
+		}
+		pruned := pruneConfigAnnotation(config, &w.template.Spec)
+		if len(pruned) == 0 {
+			return nil
+		}
+		for _, p := range pruned {
+			log.Printf("%s/%s/%s: pruning %s", w.meta.Namespace, w.kind, w.meta.Name, p)
+		}
+		if dryRun {
+			return nil
+		}
+		return c.updateWorkload(w.kind, w.meta.Namespace, w.meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+			config, err := c.loadConfigAnnotation(meta)
+			if err != nil || config == nil {
+				return err
+			}
+			pruneConfigAnnotation(config, &template.Spec)
+			return c.storeConfigAnnotation(w.kind, meta, config)
+		})
+	})
+	finish(report)
+}
+
+func pruneCommand(args []string) {
+	var selection selectionFlags
+	var dryRun bool
+	var restartedAt bool
+	flags := newCommandFlags("prune", &selection)
+	flags.BoolVar(&dryRun, "dry-run", false, "only show metadata that would be removed (default false)")
+	flags.BoolVar(&restartedAt, "restarted-at", false, fmt.Sprintf("also remove the %s pod template annotation, this trigger a rollout (default false)", imagoRestartedAtAnnotation))
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	report := NewReport()
+	forEachWorkload(&selection, report, func(c *Config, w workload) error {
+		resource := fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)
+		_, hasConfig := w.meta.Annotations[imagoConfigAnnotation]
+		_, hasPrevious := w.meta.Annotations[imagoPreviousImagesAnnotation]
+		_, hasPinned := w.meta.Annotations[imagoPinnedImagesAnnotation]
+		_, hasRestartedAt := w.template.Annotations[imagoRestartedAtAnnotation]
+		hasRestartedAt = hasRestartedAt && restartedAt
+		if !hasConfig && !hasPrevious && !hasPinned && !hasRestartedAt {
+			return nil
+		}
+		if hasConfig {
+			log.Printf("%s: removing %s annotation", resource, imagoConfigAnnotation)
+		}
+		if hasPrevious {
+			log.Printf("%s: removing %s annotation", resource, imagoPreviousImagesAnnotation)
+		}
+		if hasPinned {
+			log.Printf("%s: removing %s annotation", resource, imagoPinnedImagesAnnotation)
+		}
+		if hasRestartedAt {
+			log.Printf("%s: removing %s pod template annotation", resource, imagoRestartedAtAnnotation)
+		}
+		if dryRun {
+			return nil
+		}
+		return c.updateWorkload(w.kind, w.meta.Namespace, w.meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+			if err := c.deleteConfigMap(w.kind, meta); err != nil {
+				return err
+			}
+			delete(meta.Annotations, imagoConfigAnnotation)
+			delete(meta.Annotations, imagoPreviousImagesAnnotation)
+			delete(meta.Annotations, imagoPinnedImagesAnnotation)
+			if restartedAt {
+				delete(template.Annotations, imagoRestartedAtAnnotation)
+			}
+			return nil
+		})
+	})
+	finish(report)
+}
+
+// unpinImages set images of containers of given template to their recorded
+// tag, returning tags restored indexed by container name
+func unpinImages(template *v1.PodTemplateSpec, config *configAnnotation) map[string]string {
+	restored := make(map[string]string)
+	unpin := func(containers []v1.Container, entries []configAnnotationImageSpec) {
+		for i, container := range containers {
+			for _, entry := range entries {
+				if entry.Name == container.Name && entry.Image != container.Image {
+					restored[container.Name] = entry.Image
+					containers[i].Image = entry.Image
+				}
+			}
+		}
+	}
+	unpin(template.Spec.InitContainers, config.InitContainers)
+	unpin(template.Spec.Containers, config.Containers)
+	return restored
+}
+
+func unpinCommand(args []string) {
+	var selection selectionFlags
+	var dryRun bool
+	flags := newCommandFlags("unpin", &selection)
+	flags.BoolVar(&dryRun, "dry-run", false, "only show images that would be restored (default false)")
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	report := NewReport()
+	forEachWorkload(&selection, report, func(c *Config, w workload) error {
+		resource := fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)
+		config, err := c.loadConfigAnnotation(w.meta)
+		if err != nil || config == nil {
+			return err
+		}
+		restored := unpinImages(w.template.DeepCopy(), config)
+		for _, containers := range [][]v1.Container{w.template.Spec.InitContainers, w.template.Spec.Containers} {
+			for _, container := range containers {
+				if image, ok := restored[container.Name]; ok {
+					log.Printf("%s: restoring container %s from %s to %s", resource, container.Name, container.Image, image)
+				}
+			}
+		}
+		log.Printf("%s: removing %s annotation", resource, imagoConfigAnnotation)
+		if dryRun {
+			return nil
+		}
+		return c.updateWorkload(w.kind, w.meta.Namespace, w.meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+			config, err := c.loadConfigAnnotation(meta)
+			if err != nil || config == nil {
+				return err
+			}
+			unpinImages(template, config)
+			if err := c.deleteConfigMap(w.kind, meta); err != nil {
+				return err
+			}
+			delete(meta.Annotations, imagoConfigAnnotation)
+			delete(meta.Annotations, imagoPreviousImagesAnnotation)
+			delete(meta.Annotations, imagoPinnedImagesAnnotation)
+			return nil
+		})
+	})
+	finish(report)
+}
+
+func verifyCommand(args []string) {
+	var selection selectionFlags
+	var fix bool
+	flags := newCommandFlags("verify", &selection)
+	flags.BoolVar(&fix, "fix", false, "fix inconsistencies, unreadable annotations are removed (default false)")
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	report := NewReport()
+	forEachWorkload(&selection, report, func(c *Config, w workload) error {
+		resource := fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)
+		config, err := c.loadConfigAnnotation(w.meta)
+		if err != nil {
+			err = fmt.Errorf("%s: unable to read %s: %w", resource, imagoConfigAnnotation, err)
+			log.Print(err)
+			report.AddError(configErrorClass, err)
+			if !fix {
+				return nil
+			}
+			log.Printf("%s: removing %s annotation", resource, imagoConfigAnnotation)
+			return c.updateWorkload(w.kind, w.meta.Namespace, w.meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+				delete(meta.Annotations, imagoConfigAnnotation)
+				return nil
+			})
+		}
+		if config == nil {
+			return nil
+		}
+		problems := c.verifyConfigAnnotation(config, &w.template.Spec)
+		if len(problems) == 0 {
+			log.Printf("%s ok", resource)
+			return nil
+		}
+		for _, p := range problems {
+			err := fmt.Errorf("%s: %s", resource, p)
+			log.Print(err)
+			report.AddError(configErrorClass, err)
+		}
+		if !fix {
+			return nil
+		}
+		log.Printf("%s: fixing %s annotation", resource, imagoConfigAnnotation)
+		return c.updateWorkload(w.kind, w.meta.Namespace, w.meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+			config, err := c.loadConfigAnnotation(meta)
+			if err != nil || config == nil {
+				return err
+			}
+			c.verifyConfigAnnotation(config, &template.Spec)
+			return c.storeConfigAnnotation(w.kind, meta, config)
+		})
+	})
+	finish(report)
+}
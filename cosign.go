@@ -0,0 +1,134 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	cosignSignatureMediaType  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// errUnsigned is returned when an image has no signature valid for
+// -cosign-key keys
+var errUnsigned = errors.New("no valid cosign signature")
+
+// loadCosignKey read a PEM public key of cosign signatures, like cosign.pub
+// written by cosign generate-key-pair
+func loadCosignKey(path string) (crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM public key found in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// verifyBlob check signature of payload with given public key
+func verifyBlob(key crypto.PublicKey, payload []byte, signature []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, hash[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, signature)
+	}
+	return false
+}
+
+// cosignPayload is the simple signing payload signed by cosign
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifySignature check the image of given digest has a cosign signature,
+// stored in the sha256-<digest>.sig tag of its repository, valid for one
+// of -cosign-key keys
+func (c *Config) verifySignature(image string, digest string, auth *DockerRegistryCredentials) error {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return err
+	}
+	ref := reference.TrimNamed(named)
+	sigTag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	b, _, err := c.reg.GetManifest(c.context, ref, sigTag, auth)
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) && reqErr.Status == http.StatusNotFound {
+		return errUnsigned
+	} else if err != nil {
+		return fmt.Errorf("unable to get signatures: %w", err)
+	}
+	var m imgspecv1.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("invalid signature manifest: %w", err)
+	}
+	for _, layer := range m.Layers {
+		if layer.MediaType != cosignSignatureMediaType || layer.Annotations[cosignSignatureAnnotation] == "" {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil {
+			continue
+		}
+		payload, err := c.reg.GetBlob(c.context, ref, string(layer.Digest), auth)
+		if err != nil {
+			return fmt.Errorf("unable to get signature payload: %w", err)
+		}
+		if layer.Digest.Validate() != nil || layer.Digest.Algorithm().FromBytes(payload) != layer.Digest {
+			continue
+		}
+		var p cosignPayload
+		if err := json.Unmarshal(payload, &p); err != nil || p.Critical.Image.DockerManifestDigest != digest {
+			continue
+		}
+		for _, key := range c.cosignKeys {
+			if verifyBlob(key, payload, signature) {
+				return nil
+			}
+		}
+	}
+	return errUnsigned
+}
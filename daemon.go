@@ -0,0 +1,91 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// signalContext return a context canceled on SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// reexec replace the process with a new one of the same executable and
+// arguments, so that flags are parsed and defaults loaded again
+func reexec() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
+
+// daemon call run every interval, plus up to 10% of jitter so that imago
+// instances of several clusters don't hit registries at the same time,
+// until ctx is canceled. A run in progress is completed before exiting.
+func daemon(ctx context.Context, interval time.Duration, run func()) {
+	rand.Seed(time.Now().UnixNano())
+	for {
+		run()
+		delay := interval + time.Duration(rand.Int63n(int64(interval)/10+1))
+		log.Printf("next run in %s", delay.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			log.Print("stopping")
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// reset forget digests older than the cache TTL, tokens (credentials
+// are reloaded) and registry checks of the previous run, connections,
+// pacing and last known manifests are kept
+func (r *RegistryClient) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, cached := range r.cache {
+		if time.Since(cached.resolved) >= r.cacheTTL {
+			delete(r.cache, key)
+			delete(r.resolved, key)
+		}
+	}
+	r.tokens = make(map[string]registryToken)
+	r.pings = make(map[string]error)
+	r.warnings = nil
+	r.moved = nil
+	for _, pacer := range r.pacers {
+		pacer.mu.Lock()
+		pacer.throttled = 0
+		pacer.rateWarned = false
+		pacer.mu.Unlock()
+	}
+}
+
+// resetCaches forget secrets, service accounts, namespaces and node images
+// of the previous run
+func (c *Config) resetCaches() {
+	c.secretCache = nil
+	c.serviceAccountCache = nil
+	c.namespaceCache = nil
+	c.nodeImages = nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxDashboardChanges bound the number of recent changes kept for the
+// dashboard, across runs
+const maxDashboardChanges = 100
+
+// dashboardPage is the dashboard, a single page filtered with the
+// namespace, action and q query parameters
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>imago</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; font-size: 0.9em; }
+code { font-size: 0.85em; }
+.update-available, .failed, .error { background: #fee; }
+.updated, .applied { background: #efe; }
+</style>
+</head>
+<body>
+<h1>imago</h1>
+<p>Run {{.Status.Run}} finished at {{.Status.Finished.Format "2006-01-02 15:04:05 MST"}}, exit code {{.Status.ExitCode}}.</p>
+<form method="get">
+<select name="namespace">
+<option value="">all namespaces</option>
+{{range .Namespaces}}<option{{if eq . $.Namespace}} selected{{end}}>{{.}}</option>
+{{end}}</select>
+<select name="action">
+<option value="">all actions</option>
+{{range .Actions}}<option{{if eq . $.Action}} selected{{end}}>{{.}}</option>
+{{end}}</select>
+<input name="q" value="{{.Query}}" placeholder="workload or image">
+<input type="submit" value="Filter">
+</form>
+<h2>Workloads</h2>
+<table>
+<tr><th>Namespace</th><th>Workload</th><th>Container</th><th>Image</th><th>Current digest</th><th>Latest digest</th><th>Action</th><th>Details</th></tr>
+{{range .Rows}}<tr class="{{.Class}}"><td>{{.Namespace}}</td><td>{{.Kind}}/{{.Name}}</td><td>{{.Container.Name}}</td><td><code>{{.Container.Image}}</code></td><td><code>{{.Container.CurrentDigest}}</code></td><td><code>{{.Container.LatestDigest}}</code></td><td>{{.Container.Action}}</td><td>{{if .Container.NewImage}}<code>{{.Container.NewImage}}</code> {{end}}{{.Container.Error}}</td></tr>
+{{else}}<tr><td colspan="8">no workload</td></tr>
+{{end}}</table>
+<h2>Recent changes</h2>
+<table>
+<tr><th>Time</th><th>Workload</th><th>Container</th><th>Previous</th><th>Image</th><th>Outcome</th></tr>
+{{range .Changes}}<tr class="{{.Type}}"><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Namespace}}/{{.Kind}}/{{.Name}}</td><td>{{.Container}}</td><td><code>{{.Previous}}</code></td><td><code>{{.Image}}</code></td><td>{{.Type}} {{.Error}}</td></tr>
+{{else}}<tr><td colspan="6">no change</td></tr>
+{{end}}</table>
+<h2>Errors</h2>
+<ul>
+{{range .Status.Errors}}<li>{{.Class}}: {{.Message}}</li>
+{{else}}<li>none</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// dashboardRow is a container shown on the dashboard
+type dashboardRow struct {
+	Namespace string
+	Kind      string
+	Name      string
+	Container apiContainer
+	// Class highlight the row depending on the action
+	Class string
+}
+
+// dashboardData is the data rendered by dashboardPage
+type dashboardData struct {
+	Status     *apiStatus
+	Namespaces []string
+	Actions    []string
+	Namespace  string
+	Action     string
+	Query      string
+	Rows       []dashboardRow
+	Changes    []*updateEvent
+}
+
+// dashboard serve the dashboard of the last run
+func (a *statusAPI) dashboard(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	if !a.authorized(req) {
+		// browsers prompt for the token as a password
+		w.Header().Set("WWW-Authenticate", `Basic realm="imago"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	status, changes := a.health.lastStatus(), a.health.recentChanges()
+	if status == nil {
+		http.Error(w, "first run in progress", http.StatusServiceUnavailable)
+		return
+	}
+	query := req.URL.Query()
+	data := &dashboardData{Status: status, Namespace: query.Get("namespace"), Action: query.Get("action"), Query: query.Get("q")}
+	namespaces := make(map[string]bool)
+	actions := make(map[string]bool)
+	for _, w := range status.Workloads {
+		if !namespaces[w.Namespace] {
+			namespaces[w.Namespace] = true
+			data.Namespaces = append(data.Namespaces, w.Namespace)
+		}
+		containers := w.Containers
+		if w.Error != "" {
+			containers = append([]apiContainer{{Action: actionError, Error: w.Error}}, containers...)
+		}
+		for _, c := range containers {
+			if !actions[c.Action] {
+				actions[c.Action] = true
+				data.Actions = append(data.Actions, c.Action)
+			}
+			if data.Namespace != "" && w.Namespace != data.Namespace || data.Action != "" && c.Action != data.Action {
+				continue
+			}
+			if data.Query != "" && !strings.Contains(w.Kind+"/"+w.Name+" "+c.Image+" "+c.NewImage, data.Query) {
+				continue
+			}
+			data.Rows = append(data.Rows, dashboardRow{w.Namespace, w.Kind, w.Name, c, strings.Replace(c.Action, " ", "-", -1)})
+		}
+	}
+	// most recent first
+	for i := len(changes) - 1; i >= 0; i-- {
+		e := changes[i]
+		if data.Namespace != "" && e.Namespace != data.Namespace {
+			continue
+		}
+		if data.Query != "" && !strings.Contains(e.Kind+"/"+e.Name+" "+e.Previous+" "+e.Image, data.Query) {
+			continue
+		}
+		data.Changes = append(data.Changes, e)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardPage.Execute(w, data); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// decisionPolicy ask a policy service, like the data API of an Open Policy
+// Agent server evaluating Rego, whether updates are allowed
+type decisionPolicy struct {
+	client *http.Client
+	url    string
+}
+
+func newDecisionPolicy(policyURL string) (*decisionPolicy, error) {
+	u, err := url.Parse(policyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported decision policy URL %s, expected http:// or https://", policyURL)
+	}
+	return &decisionPolicy{client: &http.Client{Timeout: 10 * time.Second}, url: policyURL}, nil
+}
+
+// decisionInput describe an update proposed for a container, it is the
+// input document of the policy
+type decisionInput struct {
+	Kind        string            `json:"kind"`
+	Namespace   string            `json:"namespace"`
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Container   string            `json:"container"`
+	// Current is the image in spec, Source the image followed and Image
+	// the new image
+	Current string `json:"current"`
+	Source  string `json:"source"`
+	Image   string `json:"image"`
+	Digest  string `json:"digest"`
+	Reason  string `json:"reason"`
+	// Registry is the registry host of the new image
+	Registry string `json:"registry"`
+	// ImageLabels and Created come from the new image config, when known
+	ImageLabels map[string]string `json:"imageLabels,omitempty"`
+	Created     *time.Time        `json:"created,omitempty"`
+}
+
+// decide return whether given update is allowed and the reason given by the
+// policy. The result of the policy is either a boolean or an object with
+// "allow" and "reason" fields, an undefined result deny the update.
+func (p *decisionPolicy) decide(input *decisionInput) (bool, string, error) {
+	data, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(data))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imago")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer closeResource(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, "", fmt.Errorf("unexpected response from %s: %s %s", p.url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return false, "", err
+	}
+	if len(response.Result) == 0 {
+		return false, "policy result is undefined", nil
+	}
+	var allow bool
+	if err := json.Unmarshal(response.Result, &allow); err == nil {
+		return allow, "", nil
+	}
+	var result struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(response.Result, &result); err != nil {
+		return false, "", fmt.Errorf("unexpected policy result %s, expected a boolean or an object with allow and reason fields", response.Result)
+	}
+	return result.Allow, result.Reason, nil
+}
+
+// applyDecisionPolicy remove updates of given workload which the decision
+// policy doesn't allow
+func (c *Config) applyDecisionPolicy(kind string, meta *metav1.ObjectMeta, updates map[string]containerUpdate, pullSecrets *dockerConfig) {
+	if c.decisionPolicy == nil {
+		return
+	}
+	resource := fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name)
+	names := make([]string, 0, len(updates))
+	for name := range updates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := updates[name]
+		input := &decisionInput{
+			Kind:        kind,
+			Namespace:   meta.Namespace,
+			Name:        meta.Name,
+			Labels:      meta.Labels,
+			Annotations: meta.Annotations,
+			Container:   name,
+			Current:     u.current,
+			Source:      u.source,
+			Image:       u.image,
+			Reason:      u.reason,
+			Registry:    imageHost(u.image),
+		}
+		if ref, err := reference.ParseNormalizedNamed(u.image); err == nil {
+			if canonical, ok := ref.(reference.Canonical); ok {
+				input.Digest = string(canonical.Digest())
+			}
+		}
+		if source, err := reference.ParseNormalizedNamed(u.source); err == nil && c.reg != nil && input.Digest != "" {
+			if auth, err := c.registryCredentials(u.source, pullSecrets); err == nil {
+				if config, err := c.reg.GetImageConfig(c.context, reference.TrimNamed(source), input.Digest, auth); err == nil {
+					input.ImageLabels, input.Created = config.Config.Labels, config.Created
+				}
+			}
+		}
+		allow, reason, err := c.decisionPolicy.decide(input)
+		if err != nil {
+			log.Printf("    %s update skipped: decision policy failed: %s", name, err)
+			c.explainf(name, "no update: decision policy failed: %s", err)
+			c.report.AddContainerError(otherErrorClass, resource, name, fmt.Errorf("%s %s: decision policy failed: %w", resource, name, err))
+			delete(updates, name)
+			continue
+		}
+		if !allow {
+			if reason == "" {
+				reason = "denied"
+			}
+			log.Printf("    %s update denied by decision policy: %s", name, reason)
+			c.explainf(name, "no update: decision policy: %s", reason)
+			delete(updates, name)
+			continue
+		}
+		c.explainf(name, "decision policy allow the update")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultsConfigMap is the ConfigMap holding cluster-wide default flags
+const defaultsConfigMap = "imago-system/imago-defaults"
+
+// loadDefaults set flags not given on the command line from the data of
+// given namespace/name ConfigMap, keys are flag names and repeatable flags
+// take one value per line. A missing well-known ConfigMap is ignored. The
+// loaded data is returned to detect changes with getDefaults.
+func loadDefaults(flags *flag.FlagSet, kubeconfig string, ref string) (map[string]string, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	namespace, _, err := parseDefaultsRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewConfig(kubeconfig, namespace, false, &arrayFlags{}, "", false, context.Background())
+	if err != nil {
+		return nil, err
+	}
+	data, err := getDefaults(c, ref)
+	if err != nil {
+		return nil, err
+	}
+	return data, applyDefaults(flags, ref, data)
+}
+
+// parseDefaultsRef return namespace and name of a defaults ConfigMap
+func parseDefaultsRef(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid defaults ConfigMap %s, expected namespace/name", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// getDefaults return the data of given namespace/name ConfigMap, nil when
+// the well-known ConfigMap is missing or forbidden
+func getDefaults(c *Config, ref string) (map[string]string, error) {
+	namespace, name, err := parseDefaultsRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	var cm *v1.ConfigMap
+	err = retryTransient(func() (err error) {
+		cm, err = c.cluster.CoreV1().ConfigMaps(namespace).Get(c.context, name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		if ref == defaultsConfigMap && (apierrors.IsNotFound(err) || apierrors.IsForbidden(err)) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to load defaults from %s: %w", ref, err)
+	}
+	return cm.Data, nil
+}
+
+// defaultsChanged tell whether defaults data differ from loaded ones
+func defaultsChanged(loaded, data map[string]string) bool {
+	if len(loaded) != len(data) {
+		return true
+	}
+	for key, value := range data {
+		if previous, ok := loaded[key]; !ok || previous != value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDefaults set flags not given on the command line from data of the
+// ref ConfigMap
+func applyDefaults(flags *flag.FlagSet, ref string, data map[string]string) error {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	loaded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		f := flags.Lookup(key)
+		if f == nil || key == "defaults" || key == "kubeconfig" {
+			return fmt.Errorf("invalid key %s in defaults ConfigMap %s, expected a flag name", key, ref)
+		}
+		if set[key] {
+			continue
+		}
+		values := []string{strings.TrimSpace(data[key])}
+		if _, ok := f.Value.(*arrayFlags); ok {
+			values = values[:0]
+			for _, line := range strings.Split(data[key], "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					values = append(values, line)
+				}
+			}
+		}
+		for _, value := range values {
+			if err := flags.Set(key, value); err != nil {
+				return fmt.Errorf("invalid value of %s in defaults ConfigMap %s: %w", key, ref, err)
+			}
+		}
+		loaded = append(loaded, key)
+	}
+	if len(loaded) > 0 {
+		log.Printf("loaded defaults from %s: %s", ref, strings.Join(loaded, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// imagoAfterAnnotation list workloads, as [namespace/]kind/name, which must
+// be up to date and healthy before updating the annotated workload
+const imagoAfterAnnotation = "imago/after"
+
+// Outcomes of workloads checked in a run
+const (
+	outcomeHeld     = "held"
+	outcomeUpToDate = "up to date"
+	outcomeApplied  = "applied"
+)
+
+// runState track outcomes of workloads checked in a run, shared by all
+// configs, to order updates of dependent workloads
+type runState struct {
+	// outcomes of workloads of the run, indexed by namespace/kind/name,
+	// workloads not processed yet are missing
+	outcomes map[string]string
+	// selected workloads of the run
+	selected map[string]bool
+	// timeout of waiting for dependencies to become healthy
+	timeout time.Duration
+	// groupByRepository put workloads using the same image repository in
+	// the same update group
+	groupByRepository bool
+	// groups of workloads updated all at once, indexed by workload
+	groups map[string]*updateGroup
+	// wave of namespaces updated before waiting for their rollouts
+	wave *updateWave
+	// rollout wait for rollouts of updated workloads one at a time, if set
+	rollout *rolloutWatch
+	// stop is closed on shutdown, workloads left aren't checked
+	stop <-chan struct{}
+	// schedule skip namespaces whose interval didn't elapse, in -daemon
+	// mode
+	schedule *namespaceSchedule
+}
+
+func newRunState(timeout time.Duration, groupByRepository bool) *runState {
+	return &runState{outcomes: make(map[string]string), selected: make(map[string]bool), timeout: timeout, groupByRepository: groupByRepository}
+}
+
+// stopping return whether the run must stop before checking the next
+// workload
+func (r *runState) stopping() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// workloadDependencies return namespace/kind/name of workloads given
+// workload must be updated after
+func workloadDependencies(meta *metav1.ObjectMeta) ([]string, error) {
+	value := meta.Annotations[imagoAfterAnnotation]
+	if value == "" {
+		return nil, nil
+	}
+	deps := make([]string, 0)
+	for _, ref := range strings.Split(value, ",") {
+		ref = strings.TrimSpace(ref)
+		namespace := meta.Namespace
+		if strings.Count(ref, "/") == 2 {
+			i := strings.Index(ref, "/")
+			namespace, ref = ref[:i], ref[i+1:]
+		}
+		kind, name, err := parseWorkloadRef(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %s", imagoAfterAnnotation, err)
+		}
+		deps = append(deps, fmt.Sprintf("%s/%s/%s", namespace, kind, name))
+	}
+	return deps, nil
+}
+
+// orderByDependencies reorder workloads so that each workload come after
+// its dependencies, keeping the given order otherwise. Invalid annotations
+// and dependency cycles are returned as errors, workloads involved are held
+// when processed.
+func orderByDependencies(workloads []prioritizedWorkload) ([]prioritizedWorkload, []error) {
+	index := make(map[string]int, len(workloads))
+	for i, w := range workloads {
+		index[fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)] = i
+	}
+	ordered := make([]prioritizedWorkload, 0, len(workloads))
+	failed := make([]error, 0)
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make([]int, len(workloads))
+	var path []string
+	var visit func(i int)
+	visit = func(i int) {
+		w := workloads[i]
+		resource := fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)
+		switch state[i] {
+		case visited:
+			return
+		case visiting:
+			start := 0
+			for path[start] != resource {
+				start++
+			}
+			cycle := append(append([]string{}, path[start:]...), resource)
+			failed = append(failed, fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> ")))
+			return
+		}
+		state[i] = visiting
+		path = append(path, resource)
+		deps, err := workloadDependencies(w.meta)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", resource, err))
+		}
+		for _, dep := range deps {
+			if j, ok := index[dep]; ok {
+				visit(j)
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		ordered = append(ordered, w)
+	}
+	for i := range workloads {
+		visit(i)
+	}
+	return ordered, failed
+}
+
+// dependenciesReady return why given workload can't be updated yet, or an
+// empty string. Dependencies updated in the run are waited for to become
+// healthy.
+func (c *Config) dependenciesReady(meta *metav1.ObjectMeta) string {
+	if c.run == nil {
+		return ""
+	}
+	deps, err := workloadDependencies(meta)
+	if err != nil {
+		return err.Error()
+	}
+	for _, dep := range deps {
+		outcome, processed := c.run.outcomes[dep]
+		switch {
+		case processed && outcome == outcomeHeld:
+			return fmt.Sprintf("%s is not up to date", dep)
+		case !processed && c.run.selected[dep]:
+			return fmt.Sprintf("%s is part of a dependency cycle", dep)
+		}
+		parts := strings.SplitN(dep, "/", 3)
+		namespace, kind, name := parts[0], parts[1], parts[2]
+		healthy, err := c.workloadHealthy(kind, namespace, name)
+		if err != nil {
+			return fmt.Sprintf("unable to check %s health: %s", dep, err)
+		}
+		if healthy {
+			continue
+		}
+		log.Printf("waiting for %s to become healthy", dep)
+		err = wait.PollImmediate(5*time.Second, c.run.timeout, func() (bool, error) {
+			return c.workloadHealthy(kind, namespace, name)
+		})
+		if err != nil {
+			return fmt.Sprintf("%s is not healthy: %s", dep, err)
+		}
+	}
+	return ""
+}
+
+// workloadHealthy return whether all replicas of given workload run its
+// latest pod template and are available. CronJobs are always healthy.
+func (c *Config) workloadHealthy(kind string, namespace string, name string) (bool, error) {
+	ctx := c.context
+	client := c.cluster.AppsV1()
+	switch kind {
+	case "Deployment":
+		d, err := client.Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		replicas := int32(1)
+		if d.Spec.Replicas != nil {
+			replicas = *d.Spec.Replicas
+		}
+		return d.Status.ObservedGeneration >= d.Generation && d.Status.UpdatedReplicas == replicas && d.Status.AvailableReplicas == replicas && d.Status.Replicas == replicas, nil
+	case "DaemonSet":
+		ds, err := client.DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		desired := ds.Status.DesiredNumberScheduled
+		return ds.Status.ObservedGeneration >= ds.Generation && ds.Status.UpdatedNumberScheduled == desired && ds.Status.NumberAvailable == desired, nil
+	case "StatefulSet":
+		sts, err := client.StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		replicas := int32(1)
+		if sts.Spec.Replicas != nil {
+			replicas = *sts.Spec.Replicas
+		}
+		return sts.Status.ObservedGeneration >= sts.Generation && sts.Status.UpdatedReplicas == replicas && sts.Status.ReadyReplicas == replicas && sts.Status.CurrentRevision == sts.Status.UpdateRevision, nil
+	case "CronJob":
+		_, err := c.cluster.BatchV1beta1().CronJobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		return err == nil, err
+	}
+	return false, fmt.Errorf("unsupported workload kind %s", kind)
+}
+
+// setOutcome record the outcome of given workload in the run
+func (c *Config) setOutcome(resource string, outcome string) {
+	if c.run != nil {
+		c.run.outcomes[resource] = outcome
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// diffContext is the number of unchanged lines around changes in diffs
+const diffContext = 3
+
+// imageFields render fields of a workload updates change as YAML lines: the
+// imago-config-spec annotation and images of containers
+func imageFields(kind string, annotation string, initContainers []v1.Container, containers []v1.Container) []string {
+	lines := make([]string, 0)
+	if annotation != "" {
+		lines = append(lines, "metadata:", "  annotations:", "    "+imagoConfigAnnotation+": "+strconv.Quote(annotation))
+	}
+	indent := "    "
+	lines = append(lines, "spec:")
+	if kind == "CronJob" {
+		lines = append(lines, "  jobTemplate:", "    spec:")
+		indent += "  "
+	}
+	lines = append(lines, indent[2:]+"template:", indent+"spec:")
+	for _, list := range []struct {
+		name       string
+		containers []v1.Container
+	}{{"initContainers", initContainers}, {"containers", containers}} {
+		if len(list.containers) == 0 {
+			continue
+		}
+		lines = append(lines, indent+"  "+list.name+":")
+		for _, container := range list.containers {
+			lines = append(lines, indent+"  - name: "+container.Name, indent+"    image: "+container.Image)
+		}
+	}
+	return lines
+}
+
+// diffOp is a line of a diff, kind is ' ', '-' or '+'
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines compute the shortest edit script turning a into b, from their
+// longest common subsequence
+func diffLines(a []string, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ops := make([]diffOp, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		default:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		}
+	}
+	return ops
+}
+
+// writeUnifiedDiff write the unified diff of a and b, with diffContext lines
+// of context around changes
+func writeUnifiedDiff(out io.Writer, from string, to string, a []string, b []string) {
+	ops := diffLines(a, b)
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", from, to)
+	for start := 0; start < len(ops); {
+		// find the next change and extend the hunk while changes are
+		// closer than twice the context
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			return
+		}
+		end, unchanged := first, 0
+		for i := first; i < len(ops) && unchanged <= 2*diffContext; i++ {
+			if ops[i].kind == ' ' {
+				unchanged++
+				continue
+			}
+			unchanged = 0
+			end = i + 1
+		}
+		begin := first - diffContext
+		if begin < start {
+			begin = start
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		// line numbers of the hunk in a and b
+		lineA, lineB := 1, 1
+		for _, op := range ops[:begin] {
+			if op.kind != '+' {
+				lineA++
+			}
+			if op.kind != '-' {
+				lineB++
+			}
+		}
+		countA, countB := 0, 0
+		for _, op := range ops[begin:stop] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+		for _, op := range ops[begin:stop] {
+			fmt.Fprintf(out, "%c%s\n", op.kind, op.line)
+		}
+		start = stop
+	}
+}
+
+// writeDiff write the diff of images and imago-config-spec annotation updates
+// of given workload would apply
+func (c *Config) writeDiff(kind string, meta *metav1.ObjectMeta, template *v1.PodTemplateSpec, config *configAnnotation, updateInitContainers map[string]containerUpdate, updateContainers map[string]containerUpdate) error {
+	updated := *config
+	updated.Version = configAnnotationVersion
+	updated.ConfigMap = ""
+	jsonConfig, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+	apply := func(containers []v1.Container, update map[string]containerUpdate) []v1.Container {
+		applied := make([]v1.Container, len(containers))
+		for i, container := range containers {
+			applied[i] = v1.Container{Name: container.Name, Image: container.Image}
+			if u, ok := update[container.Name]; ok {
+				applied[i].Image = u.image
+			}
+		}
+		return applied
+	}
+	before := imageFields(kind, meta.Annotations[imagoConfigAnnotation], template.Spec.InitContainers, template.Spec.Containers)
+	after := imageFields(kind, string(jsonConfig), apply(template.Spec.InitContainers, updateInitContainers), apply(template.Spec.Containers, updateContainers))
+	resource := fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name)
+	writeUnifiedDiff(c.diff, resource, resource+" (updated)", before, after)
+	return nil
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	v1 "k8s.io/api/core/v1"
+)
+
+type dockerAuthEntry struct {
+	Auth string `json:"auth"`
+	// some tools write the user name and password separately
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// IdentityToken is an OAuth2 refresh token, e.g. of az acr login
+	IdentityToken string `json:"identitytoken"`
+}
+
+// empty return whether the entry has no credentials
+func (e *dockerAuthEntry) empty() bool {
+	return e.Auth == "" && e.Username == "" && e.IdentityToken == ""
+}
+
+// dockerConfig hold registry credentials from a docker config.json file
+type dockerConfig struct {
+	Auths map[string]dockerAuthEntry `json:"auths"`
+	// sources hold where credentials of each registry host come from
+	sources map[string]string
+}
+
+// parseDockerConfigSecret read a kubernetes.io/dockerconfigjson or
+// kubernetes.io/dockercfg secret
+func parseDockerConfigSecret(secret *v1.Secret) (*dockerConfig, error) {
+	config := &dockerConfig{}
+	if data, ok := secret.Data[v1.DockerConfigJsonKey]; ok {
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("unable to parse secret %s/%s: %s", secret.Namespace, secret.Name, err)
+		}
+	} else if data, ok := secret.Data[v1.DockerConfigKey]; ok {
+		if err := json.Unmarshal(data, &config.Auths); err != nil {
+			return nil, fmt.Errorf("unable to parse secret %s/%s: %s", secret.Namespace, secret.Name, err)
+		}
+	} else {
+		return nil, fmt.Errorf("secret %s/%s has no %s or %s key", secret.Namespace, secret.Name, v1.DockerConfigJsonKey, v1.DockerConfigKey)
+	}
+	return config, nil
+}
+
+// normalizeRegistryHost return the registry host of a docker config "auths"
+// key, which might be an URL like https://index.docker.io/v1/
+func normalizeRegistryHost(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return host
+}
+
+func defaultDockerConfig() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return filepath.Join(homeDir(), ".docker", "config.json")
+}
+
+// imageRegistryHost return the registry host of given image name
+func imageRegistryHost(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	return reference.Domain(named), nil
+}
+
+// lookup return credentials for given registry host or nil
+func (d *dockerConfig) lookup(host string) (*DockerRegistryCredentials, error) {
+	for key, entry := range d.Auths {
+		if normalizeRegistryHost(key) != host || entry.empty() {
+			continue
+		}
+		auth := &DockerRegistryCredentials{Username: entry.Username, Password: entry.Password, IdentityToken: entry.IdentityToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for %s: %s", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid auth for %s: expected user:password", key)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		return auth, nil
+	}
+	return nil, nil
+}
+
+func (c *Config) loadDockerConfigSecret(secretRef string) (*dockerConfig, error) {
+	parts := strings.SplitN(secretRef, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid docker config secret %s, expected namespace/name", secretRef)
+	}
+	secret, err := c.getSecret(parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return parseDockerConfigSecret(secret)
+}
+
+// loadDockerConfig read registry credentials from given source which can be
+// a file path, "secret:namespace/name" or "env:VARIABLE"
+func (c *Config) loadDockerConfig(source string) (*dockerConfig, error) {
+	config := &dockerConfig{}
+	var data []byte
+	switch {
+	case strings.HasPrefix(source, "secret:"):
+		return c.loadDockerConfigSecret(strings.TrimPrefix(source, "secret:"))
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		data = []byte(value)
+	default:
+		var err error
+		data, err = ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unable to parse docker config %s: %s", source, err)
+	}
+	return config, nil
+}
+
+// merge add credentials of registries not already present in d
+func (d *dockerConfig) merge(other *dockerConfig, source string) {
+	if d.Auths == nil {
+		d.Auths = make(map[string]dockerAuthEntry)
+		d.sources = make(map[string]string)
+	}
+	for key, entry := range other.Auths {
+		host := normalizeRegistryHost(key)
+		if _, ok := d.Auths[host]; !ok && !entry.empty() {
+			d.Auths[host] = entry
+			d.sources[host] = source
+		}
+	}
+}
+
+// LoadDockerConfigs use registry credentials from given sources, or
+// ~/.docker/config.json if it exists. Sources are merged per registry host,
+// the first source having credentials for a registry takes precedence.
+func (c *Config) LoadDockerConfigs(sources []string) error {
+	config := &dockerConfig{}
+	if len(sources) == 0 {
+		if _, err := os.Stat(defaultDockerConfig()); err != nil {
+			return nil
+		}
+		sources = []string{defaultDockerConfig()}
+	}
+	for _, source := range sources {
+		sourceConfig, err := c.loadDockerConfig(source)
+		if err != nil {
+			return err
+		}
+		config.merge(sourceConfig, source)
+	}
+	c.dockerConfig = config
+	return nil
+}
+
+// AddRegistryAuth add credentials for given registry host with the lowest
+// precedence, they are only used when no docker config source has
+// credentials for this registry
+func (c *Config) AddRegistryAuth(host string, userPassword string) error {
+	if !strings.Contains(userPassword, ":") {
+		return fmt.Errorf("invalid registry auth for %s, expected user:password", host)
+	}
+	if c.dockerConfig == nil {
+		c.dockerConfig = &dockerConfig{}
+	}
+	c.dockerConfig.merge(&dockerConfig{Auths: map[string]dockerAuthEntry{
+		host: {Auth: base64.StdEncoding.EncodeToString([]byte(userPassword))},
+	}}, "-registry-auth")
+	return nil
+}
+
+// registryCredentialsSource describe where credentials used for given image
+// come from, pullSecrets are credentials of the workload or nil
+func (c *Config) registryCredentialsSource(image string, pullSecrets *dockerConfig) string {
+	host, err := imageRegistryHost(image)
+	if err != nil {
+		return "none"
+	}
+	for _, config := range []*dockerConfig{c.dockerConfig, pullSecrets} {
+		if config != nil && config.sources[host] != "" {
+			return config.sources[host]
+		}
+	}
+	if p := c.authProviderOf(host); p != nil {
+		return p.String()
+	}
+	return "none"
+}
+
+// registryCredentials return the credentials to use for given image or nil,
+// pullSecrets are credentials of the workload or nil
+func (c *Config) registryCredentials(image string, pullSecrets *dockerConfig) (*DockerRegistryCredentials, error) {
+	host, err := imageRegistryHost(image)
+	if err != nil {
+		return nil, err
+	}
+	return c.hostCredentials(host, pullSecrets)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// editedImage return whether the spec image of a managed container was
+// changed out of band from its recorded image: another tag, or a digest of
+// another repository
+func (c *Config) editedImage(recorded string, specImage string) bool {
+	if strings.Contains(recorded, "@") {
+		// fixed digest, not managed
+		return false
+	}
+	if !strings.Contains(specImage, "@") {
+		return !c.sameImage(recorded, specImage)
+	}
+	specRepository, err := c.repositoryName(specImage)
+	if err != nil {
+		return false
+	}
+	recordedRepository, err := c.repositoryName(recorded)
+	return err == nil && specRepository != recordedRepository
+}
+
+// imagoPinnedImagesAnnotation record images containers were last pinned to
+// by imago, restored by -enforce when edited out of band
+const imagoPinnedImagesAnnotation = "imago-pinned-images"
+
+// storePinnedImages record images of containers of given template pinned
+// to a digest in imagoPinnedImagesAnnotation
+func storePinnedImages(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+	pinned := make(map[string]string)
+	for _, containers := range [][]v1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for _, container := range containers {
+			if strings.Contains(container.Image, "@") {
+				pinned[container.Name] = container.Image
+			}
+		}
+	}
+	if len(pinned) == 0 {
+		delete(meta.Annotations, imagoPinnedImagesAnnotation)
+		return nil
+	}
+	data, err := json.Marshal(pinned)
+	if err != nil {
+		return err
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[imagoPinnedImagesAnnotation] = string(data)
+	return nil
+}
+
+// loadPinnedImages return images recorded in imagoPinnedImagesAnnotation of
+// given workload, nil when there is none
+func loadPinnedImages(meta *metav1.ObjectMeta) (map[string]string, error) {
+	value, ok := meta.Annotations[imagoPinnedImagesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	pinned := make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &pinned); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", imagoPinnedImagesAnnotation, err)
+	}
+	return pinned, nil
+}
+
+// editedContainer is a managed container whose image was edited out of
+// band, restored to the image it was last pinned to, or to its recorded
+// image when unknown
+type editedContainer struct {
+	image    string
+	recorded string
+	restore  string
+	init     bool
+}
+
+// enforceConfig detect containers of a managed workload edited out of band.
+// With a policy their images are reset in given template to the image they
+// were last pinned to so that updates revert the edit, otherwise they're
+// reported as configuration errors. Return edited containers indexed by
+// name.
+func (c *Config) enforceConfig(kind string, meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) (map[string]editedContainer, error) {
+	edited := make(map[string]editedContainer)
+	if !c.enforce {
+		return edited, nil
+	}
+	config, err := c.loadConfigAnnotation(meta)
+	if err != nil || config == nil {
+		return edited, err
+	}
+	pinned, err := loadPinnedImages(meta)
+	if err != nil {
+		return edited, err
+	}
+	resource := fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name)
+	enforce := func(entries []configAnnotationImageSpec, containers []v1.Container, init bool) {
+		for _, entry := range entries {
+			for i, container := range containers {
+				if container.Name != entry.Name || !c.editedImage(entry.Image, container.Image) {
+					continue
+				}
+				log.Printf("    %s image was edited out of band from %s to %s", container.Name, entry.Image, container.Image)
+				c.explainf(container.Name, "out of band edit: image changed from %s to %s", entry.Image, container.Image)
+				if c.policy == "" {
+					c.report.AddContainerError(configErrorClass, resource, container.Name, fmt.Errorf("%s: container %s image was edited out of band from %s to %s", resource, container.Name, entry.Image, container.Image))
+					continue
+				}
+				restore := entry.Image
+				if image, ok := pinned[container.Name]; ok && c.sameRepository(image, entry.Image) {
+					restore = image
+				}
+				edited[container.Name] = editedContainer{container.Image, entry.Image, restore, init}
+				containers[i].Image = restore
+			}
+		}
+	}
+	enforce(config.InitContainers, template.Spec.InitContainers, true)
+	enforce(config.Containers, template.Spec.Containers, false)
+	return edited, nil
+}
+
+// sameRepository return whether given images are in the same repository
+func (c *Config) sameRepository(a string, b string) bool {
+	repositoryA, err := c.repositoryName(a)
+	if err != nil {
+		return false
+	}
+	repositoryB, err := c.repositoryName(b)
+	return err == nil && repositoryA == repositoryB
+}
+
+// revertEdits describe updates of init containers and containers edited out
+// of band as reverts. Edited containers without update, when the image they
+// were pinned to is still the latest one or the update is held back, are
+// restored to it, as any other update.
+func (c *Config) revertEdits(updates []map[string]containerUpdate, edited map[string]editedContainer) {
+	for name, e := range edited {
+		update := updates[1]
+		if e.init {
+			update = updates[0]
+		}
+		if u, ok := update[name]; ok {
+			u.current = e.image
+			u.reason = fmt.Sprintf("revert out of band edit of %s; %s", e.image, u.reason)
+			update[name] = u
+			continue
+		}
+		log.Printf("    %s reverting out of band edit to %s", name, e.restore)
+		c.explainf(name, "revert out of band edit: restoring %s", e.restore)
+		update[name] = containerUpdate{
+			source:  e.recorded,
+			current: e.image,
+			image:   e.restore,
+			reason:  fmt.Sprintf("revert out of band edit of %s", e.image),
+		}
+	}
+}
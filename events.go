@@ -0,0 +1,431 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Event types
+const (
+	eventPending = "pending"
+	eventApplied = "applied"
+	eventFailed  = "failed"
+)
+
+// updateEvent describe an image update of a container
+type updateEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Container string    `json:"container"`
+	Source    string    `json:"source"`
+	Previous  string    `json:"previous"`
+	Image     string    `json:"image"`
+	Reason    string    `json:"reason"`
+	Policy    string    `json:"policy,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// cloudEventTypePrefix is the prefix of CloudEvents types, the event type is
+// appended
+const cloudEventTypePrefix = "org.philpep.imago.update."
+
+// cloudEvent is an event in CloudEvents structured JSON format
+type cloudEvent struct {
+	SpecVersion     string       `json:"specversion"`
+	ID              string       `json:"id"`
+	Source          string       `json:"source"`
+	Type            string       `json:"type"`
+	Subject         string       `json:"subject"`
+	Time            time.Time    `json:"time"`
+	DataContentType string       `json:"datacontenttype"`
+	Data            *updateEvent `json:"data"`
+}
+
+// eventID return the id of an update event of given run, an event
+// published again has the same id
+func eventID(run string, e *updateEvent) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{e.Type, e.Namespace, e.Kind, e.Name, e.Container, e.Previous, e.Image}, "\x00")))
+	return run + "-" + hex.EncodeToString(sum[:8])
+}
+
+// newCloudEvent wrap an update event in a CloudEvents envelope, with the id
+// of the event or a random one
+func newCloudEvent(e *updateEvent) (*cloudEvent, error) {
+	id := e.ID
+	if id == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		id = hex.EncodeToString(b)
+	}
+	return &cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              id,
+		Source:          "imago",
+		Type:            cloudEventTypePrefix + e.Type,
+		Subject:         fmt.Sprintf("%s/%s/%s/%s", e.Namespace, e.Kind, e.Name, e.Container),
+		Time:            e.Time,
+		DataContentType: "application/json",
+		Data:            e,
+	}, nil
+}
+
+// eventSink publish events to an external system
+type eventSink interface {
+	send(e *updateEvent) error
+	close() error
+}
+
+// eventRoute send events of workloads matching a namespace pattern and a
+// label selector to a dedicated sink
+type eventRoute struct {
+	namespace string
+	selector  labels.Selector
+	sink      eventSink
+}
+
+// parseEventRoute parse a NAMESPACE[/SELECTOR]=URL route
+func parseEventRoute(value string, natsSubject string) (*eventRoute, error) {
+	sep := strings.Index(value, "://")
+	if sep == -1 {
+		return nil, fmt.Errorf("invalid event route %s, expected NAMESPACE[/SELECTOR]=URL", value)
+	}
+	sep = strings.LastIndex(value[:sep], "=")
+	if sep <= 0 {
+		return nil, fmt.Errorf("invalid event route %s, expected NAMESPACE[/SELECTOR]=URL", value)
+	}
+	match, target := value[:sep], value[sep+1:]
+	route := &eventRoute{namespace: match, selector: labels.Everything()}
+	if i := strings.Index(match, "/"); i != -1 {
+		route.namespace = match[:i]
+		selector, err := labels.Parse(match[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid event route %s: %s", value, err)
+		}
+		route.selector = selector
+	}
+	if _, err := path.Match(route.namespace, ""); err != nil {
+		return nil, fmt.Errorf("invalid event route %s: %s", value, err)
+	}
+	sink, err := newEventSink(target, natsSubject)
+	if err != nil {
+		return nil, err
+	}
+	route.sink = sink
+	return route, nil
+}
+
+// matches return whether events of given workload follow the route
+func (r *eventRoute) matches(meta *metav1.ObjectMeta) bool {
+	ok, _ := path.Match(r.namespace, meta.Namespace)
+	return ok && r.selector.Matches(labels.Set(meta.Labels))
+}
+
+// newEventSink return a NATS, Kafka, push notification or CloudEvents sink
+// depending on URL scheme
+func newEventSink(sinkURL string, natsSubject string) (eventSink, error) {
+	if isPushURL(sinkURL) {
+		return newPushSink(sinkURL)
+	}
+	if strings.HasPrefix(sinkURL, "kafka://") || strings.HasPrefix(sinkURL, "kafka+tls://") {
+		return newKafkaSink(sinkURL)
+	}
+	if strings.HasPrefix(sinkURL, "nats://") || strings.HasPrefix(sinkURL, "tls://") {
+		sink, err := newNatsSink(sinkURL, natsSubject)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to NATS server: %s", err)
+		}
+		return sink, nil
+	}
+	return newHTTPSink(sinkURL)
+}
+
+// emitEvents record and publish an event of given type for each container
+// update to global sinks and to sinks of matching routes, publishing
+// failures are logged and don't fail the run. Pending updates published in
+// a previous run are recorded but not published again.
+func (c *Config) emitEvents(eventType string, kind string, meta *metav1.ObjectMeta, updates []map[string]containerUpdate, err error) {
+	sinks := c.eventSinks
+	for _, route := range c.eventRoutes {
+		if route.matches(meta) {
+			sinks = append(sinks[:len(sinks):len(sinks)], route.sink)
+		}
+	}
+	namespace, name := meta.Namespace, meta.Name
+	for _, update := range updates {
+		for container, u := range update {
+			e := &updateEvent{
+				Type:      eventType,
+				Time:      time.Now().UTC(),
+				Namespace: namespace,
+				Kind:      kind,
+				Name:      name,
+				Container: container,
+				Source:    u.source,
+				Previous:  u.current,
+				Image:     u.image,
+				Reason:    u.reason,
+				Policy:    c.policy,
+			}
+			if err != nil {
+				e.Error = err.Error()
+			}
+			e.ID = eventID(c.report.run, e)
+			c.report.AddEvent(e)
+			key := strings.Join([]string{namespace, kind, name, container}, "/")
+			if eventType == eventPending {
+				if c.pendingEvents == nil {
+					c.pendingEvents = make(map[string]string)
+				}
+				if c.pendingEvents[key] == u.image {
+					continue
+				}
+				c.pendingEvents[key] = u.image
+			} else {
+				delete(c.pendingEvents, key)
+			}
+			for _, sink := range sinks {
+				if err := sink.send(e); err != nil {
+					log.Printf("unable to publish %s event: %s", eventType, err)
+				}
+			}
+		}
+	}
+}
+
+// natsSink publish events in CloudEvents JSON format to a NATS server, on
+// <subject>.<type>, with the event id as Nats-Msg-Id header so that
+// JetStream streams drop events published again. The client reconnects
+// when the connection is lost.
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+	mu      sync.Mutex
+}
+
+// natsFlushTimeout is how long to wait for the server to acknowledge an
+// event, including while reconnecting
+const natsFlushTimeout = 10 * time.Second
+
+// newNatsSink connect to given nats:// or tls:// server URL
+func newNatsSink(serverURL string, subject string) (*natsSink, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported NATS URL %s, expected nats://host:port or tls://host:port", serverURL)
+	}
+	conn, err := nats.Connect(serverURL, nats.Name("imago"), nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("NATS connection to %s lost: %s, reconnecting", u.Host, err)
+			}
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Printf("NATS server %s: %s", u.Host, err)
+		}))
+	if err != nil {
+		return nil, err
+	}
+	return &natsSink{conn: conn, subject: subject}, nil
+}
+
+func (s *natsSink) send(e *updateEvent) error {
+	ce, err := newCloudEvent(e)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(ce)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(s.subject + "." + e.Type)
+	msg.Header.Set(nats.MsgIdHdr, ce.ID)
+	msg.Data = payload
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.publish(msg)
+	if errors.Is(err, nats.ErrConnectionClosed) && !s.conn.IsClosed() {
+		// the connection was lost before the server acknowledged the
+		// event, it is published again with the same id once reconnected
+		err = s.publish(msg)
+	}
+	return err
+}
+
+// publish publish a message and wait for the server to process it, so that
+// an error of the server (e.g. a permissions violation) is reported for its
+// event
+func (s *natsSink) publish(msg *nats.Msg) error {
+	previous := s.conn.LastError()
+	if err := s.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	if err := s.conn.FlushTimeout(natsFlushTimeout); err != nil {
+		return err
+	}
+	if err := s.conn.LastError(); err != nil && err != previous {
+		return err
+	}
+	return nil
+}
+
+// close implement eventSink, events are flushed when sent
+func (s *natsSink) close() error {
+	s.conn.Close()
+	return nil
+}
+
+// kafkaSink publish events in CloudEvents JSON format to a Kafka topic,
+// keyed by event id so that compacted topics and consumers can drop events
+// published again
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+// newKafkaSink return a sink of given kafka:// or kafka+tls:// URL, with a
+// comma separated list of brokers and the topic as path, user and password
+// authenticate with SASL PLAIN
+func newKafkaSink(sinkURL string) (*kafkaSink, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if (u.Scheme != "kafka" && u.Scheme != "kafka+tls") || u.Host == "" || topic == "" {
+		return nil, fmt.Errorf("unsupported Kafka URL %s, expected kafka://host:port[,host:port]/topic or kafka+tls://host:port[,host:port]/topic", sinkURL)
+	}
+	transport := &kafka.Transport{ClientID: "imago"}
+	if u.Scheme == "kafka+tls" {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		transport.SASL = plain.Mechanism{Username: u.User.Username(), Password: password}
+	}
+	return &kafkaSink{writer: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+		WriteTimeout: 10 * time.Second,
+		Transport:    transport,
+	}}, nil
+}
+
+func (s *kafkaSink) send(e *updateEvent) error {
+	ce, err := newCloudEvent(e)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(ce)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(ce.ID),
+		Value:   payload,
+		Headers: []kafka.Header{{Key: "content-type", Value: []byte("application/cloudevents+json")}},
+	})
+}
+
+func (s *kafkaSink) close() error {
+	return s.writer.Close()
+}
+
+// httpSink send events to an URL (e.g. a Knative broker) with the CloudEvents
+// HTTP binary content mode
+type httpSink struct {
+	client *http.Client
+	url    string
+}
+
+func newHTTPSink(sinkURL string) (*httpSink, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported event sink URL %s, expected http:// or https://", sinkURL)
+	}
+	return &httpSink{client: &http.Client{Timeout: 10 * time.Second}, url: sinkURL}, nil
+}
+
+func (s *httpSink) send(e *updateEvent) error {
+	ce, err := newCloudEvent(e)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(ce.Data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ce.DataContentType)
+	req.Header.Set("User-Agent", "imago")
+	req.Header.Set("Ce-Specversion", ce.SpecVersion)
+	req.Header.Set("Ce-Id", ce.ID)
+	req.Header.Set("Ce-Source", ce.Source)
+	req.Header.Set("Ce-Type", ce.Type)
+	req.Header.Set("Ce-Subject", ce.Subject)
+	req.Header.Set("Ce-Time", ce.Time.Format(time.RFC3339Nano))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	closeResource(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response from %s: %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) close() error {
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// workloadKinds map kind names and their kubectl short names to kinds
+var workloadKinds = map[string]string{
+	"deployment":   "Deployment",
+	"deployments":  "Deployment",
+	"deploy":       "Deployment",
+	"daemonset":    "DaemonSet",
+	"daemonsets":   "DaemonSet",
+	"ds":           "DaemonSet",
+	"statefulset":  "StatefulSet",
+	"statefulsets": "StatefulSet",
+	"sts":          "StatefulSet",
+	"cronjob":      "CronJob",
+	"cronjobs":     "CronJob",
+	"cj":           "CronJob",
+}
+
+// parseWorkloadRef parse a kind/name workload reference like deploy/foo
+func parseWorkloadRef(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid workload %s, expected kind/name (e.g. deploy/foo)", ref)
+	}
+	kind, ok := workloadKinds[strings.ToLower(parts[0])]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported workload kind %s", parts[0])
+	}
+	return kind, parts[1], nil
+}
+
+func explainCommand(args []string) {
+	var selection selectionFlags
+	var registry registryFlags
+	var policies policyFlags
+	var container string
+	var checkpods bool
+	flags := newCommandFlags("explain", &selection)
+	flags.StringVar(&container, "c", "", "only explain given container (default all containers)")
+	flags.BoolVar(&checkpods, "check-pods", false, "compare with image digests of running pods (default false)")
+	registry.register(flags)
+	policies.register(flags)
+	usage := flags.Usage
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s explain <kind>/<name> [flags]\n", os.Args[0])
+		usage()
+	}
+	// allow flags after the workload reference
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+	ref := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		exit(exitConfigError, err)
+	}
+	if flags.NArg() > 0 {
+		exit(exitConfigError, fmt.Errorf("unexpected arguments %s", strings.Join(flags.Args(), " ")))
+	}
+	kind, name, err := parseWorkloadRef(ref)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	selection.fieldSelector = "metadata.name=" + name
+	report := NewReport()
+	configs, err := selection.configs("", checkpods, report)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	if _, err := registry.setup(configs); err != nil {
+		exit(exitConfigError, err)
+	}
+	if err := policies.setup(configs); err != nil {
+		exit(exitConfigError, err)
+	}
+	found := false
+	for _, c := range configs {
+		c.explain = os.Stdout
+		c.explainContainer = container
+		workloads, listErrors := c.listWorkloads(selection.fieldSelector, selection.labelSelector)
+		for _, err := range listErrors {
+			report.AddError(classifyError(err), err)
+		}
+		for _, w := range workloads {
+			if w.kind != kind {
+				continue
+			}
+			found = true
+			fmt.Printf("%s/%s/%s:\n", w.meta.Namespace, w.kind, w.meta.Name)
+			c.precheckRegistries([]workload{w})
+			if err := c.process(w.kind, w.meta, w.template); err != nil {
+				fmt.Printf("  failed: %s\n", err)
+				report.AddError(classifyError(err), err)
+			}
+		}
+	}
+	if !found && report.ExitCode() == exitOK {
+		report.AddError(configErrorClass, fmt.Errorf("%s %s not found", kind, name))
+	}
+	finish(report)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// trackedImage is an image checked during the run
+type trackedImage struct {
+	resource  string
+	container string
+	// image is the image in spec
+	image string
+	// source is the image followed, latest the image it currently resolve
+	// to (a different tag when following a channel)
+	source        string
+	latest        string
+	currentDigest string
+	latestDigest  string
+}
+
+// AddTracked record an image checked during the run
+func (r *Report) AddTracked(t trackedImage) {
+	r.tracked = append(r.tracked, t)
+}
+
+// AddFixed record a container having a source image with a fixed digest
+func (r *Report) AddFixed(t trackedImage) {
+	r.fixed = append(r.fixed, t)
+}
+
+// dependency is an image used by workloads, in a format close to
+// dependency dashboards like Renovate
+type dependency struct {
+	Datasource      string   `json:"datasource"`
+	DepName         string   `json:"depName"`
+	Registry        string   `json:"registry"`
+	CurrentValue    string   `json:"currentValue"`
+	CurrentDigest   string   `json:"currentDigest,omitempty"`
+	NewValue        string   `json:"newValue"`
+	NewDigest       string   `json:"newDigest"`
+	UpdateAvailable bool     `json:"updateAvailable"`
+	Workloads       []string `json:"workloads"`
+}
+
+// tagOf return the tag of given image, latest if it has none
+func tagOf(image string) (reference.Named, string, error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, "", err
+	}
+	tagged, ok := reference.TagNameOnly(ref).(reference.NamedTagged)
+	if !ok {
+		return nil, "", fmt.Errorf("%s has no tag", image)
+	}
+	return reference.TrimNamed(ref), tagged.Tag(), nil
+}
+
+// dependencies group checked images by image and current digest
+func (r *Report) dependencies() []*dependency {
+	index := make(map[string]*dependency)
+	keys := make([]string, 0)
+	for _, t := range r.tracked {
+		repository, currentTag, err := tagOf(t.source)
+		if err != nil {
+			continue
+		}
+		_, newTag, err := tagOf(t.latest)
+		if err != nil {
+			continue
+		}
+		key := t.source + " " + t.currentDigest
+		d, ok := index[key]
+		if !ok {
+			d = &dependency{
+				Datasource:      "docker",
+				DepName:         repository.String(),
+				Registry:        reference.Domain(repository),
+				CurrentValue:    currentTag,
+				CurrentDigest:   t.currentDigest,
+				NewValue:        newTag,
+				NewDigest:       t.latestDigest,
+				UpdateAvailable: t.currentDigest != "" && t.currentDigest != t.latestDigest,
+				Workloads:       make([]string, 0),
+			}
+			index[key] = d
+			keys = append(keys, key)
+		}
+		d.Workloads = append(d.Workloads, fmt.Sprintf("%s/%s", t.resource, t.container))
+	}
+	sort.Strings(keys)
+	result := make([]*dependency, len(keys))
+	for i, key := range keys {
+		result[i] = index[key]
+	}
+	return result
+}
+
+// writeDependencies write images checked during the run in given file
+func (r *Report) writeDependencies(path string) error {
+	data, err := json.MarshalIndent(map[string]interface{}{"dependencies": r.dependencies()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagoForceResolveAnnotation make imago follow the tag of containers
+// pinned to a digest by hand (e.g. nginx:1.25@sha256:...) when set to
+// "true", like -force-resolve for all workloads
+const imagoForceResolveAnnotation = "imago/force-resolve"
+
+// forceResolve return whether containers of given workload pinned to a
+// digest by hand follow their tag
+func (c *Config) forceResolve(meta *metav1.ObjectMeta) bool {
+	return c.forceResolveAll || meta.Annotations[imagoForceResolveAnnotation] == "true"
+}
+
+// resolvePinnedSources replace source images pinned to a digest and still
+// having their tag by the tag, so that it's followed and recorded in the
+// imago-config-spec annotation. Sources pinned without a tag are kept as
+// fixed digests.
+func (c *Config) resolvePinnedSources(entries []configAnnotationImageSpec) {
+	for i, entry := range entries {
+		if !strings.Contains(entry.Image, "@") {
+			continue
+		}
+		name, tag := splitTag(entry.Image)
+		if tag == "" {
+			c.explainf(entry.Name, "source image %s has no tag to resolve", entry.Image)
+			continue
+		}
+		entries[i].Image = name + ":" + tag
+		c.explainf(entry.Name, "forcing resolution of %s, following %s", entry.Image, entries[i].Image)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Endpoints of Google identity services, replaced in tests
+var (
+	gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpTokenURL    = "https://oauth2.googleapis.com/token"
+)
+
+// gcpAuthProvider get access tokens of Google Container Registry and
+// Artifact Registry from application default credentials: the file of
+// GOOGLE_APPLICATION_CREDENTIALS, the gcloud default credentials or the
+// metadata server (GCE service account or GKE workload identity)
+type gcpAuthProvider struct {
+	token cachedToken
+}
+
+func (p *gcpAuthProvider) String() string {
+	return "gcp application default credentials"
+}
+
+func (p *gcpAuthProvider) matches(host string) bool {
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+func (p *gcpAuthProvider) credentials(ctx context.Context, host string) (*DockerRegistryCredentials, error) {
+	token, err := p.token.get(func() (string, time.Time, error) {
+		return gcpAccessToken(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DockerRegistryCredentials{Username: "oauth2accesstoken", Password: token}, nil
+}
+
+// gcpCredentialsFile is an application default credentials file
+type gcpCredentialsFile struct {
+	Type string `json:"type"`
+	// authorized_user credentials (gcloud auth application-default login)
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	// service_account credentials
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// gcpCredentialsPath return the path of the application default
+// credentials file or an empty string
+func gcpCredentialsPath() string {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// gcpAccessToken return an access token of application default credentials
+// and its expiration time
+func gcpAccessToken(ctx context.Context) (string, time.Time, error) {
+	path := gcpCredentialsPath()
+	if path == "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataURL+"?scopes="+url.QueryEscape(gcpScope), nil)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return requestAccessToken(req)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var creds gcpCredentialsFile
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+	form := url.Values{}
+	tokenURL := gcpTokenURL
+	switch creds.Type {
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	case "service_account":
+		if creds.TokenURI != "" {
+			tokenURL = creds.TokenURI
+		}
+		assertion, err := gcpAssertion(&creds, tokenURL, time.Now())
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("invalid credentials file %s: %w", path, err)
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	default:
+		return "", time.Time{}, fmt.Errorf("unsupported credentials type %q in %s", creds.Type, path)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return requestAccessToken(req)
+}
+
+// gcpAssertion return a JWT signed with the service account key to
+// exchange for an access token
+func gcpAssertion(creds *gcpCredentialsFile, audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("no PEM private key found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return "", err
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private key is not a RSA key")
+	}
+	encode := func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b), err
+	}
+	header, err := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := encode(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcpScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := header + "." + claims
+	hash := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// requestAccessToken send an OAuth2 token request and return the access
+// token and its expiration time
+func requestAccessToken(req *http.Request) (string, time.Time, error) {
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer closeResource(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", time.Time{}, fmt.Errorf("%s: %s %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		// ExpiresIn is a string in Azure responses
+		ExpiresIn json.Number `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", time.Time{}, err
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("%s: no access token in response", req.URL.Host)
+	}
+	expiresIn, err := token.ExpiresIn.Int64()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%s: invalid expires_in: %w", req.URL.Host, err)
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(expiresIn) * time.Second), nil
+}
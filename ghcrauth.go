@@ -0,0 +1,51 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// githubAuthProvider authenticate to the GitHub container registry with the
+// token of GHCR_TOKEN or GITHUB_TOKEN, e.g. the token of a GitHub Actions
+// workflow
+type githubAuthProvider struct{}
+
+func (p *githubAuthProvider) String() string {
+	return "github token"
+}
+
+func (p *githubAuthProvider) matches(host string) bool {
+	return host == "ghcr.io"
+}
+
+func (p *githubAuthProvider) credentials(ctx context.Context, host string) (*DockerRegistryCredentials, error) {
+	token := os.Getenv("GHCR_TOKEN")
+	if token == "" {
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+	if token == "" {
+		return nil, errors.New("GHCR_TOKEN and GITHUB_TOKEN are not set")
+	}
+	// the registry only checks the token, use the workflow actor when
+	// available for the registry audit log
+	username := os.Getenv("GITHUB_ACTOR")
+	if username == "" {
+		username = "imago"
+	}
+	return &DockerRegistryCredentials{Username: username, Password: token}, nil
+}
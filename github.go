@@ -0,0 +1,94 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// githubEscape escape data of a GitHub Actions workflow command
+func githubEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubEscapeProperty escape a property of a GitHub Actions workflow command
+func githubEscapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// markdownCell escape a markdown table cell
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(s)
+}
+
+// githubCommands write workflow commands reporting errors and outdated
+// images, GitHub shows them as annotations of the run and pull requests
+func (r *Report) githubCommands(out io.Writer) {
+	for _, c := range errorClasses {
+		for _, err := range r.errors[c.class] {
+			fmt.Fprintf(out, "::error title=%s::%s\n", githubEscapeProperty("imago "+c.class+" error"), githubEscape(err))
+		}
+	}
+	for _, o := range r.outdated {
+		fmt.Fprintf(out, "::warning title=%s::%s\n", githubEscapeProperty("Outdated image in "+o.resource), githubEscape(o.String()))
+	}
+}
+
+// githubSummary write the markdown job summary of the run
+func (r *Report) githubSummary(out io.Writer) {
+	fmt.Fprintf(out, "## imago\n\n")
+	if len(r.outdated) > 0 {
+		fmt.Fprintf(out, "| Workload | Container | Current image | Available image | Details |\n")
+		fmt.Fprintf(out, "| --- | --- | --- | --- | --- |\n")
+		for _, o := range r.outdated {
+			fmt.Fprintf(out, "| %s | %s | `%s` | `%s` | %s |\n", markdownCell(o.resource), markdownCell(o.container), markdownCell(o.current), markdownCell(o.image), markdownCell(o.details()))
+		}
+		fmt.Fprintf(out, "\n")
+	}
+	for _, c := range errorClasses {
+		for _, err := range r.errors[c.class] {
+			fmt.Fprintf(out, "- :x: %s error: %s\n", c.class, markdownCell(err))
+		}
+	}
+	summary := r.Summary()
+	if len(r.outdated) == 0 && len(r.errors) == 0 {
+		fmt.Fprintf(out, "All images are up to date.\n")
+	} else if len(summary) > 0 {
+		fmt.Fprintf(out, "\n%s\n", summary[len(summary)-1])
+	}
+}
+
+// githubActions report the run outcome to GitHub Actions when imago runs in
+// a workflow
+func (r *Report) githubActions() error {
+	if os.Getenv("GITHUB_ACTIONS") != "true" {
+		return nil
+	}
+	r.githubCommands(os.Stdout)
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer closeResource(f)
+	r.githubSummary(f)
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// codeQualityIssue is a finding of a GitLab code quality report
+type codeQualityIssue struct {
+	Description string              `json:"description"`
+	CheckName   string              `json:"check_name"`
+	Fingerprint string              `json:"fingerprint"`
+	Severity    string              `json:"severity"`
+	Location    codeQualityLocation `json:"location"`
+}
+
+type codeQualityLocation struct {
+	Path  string `json:"path"`
+	Lines struct {
+		Begin int `json:"begin"`
+	} `json:"lines"`
+}
+
+func newCodeQualityIssue(checkName string, severity string, path string, description string, key string) codeQualityIssue {
+	issue := codeQualityIssue{
+		Description: description,
+		CheckName:   checkName,
+		Fingerprint: fmt.Sprintf("%x", sha256.Sum256([]byte(checkName+" "+key))),
+		Severity:    severity,
+	}
+	// workloads aren't files of the repository, GitLab still list them in
+	// merge requests
+	issue.Location.Path = path
+	issue.Location.Lines.Begin = 1
+	return issue
+}
+
+// codeQualityIssues return errors and outdated images as GitLab code quality
+// findings
+func (r *Report) codeQualityIssues() []codeQualityIssue {
+	issues := make([]codeQualityIssue, 0)
+	for _, c := range errorClasses {
+		severity := "major"
+		if c.class == configErrorClass {
+			severity = "critical"
+		}
+		for _, err := range r.errors[c.class] {
+			issues = append(issues, newCodeQualityIssue("imago-"+c.class+"-error", severity, "imago", err, err))
+		}
+	}
+	for _, o := range r.outdated {
+		issues = append(issues, newCodeQualityIssue("imago-outdated-image", "minor", o.resource, o.String(), o.resource+" "+o.container+" "+o.image))
+	}
+	return issues
+}
+
+// writeGitLabCodeQuality write the report as a GitLab code quality artifact
+func (r *Report) writeGitLabCodeQuality(path string) error {
+	data, err := json.MarshalIndent(r.codeQualityIssues(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -4,7 +4,15 @@ go 1.16
 
 require (
 	github.com/containers/image/v5 v5.4.4
+	github.com/lib/pq v1.10.9
+	github.com/nats-io/nats.go v1.22.1
+	github.com/opencontainers/image-spec v1.0.2-0.20190823105129-775207bd45b6
+	github.com/segmentio/kafka-go v0.4.47
+	golang.org/x/crypto v0.14.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
 	k8s.io/api v0.18.5
 	k8s.io/apimachinery v0.18.5
 	k8s.io/client-go v0.18.5
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,194 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagoGroupAnnotation put workloads in a group updated all at once
+const imagoGroupAnnotation = "imago/group"
+
+// updateGroup is a set of workloads either all updated in a run or none
+type updateGroup struct {
+	name string
+	// size is the number of workloads of the group in the run
+	size int
+	// checked is the number of workloads of the group checked so far
+	checked  int
+	upToDate int
+	pending  []*pendingUpdate
+}
+
+// group return the update group of given workload, nil if it isn't part of
+// a group
+func (c *Config) group(resource string) *updateGroup {
+	if c.run == nil {
+		return nil
+	}
+	return c.run.groups[resource]
+}
+
+// groupWorkloads compute update groups of given workloads: workloads having
+// the same imago/group annotation and, when byRepository is set, workloads
+// using the same image repository
+func groupWorkloads(workloads []prioritizedWorkload, byRepository bool) map[string]*updateGroup {
+	// union-find of workloads indexes
+	parent := make([]int, len(workloads))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	keys := make(map[string]int)
+	join := func(i int, key string) {
+		if j, ok := keys[key]; ok {
+			parent[find(i)] = find(j)
+		} else {
+			keys[key] = i
+		}
+	}
+	for i, w := range workloads {
+		if name := w.meta.Annotations[imagoGroupAnnotation]; name != "" {
+			join(i, imagoGroupAnnotation+"="+name)
+		}
+		if !byRepository {
+			continue
+		}
+		for _, containers := range [][]v1.Container{w.template.Spec.InitContainers, w.template.Spec.Containers} {
+			for _, container := range containers {
+				if repository, err := w.config.repositoryName(container.Image); err == nil {
+					join(i, repository)
+				}
+			}
+		}
+	}
+	// name groups after their keys
+	names := make(map[int][]string)
+	for key, i := range keys {
+		root := find(i)
+		names[root] = append(names[root], key)
+	}
+	members := make(map[int][]int)
+	for i := range workloads {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+	groups := make(map[string]*updateGroup)
+	for root, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+		sort.Strings(names[root])
+		g := &updateGroup{name: strings.Join(names[root], ","), size: len(indexes)}
+		for _, i := range indexes {
+			w := workloads[i]
+			groups[fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)] = g
+		}
+	}
+	return groups
+}
+
+// flush apply updates of the group, or hold them all if any workload of the
+// group can't be updated. When an update fails, updates already applied
+// are reverted.
+func (g *updateGroup) flush() {
+	if len(g.pending) == 0 {
+		return
+	}
+	c := g.pending[0].c
+	reason := ""
+	switch {
+	case len(g.pending)+g.upToDate < g.size:
+		reason = fmt.Sprintf("other workloads of group %s can't be updated", g.name)
+	case c.maxUpdates != nil && *c.maxUpdates < len(g.pending):
+		reason = fmt.Sprintf("-max-updates doesn't allow updating the %d workloads of group %s", len(g.pending), g.name)
+	case c.admitRollout() != "":
+		reason = c.admitRollout()
+	}
+	if reason != "" {
+		for _, p := range g.pending {
+			p.hold(reason)
+		}
+		return
+	}
+	log.Printf("updating group %s", g.name)
+	for i, p := range g.pending {
+		err := p.apply()
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("failed to update %s: %w", p.resource(), err)
+		log.Print(err)
+		p.c.report.AddContainerError(classifyError(err), p.resource(), "", err)
+		for _, applied := range g.pending[:i] {
+			applied.revert(g.name)
+		}
+		for _, rest := range g.pending[i+1:] {
+			rest.hold(fmt.Sprintf("update of group %s failed", g.name))
+		}
+		return
+	}
+}
+
+// revert images of an applied update of given group, restarts can't be
+// reverted
+func (p *pendingUpdate) revert(group string) {
+	c, resource := p.c, p.resource()
+	if c.policy != "update" {
+		log.Printf("unable to revert %s of %s, update of group %s failed", c.policy, resource, group)
+		return
+	}
+	log.Printf("reverting %s, update of group %s failed", resource, group)
+	err := c.updateWorkload(p.kind, p.meta.Namespace, p.meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+		revertSpec := func(containers []v1.Container, update map[string]containerUpdate) {
+			for i, container := range containers {
+				if u, ok := update[container.Name]; ok {
+					containers[i].Image = u.current
+				}
+			}
+		}
+		revertSpec(template.Spec.Containers, p.containers)
+		revertSpec(template.Spec.InitContainers, p.initContainers)
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to revert %s: %w", resource, err)
+		log.Print(err)
+		c.report.AddError(classifyError(err), err)
+		return
+	}
+	if c.maxUpdates != nil {
+		*c.maxUpdates++
+	}
+	c.setOutcome(resource, outcomeHeld)
+	c.emitEvents(eventFailed, p.kind, p.meta, p.updates(), fmt.Errorf("reverted, update of group %s failed", group))
+	for _, update := range p.updates() {
+		for name, u := range update {
+			c.report.AddOutdated(resource, name, u)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philpep/imago/imagopb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+const (
+	maxGRPCRuns          = 100
+	grpcSubscriberBuffer = 100
+)
+
+// Run states of RunStatus
+const (
+	runQueued  = "queued"
+	runRunning = "running"
+	runDone    = "done"
+)
+
+// grpcRun is a run triggered through the gRPC API
+type grpcRun struct {
+	id       string
+	state    string
+	started  time.Time
+	finished time.Time
+	report   *Report
+}
+
+// status return the RunStatus of the run
+func (r *grpcRun) status() *imagopb.RunStatus {
+	m := &imagopb.RunStatus{RunId: r.id, State: r.state}
+	if r.state == runDone {
+		m.ExitCode = int32(r.report.ExitCode())
+		m.UpdatesAvailable = int32(len(r.report.outdated))
+		for _, e := range r.report.events {
+			if e.Type == eventApplied {
+				m.UpdatesApplied++
+			}
+		}
+		for _, e := range r.report.runReport().Errors {
+			m.Errors = append(m.Errors, e.Message)
+		}
+		m.Finished = r.finished.UTC().Format(time.RFC3339)
+	}
+	if !r.started.IsZero() {
+		m.Started = r.started.UTC().Format(time.RFC3339)
+	}
+	return m
+}
+
+// eventMessage return the Event message of an update event
+func eventMessage(e *updateEvent) *imagopb.Event {
+	return &imagopb.Event{
+		Type:      e.Type,
+		Time:      e.Time.UTC().Format(time.RFC3339Nano),
+		Namespace: e.Namespace,
+		Kind:      e.Kind,
+		Name:      e.Name,
+		Container: e.Container,
+		Source:    e.Source,
+		Previous:  e.Previous,
+		Image:     e.Image,
+		Reason:    e.Reason,
+		Error:     e.Error,
+		Id:        e.ID,
+	}
+}
+
+// grpcServer serve the gRPC API of imago.proto: runs are triggered with
+// given function, which must serialize them with other runs, and update
+// events are streamed to subscribers as an event sink
+type grpcServer struct {
+	imagopb.UnimplementedImagoServer
+	token string
+	// allowUpdate is set when imago was started with an update policy,
+	// TriggerUpdate is denied otherwise
+	allowUpdate bool
+	trigger     func(req *imagopb.TriggerRequest, update bool, report *Report)
+	mu          sync.Mutex
+	runs        map[string]*grpcRun
+	// standby is set while waiting for the leader election lease, runs
+	// are then triggered on the leader only
+	standby bool
+	// subscribers receive events of StreamEvents calls, events are dropped
+	// for subscribers not keeping up
+	subscribers map[chan *updateEvent]string
+}
+
+func newGRPCServer(token string, allowUpdate bool, trigger func(req *imagopb.TriggerRequest, update bool, report *Report)) *grpcServer {
+	return &grpcServer{token: token, allowUpdate: allowUpdate, trigger: trigger, runs: make(map[string]*grpcRun), subscribers: make(map[chan *updateEvent]string)}
+}
+
+// isLoopbackAddr return true if given listen address only accepts
+// connections from the host itself
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listen serve the gRPC API on given address, over TLS with given
+// certificate files, loaded again when renewed, if any
+func (s *grpcServer) listen(addr string, certFile string, keyFile string) error {
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(s.authorizeUnary), grpc.StreamInterceptor(s.authorizeStream)}
+	if certFile != "" {
+		cert := &servingCertificate{certFile: certFile, keyFile: keyFile}
+		if _, err := cert.load(); err != nil {
+			return fmt.Errorf("unable to load the gRPC API certificate: %s", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{GetCertificate: cert.GetCertificate})))
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to serve the gRPC API: %s", err)
+	}
+	server := grpc.NewServer(opts...)
+	imagopb.RegisterImagoServer(server, s)
+	go func() {
+		if err := server.Serve(l); err != nil {
+			log.Printf("unable to serve the gRPC API: %s", err)
+		}
+	}()
+	return nil
+}
+
+// authorize check the bearer token in the authorization metadata of a
+// call
+func (s *grpcServer) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1 {
+			return nil
+		}
+	}
+	return grpcstatus.Error(codes.Unauthenticated, "invalid or missing bearer token")
+}
+
+func (s *grpcServer) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// send implement eventSink
+func (s *grpcServer) send(e *updateEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch, namespace := range s.subscribers {
+		if namespace != "" && namespace != e.Namespace {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	return nil
+}
+
+// close implement eventSink
+func (s *grpcServer) close() error {
+	return nil
+}
+
+// setStandby record whether this instance waits for the leader election
+// lease
+func (s *grpcServer) setStandby(standby bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.standby = standby
+}
+
+// start trigger a run in the background and return its status
+func (s *grpcServer) start(req *imagopb.TriggerRequest, update bool) (*imagopb.RunStatus, error) {
+	report := NewReport()
+	r := &grpcRun{id: report.run, state: runQueued, report: report}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.standby {
+		return nil, grpcstatus.Error(codes.Unavailable, "standby instance, runs are triggered on the leader")
+	}
+	s.runs[r.id] = r
+	if len(s.runs) > maxGRPCRuns {
+		// forget the oldest completed runs
+		done := make([]*grpcRun, 0)
+		for _, run := range s.runs {
+			if run.state == runDone {
+				done = append(done, run)
+			}
+		}
+		sort.Slice(done, func(i, j int) bool { return done[i].finished.Before(done[j].finished) })
+		if n := len(s.runs) - maxGRPCRuns; n < len(done) {
+			done = done[:n]
+		}
+		for _, run := range done {
+			delete(s.runs, run.id)
+		}
+	}
+	go func() {
+		s.trigger(req, update, report)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		r.state, r.finished = runDone, time.Now()
+	}()
+	log.Printf("run %s triggered through the gRPC API", r.id)
+	return r.status(), nil
+}
+
+// running record that given run started, called by the trigger function
+// once it holds the run lock
+func (s *grpcServer) running(report *Report) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.runs[report.run]; ok {
+		r.state, r.started = runRunning, time.Now()
+	}
+}
+
+// TriggerCheck implement imagopb.ImagoServer
+func (s *grpcServer) TriggerCheck(ctx context.Context, req *imagopb.TriggerRequest) (*imagopb.RunStatus, error) {
+	return s.start(req, false)
+}
+
+// TriggerUpdate implement imagopb.ImagoServer
+func (s *grpcServer) TriggerUpdate(ctx context.Context, req *imagopb.TriggerRequest) (*imagopb.RunStatus, error) {
+	if !s.allowUpdate {
+		return nil, grpcstatus.Error(codes.PermissionDenied, "imago only checks workloads, TriggerUpdate requires -update or -restart")
+	}
+	return s.start(req, true)
+}
+
+// GetRunStatus implement imagopb.ImagoServer
+func (s *grpcServer) GetRunStatus(ctx context.Context, req *imagopb.GetRunStatusRequest) (*imagopb.RunStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.runs[req.GetRunId()]
+	if !ok {
+		return nil, grpcstatus.Errorf(codes.NotFound, "unknown run %q", req.GetRunId())
+	}
+	return r.status(), nil
+}
+
+// StreamEvents implement imagopb.ImagoServer, events of the requested
+// namespace, all when empty, are sent until the client cancels the call
+func (s *grpcServer) StreamEvents(req *imagopb.StreamEventsRequest, stream imagopb.Imago_StreamEventsServer) error {
+	ch := make(chan *updateEvent, grpcSubscriberBuffer)
+	s.mu.Lock()
+	s.subscribers[ch] = req.GetNamespace()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}()
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-ch:
+			if err := stream.Send(eventMessage(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
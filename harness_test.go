@@ -0,0 +1,986 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	imagemanifest "github.com/containers/image/v5/manifest"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"golang.org/x/crypto/pbkdf2"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Test digests
+const (
+	digestA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	digestB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// fakeResolver resolve images from a static map
+type fakeResolver map[string]string
+
+func (f fakeResolver) GetDigest(ctx context.Context, image string, auth *DockerRegistryCredentials) (string, error) {
+	digest, ok := f[image]
+	if !ok {
+		return "", fmt.Errorf("%s not found", image)
+	}
+	return digest, nil
+}
+
+// blockingResolver block lookups until their context is done
+type blockingResolver struct{}
+
+func (blockingResolver) GetDigest(ctx context.Context, image string, auth *DockerRegistryCredentials) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+// resolverFunc adapt a function to DigestResolver
+type resolverFunc func(image string, auth *DockerRegistryCredentials) (string, error)
+
+func (f resolverFunc) GetDigest(ctx context.Context, image string, auth *DockerRegistryCredentials) (string, error) {
+	return f(image, auth)
+}
+
+// newTestConfig return a Config acting on given objects of the default
+// namespace of a fake cluster
+func newTestConfig(t *testing.T, policy string, checkpods bool, resolver DigestResolver, objects ...runtime.Object) *Config {
+	t.Helper()
+	cluster := newFakeCluster(t, objects...)
+	// without client side throttling, tests update many workloads
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: cluster.URL, QPS: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		cluster:    clientset,
+		resolver:   resolver,
+		report:     NewReport(),
+		namespace:  "default",
+		xnamespace: &arrayFlags{},
+		policy:     policy,
+		checkpods:  checkpods,
+		context:    context.Background(),
+	}
+}
+
+// fakeCluster is an in memory kubernetes API server, storing objects as
+// JSON, supporting get, list (with label selectors), create, update
+// (including the status subresource) and delete
+type fakeCluster struct {
+	*httptest.Server
+	mu sync.Mutex
+	// objects indexed by API prefix and resource (e.g. apis/apps/v1
+	// deployments), then namespace/name
+	objects map[string]map[string][]byte
+}
+
+// fakeResources map resources to their API prefix and kind
+var fakeResources = map[string]struct{ prefix, kind string }{
+	"pods":            {"api/v1", "Pod"},
+	"configmaps":      {"api/v1", "ConfigMap"},
+	"secrets":         {"api/v1", "Secret"},
+	"serviceaccounts": {"api/v1", "ServiceAccount"},
+	"nodes":           {"api/v1", "Node"},
+	"namespaces":      {"api/v1", "Namespace"},
+	"events":          {"api/v1", "Event"},
+	"leases":          {"apis/coordination.k8s.io/v1", "Lease"},
+	"deployments":     {"apis/apps/v1", "Deployment"},
+	"daemonsets":      {"apis/apps/v1", "DaemonSet"},
+	"statefulsets":    {"apis/apps/v1", "StatefulSet"},
+	"replicasets":     {"apis/apps/v1", "ReplicaSet"},
+	"cronjobs":        {"apis/batch/v1beta1", "CronJob"},
+	"imagopolicies":   {"apis/imago.philpep.org/v1alpha1", "ImagoPolicy"},
+}
+
+func newFakeCluster(t *testing.T, objects ...runtime.Object) *fakeCluster {
+	t.Helper()
+	f := &fakeCluster{objects: make(map[string]map[string][]byte)}
+	for _, obj := range objects {
+		var resource string
+		var meta *metav1.ObjectMeta
+		switch o := obj.(type) {
+		case *appsv1.Deployment:
+			resource, meta = "deployments", &o.ObjectMeta
+		case *appsv1.ReplicaSet:
+			resource, meta = "replicasets", &o.ObjectMeta
+		case *appsv1.DaemonSet:
+			resource, meta = "daemonsets", &o.ObjectMeta
+		case *appsv1.StatefulSet:
+			resource, meta = "statefulsets", &o.ObjectMeta
+		case *v1.Pod:
+			resource, meta = "pods", &o.ObjectMeta
+		case *v1.ConfigMap:
+			resource, meta = "configmaps", &o.ObjectMeta
+		case *v1.Secret:
+			resource, meta = "secrets", &o.ObjectMeta
+		case *v1.ServiceAccount:
+			resource, meta = "serviceaccounts", &o.ObjectMeta
+		case *v1.Namespace:
+			resource, meta = "namespaces", &o.ObjectMeta
+		case *v1.Node:
+			resource, meta = "nodes", &o.ObjectMeta
+		default:
+			t.Fatalf("unsupported object %T", obj)
+		}
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.store(resource, meta.Namespace, meta.Name, data)
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// store an object, setting its kind and apiVersion
+func (f *fakeCluster) store(resource string, namespace string, name string, data []byte) []byte {
+	var obj map[string]interface{}
+	_ = json.Unmarshal(data, &obj)
+	r := fakeResources[resource]
+	obj["kind"] = r.kind
+	obj["apiVersion"] = strings.TrimPrefix(strings.TrimPrefix(r.prefix, "apis/"), "api/")
+	data, _ = json.Marshal(obj)
+	if f.objects[resource] == nil {
+		f.objects[resource] = make(map[string][]byte)
+	}
+	f.objects[resource][namespace+"/"+name] = data
+	return data
+}
+
+// status write a Status response
+func status(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(&metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   reason,
+		Code:     int32(code),
+	})
+}
+
+func (f *fakeCluster) serve(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// /api/v1/[namespaces/<ns>/]<resource>[/<name>] or
+	// /apis/<group>/<version>/[namespaces/<ns>/]<resource>[/<name>]
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) > 0 && parts[0] == "api" {
+		parts = parts[2:]
+	} else if len(parts) > 2 {
+		parts = parts[3:]
+	}
+	namespace := ""
+	if len(parts) > 2 && parts[0] == "namespaces" {
+		namespace, parts = parts[1], parts[2:]
+	}
+	// the status subresource is updated along with the object
+	if len(parts) == 3 && parts[2] == "status" {
+		parts = parts[:2]
+	}
+	if len(parts) == 0 || len(parts) > 2 {
+		status(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	resource := parts[0]
+	if _, ok := fakeResources[resource]; !ok {
+		status(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(parts) == 1 {
+		switch req.Method {
+		case http.MethodGet:
+			f.list(w, req, resource, namespace)
+		case http.MethodPost:
+			body, _ := ioutil.ReadAll(req.Body)
+			var obj metav1.PartialObjectMetadata
+			_ = json.Unmarshal(body, &obj)
+			if _, ok := f.objects[resource][namespace+"/"+obj.Name]; ok {
+				status(w, http.StatusConflict, metav1.StatusReasonAlreadyExists)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(f.store(resource, namespace, obj.Name, body))
+		default:
+			status(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed)
+		}
+		return
+	}
+	key := namespace + "/" + parts[1]
+	data, ok := f.objects[resource][key]
+	if !ok {
+		status(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		_, _ = w.Write(data)
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(req.Body)
+		_, _ = w.Write(f.store(resource, namespace, parts[1], body))
+	case http.MethodDelete:
+		delete(f.objects[resource], key)
+		_ = json.NewEncoder(w).Encode(&metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusSuccess})
+	default:
+		status(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed)
+	}
+}
+
+// list write objects of given resource in given namespace, all namespaces
+// if empty, matching the label selector of the request, by pages when the
+// request has a limit
+func (f *fakeCluster) list(w http.ResponseWriter, req *http.Request, resource string, namespace string) {
+	selector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+	if err != nil {
+		status(w, http.StatusBadRequest, metav1.StatusReasonBadRequest)
+		return
+	}
+	keys := make([]string, 0)
+	for key := range f.objects[resource] {
+		if namespace == "" || strings.HasPrefix(key, namespace+"/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// the continue token is the key of the first object of the page
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	start := req.URL.Query().Get("continue")
+	items := make([]json.RawMessage, 0)
+	next := ""
+	for _, key := range keys {
+		if key < start {
+			continue
+		}
+		var obj metav1.PartialObjectMetadata
+		_ = json.Unmarshal(f.objects[resource][key], &obj)
+		if !selector.Matches(labels.Set(obj.Labels)) {
+			continue
+		}
+		if limit > 0 && len(items) == limit {
+			next = key
+			break
+		}
+		items = append(items, f.objects[resource][key])
+	}
+	r := fakeResources[resource]
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":       r.kind + "List",
+		"apiVersion": strings.TrimPrefix(strings.TrimPrefix(r.prefix, "apis/"), "api/"),
+		"metadata":   map[string]interface{}{"continue": next},
+		"items":      items,
+	})
+}
+
+// run check and update workloads of given config
+func run(t *testing.T, c *Config) {
+	t.Helper()
+	if err := Update([]*Config{c}, c.report, newRunState(0, false), "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newDeployment(name string, images ...string) *appsv1.Deployment {
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": name}},
+			},
+		},
+	}
+	for i, image := range images {
+		d.Spec.Template.Spec.Containers = append(d.Spec.Template.Spec.Containers, v1.Container{Name: fmt.Sprintf("c%d", i), Image: image})
+	}
+	return d
+}
+
+// newPod return a running pod of given deployment, through a ReplicaSet,
+// with given image IDs
+func newPod(d *appsv1.Deployment, name string, imageIDs ...string) (*appsv1.ReplicaSet, *v1.Pod) {
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            d.Name + "-rs",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: d.Name}},
+		},
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            name,
+			Labels:          d.Spec.Template.Labels,
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: rs.Name}},
+		},
+		Spec:   d.Spec.Template.Spec,
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+	for i, imageID := range imageIDs {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, v1.ContainerStatus{
+			Name:    d.Spec.Template.Spec.Containers[i].Name,
+			Image:   d.Spec.Template.Spec.Containers[i].Image,
+			ImageID: "docker-pullable://" + imageID,
+		})
+	}
+	return rs, pod
+}
+
+// getDeployment return the current state of given deployment
+func getDeployment(t *testing.T, c *Config, name string) *appsv1.Deployment {
+	t.Helper()
+	d, err := c.cluster.AppsV1().Deployments("default").Get(c.context, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// fakeRegistry is a docker registry serving schema 2 manifests and
+// manifest lists, image configs and tag lists
+type fakeRegistry struct {
+	*httptest.Server
+	mu sync.Mutex
+	// manifests of repository:tag
+	manifests map[string][]byte
+	// blobs of repository:digest
+	blobs map[string][]byte
+	// requests count manifest requests
+	requests int
+	// notModified count conditional manifest requests answered with 304
+	notModified int
+	// contentType of manifests, guessed from manifests when empty
+	contentType string
+	// noDigestHeader omit the Docker-Content-Digest header, like some
+	// pull-through caches
+	noDigestHeader bool
+	// delay manifest responses, maxInFlight is the highest number of
+	// manifest requests received at once
+	delay       time.Duration
+	inFlight    int
+	maxInFlight int
+	// users restrict manifests of a repository to given basic auth user
+	users map[string]string
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{manifests: make(map[string][]byte), blobs: make(map[string][]byte)}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// push a new manifest for given repository tag, return its digest
+func (r *fakeRegistry) push(repository string, tag string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	layer := sha256.Sum256([]byte(fmt.Sprintf("%s:%s %d", repository, tag, len(r.manifests))))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":"sha256:%x"},"layers":[]}`, layer)
+	r.manifests[repository+":"+tag] = []byte(manifest)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+}
+
+// pushImage push a manifest and an image config created at given date for
+// given repository tag, return the manifest digest
+func (r *fakeRegistry) pushImage(repository string, tag string, created time.Time) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config := []byte(fmt.Sprintf(`{"created":%q,"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`, created.Format(time.RFC3339)))
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+	r.blobs[repository+":"+configDigest] = config
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":%d,"digest":"%s"},"layers":[]}`, len(config), configDigest)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+	r.manifests[repository+":"+tag] = []byte(manifest)
+	r.manifests[repository+":"+digest] = []byte(manifest)
+	return digest
+}
+
+// pushList push a manifest for each given os/arch platform and a manifest
+// list of them for given repository tag, return digests of platform
+// manifests
+func (r *fakeRegistry) pushList(repository string, tag string, platforms ...string) map[string]string {
+	digests := make(map[string]string)
+	instances := make([]string, 0)
+	for _, platform := range platforms {
+		digest := r.push(repository, tag)
+		r.mu.Lock()
+		r.manifests[repository+":"+digest] = r.manifests[repository+":"+tag]
+		r.mu.Unlock()
+		parts := strings.Split(platform, "/")
+		instances = append(instances, fmt.Sprintf(`{"mediaType":"application/vnd.docker.distribution.manifest.v2+json","size":1,"digest":"%s","platform":{"os":"%s","architecture":"%s"}}`, digest, parts[0], parts[1]))
+		digests[platform] = digest
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests[repository+":"+tag] = []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","manifests":[%s]}`, strings.Join(instances, ",")))
+	return digests
+}
+
+// pushOCI push an OCI image index of an OCI image manifest for given
+// os/arch platform, without mediaType fields like some registries serve
+// them, return the digest of the image manifest
+func (r *fakeRegistry) pushOCI(repository string, tag string, platform string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config := sha256.Sum256([]byte(fmt.Sprintf("%s:%s %d", repository, tag, len(r.manifests))))
+	image := []byte(fmt.Sprintf(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":2,"digest":"sha256:%x"},"layers":[]}`, config))
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(image))
+	parts := strings.Split(platform, "/")
+	r.manifests[repository+":"+digest] = image
+	r.manifests[repository+":"+tag] = []byte(fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":%d,"digest":"%s","platform":{"os":"%s","architecture":"%s"}}]}`, len(image), digest, parts[0], parts[1]))
+	return digest
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.inFlight++
+	if r.inFlight > r.maxInFlight {
+		r.maxInFlight = r.inFlight
+	}
+	r.mu.Unlock()
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() { r.inFlight-- }()
+	if req.URL.Path == "/v2/" {
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if user, ok := r.users[strings.SplitN(path, "/", 2)[0]]; ok {
+		if got, _, _ := req.BasicAuth(); got != user {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		repository := strings.TrimSuffix(path, "/tags/list")
+		tags := make([]string, 0)
+		for key := range r.manifests {
+			if tag := strings.TrimPrefix(key, repository+":"); tag != key && !strings.HasPrefix(tag, "sha256:") {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+		return
+	}
+	if parts := strings.SplitN(path, "/blobs/", 2); len(parts) == 2 {
+		blob, ok := r.blobs[parts[0]+":"+parts[1]]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write(blob)
+		return
+	}
+	parts := strings.SplitN(path, "/manifests/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	r.requests++
+	manifest, ok := r.manifests[parts[0]+":"+parts[1]]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	if !r.noDigestHeader {
+		w.Header().Set("Docker-Content-Digest", digest)
+	}
+	w.Header().Set("Etag", fmt.Sprintf("%q", digest))
+	if req.Header.Get("If-None-Match") == fmt.Sprintf("%q", digest) {
+		r.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	contentType := r.contentType
+	if contentType == "" {
+		contentType = imagemanifest.GuessMIMEType(manifest)
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(manifest)
+}
+
+// host return the registry host to use in image references
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "https://")
+}
+
+// client return a registry client trusting the fake registry
+func (r *fakeRegistry) client() *RegistryClient {
+	reg := NewRegistryClient()
+	reg.client = r.Client()
+	return reg
+}
+
+// setenv set an environment variable for the duration of the test
+func setenv(t *testing.T, key string, value string) {
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// fakeNats is a NATS server recording published subjects, message ids and
+// PONG answers of clients, it rejects publications on denied.> subjects and
+// connections can be dropped to test reconnections
+type fakeNats struct {
+	net.Listener
+	mu        sync.Mutex
+	conns     []net.Conn
+	published []string
+	ids       []string
+	pongs     int
+}
+
+func newFakeNats(t *testing.T) *fakeNats {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNats{Listener: l}
+	t.Cleanup(func() {
+		l.Close()
+		s.drop()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNats) serve(conn net.Conn) {
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"headers\":true,\"max_payload\":1048576}\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "PONG":
+			s.mu.Lock()
+			s.pongs++
+			s.mu.Unlock()
+		case "PUB", "HPUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			msg := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				return
+			}
+			if strings.HasPrefix(fields[1], "denied.") {
+				fmt.Fprintf(conn, "-ERR 'Permissions Violation for Publish to \"%s\"'\r\n", fields[1])
+				continue
+			}
+			id := ""
+			if fields[0] == "HPUB" {
+				headers, _ := strconv.Atoi(fields[len(fields)-2])
+				for _, header := range strings.Split(string(msg[:headers]), "\r\n") {
+					if strings.HasPrefix(header, "Nats-Msg-Id: ") {
+						id = strings.TrimPrefix(header, "Nats-Msg-Id: ")
+					}
+				}
+			}
+			s.mu.Lock()
+			s.published = append(s.published, fields[1])
+			s.ids = append(s.ids, id)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// ping send a PING to connected clients
+func (s *fakeNats) ping() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		fmt.Fprintf(conn, "PING\r\n")
+	}
+}
+
+// drop close connections of clients
+func (s *fakeNats) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeNats) state() (published []string, pongs int, conns int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.published...), s.pongs, len(s.conns)
+}
+
+// recordingSink is an event sink recording events
+type recordingSink struct {
+	events []*updateEvent
+}
+
+func (s *recordingSink) send(e *updateEvent) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) close() error {
+	return nil
+}
+
+// fakeKafka is a Kafka transport of a cluster with a single broker and a
+// single partition topic, recording keys and values of produced records
+type fakeKafka struct {
+	mu     sync.Mutex
+	topic  string
+	keys   []string
+	values []string
+}
+
+func (k *fakeKafka) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch req := req.(type) {
+	case *metadata.Request:
+		res := &metadata.Response{Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "kafka-0", Port: 9092}}}
+		for _, name := range req.TopicNames {
+			topic := metadata.ResponseTopic{Name: name, Partitions: []metadata.ResponsePartition{{LeaderID: 1}}}
+			if name != k.topic {
+				topic = metadata.ResponseTopic{Name: name, ErrorCode: int16(kafka.UnknownTopicOrPartition)}
+			}
+			res.Topics = append(res.Topics, topic)
+		}
+		return res, nil
+	case *produce.Request:
+		records := req.Topics[0].Partitions[0].RecordSet.Records
+		for {
+			r, err := records.ReadRecord()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			key, _ := protocol.ReadAll(r.Key)
+			value, _ := protocol.ReadAll(r.Value)
+			k.keys, k.values = append(k.keys, string(key)), append(k.values, string(value))
+		}
+		return &produce.Response{Topics: []produce.ResponseTopic{{Topic: req.Topics[0].Topic, Partitions: []produce.ResponsePartition{{}}}}}, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", req)
+}
+
+// fakePostgres is a PostgreSQL server authenticating with SCRAM-SHA-256
+// and recording statements and their parameters
+type fakePostgres struct {
+	net.Listener
+	password   string
+	mu         sync.Mutex
+	statements []string
+	params     [][]string
+}
+
+func newFakePostgres(t *testing.T, password string) *fakePostgres {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakePostgres{Listener: l, password: password}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s.serve(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakePostgres) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	send := func(t byte, payload string) {
+		conn.Write(append(appendUint32([]byte{t}, uint32(len(payload)+4)), payload...))
+	}
+	receive := func() (byte, string) {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return 0, ""
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+		if _, err := io.ReadFull(reader, msg); err != nil {
+			return 0, ""
+		}
+		return header[0], string(msg)
+	}
+	auth := func(code uint32, data string) {
+		send('R', string(appendUint32(nil, code))+data)
+	}
+	// SSLRequest then startup message
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, reader, int64(binary.BigEndian.Uint32(header))-8); err != nil {
+			return
+		}
+		if binary.BigEndian.Uint32(header[4:]) != 80877103 {
+			break
+		}
+		conn.Write([]byte("N"))
+	}
+	auth(10, "SCRAM-SHA-256\x00\x00")
+	_, initial := receive()
+	parts := strings.SplitN(initial, "\x00", 2)
+	if len(parts) != 2 || parts[0] != "SCRAM-SHA-256" || len(parts[1]) < 4 {
+		return
+	}
+	clientFirstBare := strings.TrimPrefix(parts[1][4:], "n,,")
+	salt := []byte("fake salt")
+	serverFirst := "r=" + scramAttributes(clientFirstBare)["r"] + "server,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+	auth(11, serverFirst)
+	_, clientFinal := receive()
+	i := strings.Index(clientFinal, ",p=")
+	if i < 0 {
+		return
+	}
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinal[:i]
+	proof, _ := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	salted := pbkdf2.Key([]byte(s.password), salt, 4096, sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	signature := scramHMAC(storedKey[:], authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		if i < len(signature) {
+			clientKey[i] = proof[i] ^ signature[i]
+		}
+	}
+	if sum := sha256.Sum256(clientKey); sum != storedKey {
+		send('E', "SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00")
+		return
+	}
+	auth(12, "v="+base64.StdEncoding.EncodeToString(scramHMAC(scramHMAC(salted, "Server Key"), authMessage)))
+	auth(0, "")
+	placeholders := 0
+	txStatus := "I"
+	send('Z', txStatus)
+	for {
+		t, msg := receive()
+		switch t {
+		case 'Q':
+			query := strings.TrimSuffix(msg, "\x00")
+			s.record(query, nil)
+			tag := strings.Fields(query)[0]
+			switch tag {
+			case "BEGIN":
+				txStatus = "T"
+			case "COMMIT", "ROLLBACK":
+				txStatus = "I"
+			}
+			send('C', tag+"\x00")
+			send('Z', txStatus)
+		case 'P':
+			query := strings.SplitN(msg, "\x00", 3)[1]
+			s.record(query, nil)
+			placeholders = len(regexp.MustCompile(`\$[0-9]+`).FindAllString(query, -1))
+			send('1', "")
+		case 'D':
+			// text parameters, no rows
+			description := appendUint16(nil, uint16(placeholders))
+			for i := 0; i < placeholders; i++ {
+				description = appendUint32(description, 25)
+			}
+			send('t', string(description))
+			send('n', "")
+		case 'B':
+			// unnamed portal and statement, no parameter formats
+			b := []byte(msg[4:])
+			n := int(binary.BigEndian.Uint16(b))
+			b = b[2:]
+			params := make([]string, n)
+			for i := range params {
+				size := int32(binary.BigEndian.Uint32(b))
+				b = b[4:]
+				if size < 0 {
+					params[i] = "NULL"
+					continue
+				}
+				params[i], b = string(b[:size]), b[size:]
+			}
+			s.mu.Lock()
+			s.params[len(s.params)-1] = params
+			s.mu.Unlock()
+			send('2', "")
+		case 'E':
+			send('C', "INSERT 0 1\x00")
+		case 'S':
+			send('Z', txStatus)
+		default:
+			return
+		}
+	}
+}
+
+func (s *fakePostgres) record(statement string, params []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements = append(s.statements, statement)
+	s.params = append(s.params, params)
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+	return h.Sum(nil)
+}
+
+// scramAttributes parse comma separated key=value SCRAM attributes
+func scramAttributes(message string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) > 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// writeServingCertificate write a self signed certificate for 127.0.0.1 and
+// its key in given directory, return their paths and a pool trusting it
+func writeServingCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "imago"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return certFile, keyFile, pool
+}
+
+// freeAddr return a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
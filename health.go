@@ -0,0 +1,148 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthServer serve /healthz and /readyz for liveness and readiness probes
+// of imago running as a Deployment, and record the last runs for the
+// status API and dashboard
+type healthServer struct {
+	mu sync.Mutex
+	// staleAfter fail the liveness probe when no run completed for this
+	// duration, 0 to disable it
+	staleAfter time.Duration
+	started    time.Time
+	lastRun    time.Time
+	stopping   bool
+	// standby is set while waiting for the leader election lease, the
+	// instance is then live and ready without running
+	standby bool
+	// last is the outcome of the last run, served by the status API, and
+	// changes the updates applied or failed by the last runs
+	last    *apiStatus
+	changes []*updateEvent
+}
+
+func newHealthServer(staleAfter time.Duration) *healthServer {
+	return &healthServer{staleAfter: staleAfter, started: time.Now()}
+}
+
+// listen serve health endpoints on given address
+func (h *healthServer) listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to serve health endpoints: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("unable to serve health endpoints: %s", err)
+		}
+	}()
+	return nil
+}
+
+// runDone record the end of given run
+func (h *healthServer) runDone(report *Report) {
+	status := report.apiStatus()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastRun = time.Now()
+	h.last = status
+	for _, e := range report.events {
+		if e.Type == eventApplied || e.Type == eventFailed {
+			h.changes = append(h.changes, e)
+		}
+	}
+	if len(h.changes) > maxDashboardChanges {
+		h.changes = h.changes[len(h.changes)-maxDashboardChanges:]
+	}
+}
+
+// recentChanges return updates applied or failed by the last runs, oldest
+// first
+func (h *healthServer) recentChanges() []*updateEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*updateEvent(nil), h.changes...)
+}
+
+// lastStatus return the outcome of the last run, nil before the first run
+// completed
+func (h *healthServer) lastStatus() *apiStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
+
+// setLeading record whether this instance holds the leader election lease,
+// the liveness delay restart when it starts leading
+func (h *healthServer) setLeading(leading bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.standby = !leading
+	if leading {
+		h.started = time.Now()
+	}
+}
+
+// stop mark imago as shutting down, it is no longer ready
+func (h *healthServer) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopping = true
+}
+
+// healthz fail when no run completed for staleAfter, e.g. a run stuck on
+// an unresponsive registry
+func (h *healthServer) healthz(w http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	last := h.lastRun
+	if last.Before(h.started) {
+		last = h.started
+	}
+	if h.staleAfter > 0 && !h.standby && time.Since(last) > h.staleAfter {
+		http.Error(w, fmt.Sprintf("no run completed since %s", last.UTC().Format(time.RFC3339)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz succeed once a run completed, until shutdown
+func (h *healthServer) readyz(w http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case h.stopping:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	case h.standby:
+		fmt.Fprintln(w, "standby")
+	case h.lastRun.IsZero():
+		http.Error(w, "first run in progress", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// database/sql driver of -history-dsn
+	_ "github.com/lib/pq"
+)
+
+// historySchema create history tables, it is valid for SQLite and PostgreSQL
+const historySchema = `CREATE TABLE IF NOT EXISTS imago_checks (
+  run TEXT NOT NULL,
+  cluster TEXT NOT NULL,
+  checked_at TIMESTAMP NOT NULL,
+  namespace TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  name TEXT NOT NULL,
+  container TEXT NOT NULL,
+  image TEXT NOT NULL,
+  current_digest TEXT,
+  latest_digest TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS imago_updates (
+  run TEXT NOT NULL,
+  cluster TEXT NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  type TEXT NOT NULL,
+  namespace TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  name TEXT NOT NULL,
+  container TEXT NOT NULL,
+  source TEXT NOT NULL,
+  previous TEXT NOT NULL,
+  image TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  error TEXT
+);
+`
+
+// sqlValue format given value as a SQL literal, empty strings are NULL
+func sqlValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case time.Time:
+		return "'" + v.UTC().Format("2006-01-02 15:04:05") + "'"
+	}
+	return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+}
+
+// sqlNull return nil for empty strings, stored as NULL
+func sqlNull(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// historyRows return rows of imago_checks and imago_updates recording
+// checks and updates of the run
+func (r *Report) historyRows() (checks [][]interface{}, updates [][]interface{}) {
+	run, cluster := sqlNull(r.run), sqlNull(r.cluster)
+	started := r.started.UTC().Truncate(time.Second)
+	for _, t := range r.tracked {
+		parts := strings.SplitN(t.resource, "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		checks = append(checks, []interface{}{run, cluster, started, sqlNull(parts[0]), sqlNull(parts[1]), sqlNull(parts[2]),
+			sqlNull(t.container), sqlNull(t.latest), sqlNull(t.currentDigest), sqlNull(t.latestDigest)})
+	}
+	for _, e := range r.events {
+		updates = append(updates, []interface{}{run, cluster, e.Time.UTC().Truncate(time.Second), sqlNull(e.Type), sqlNull(e.Namespace), sqlNull(e.Kind), sqlNull(e.Name),
+			sqlNull(e.Container), sqlNull(e.Source), sqlNull(e.Previous), sqlNull(e.Image), sqlNull(e.Reason), sqlNull(e.Error)})
+	}
+	return checks, updates
+}
+
+// historyInsert return the INSERT statement of a row of given table, with
+// $n placeholders or literal values
+func historyInsert(table string, row []interface{}, literal bool) string {
+	values := make([]string, len(row))
+	for i, v := range row {
+		if literal {
+			values[i] = sqlValue(v)
+		} else {
+			values[i] = "$" + strconv.Itoa(i+1)
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s VALUES (%s)", table, strings.Join(values, ", "))
+}
+
+// historyStatements return SQL statements recording checks and updates of
+// the run
+func (r *Report) historyStatements() string {
+	var b strings.Builder
+	b.WriteString(historySchema)
+	b.WriteString("BEGIN;\n")
+	checks, updates := r.historyRows()
+	for _, row := range checks {
+		b.WriteString(historyInsert("imago_checks", row, true) + ";\n")
+	}
+	for _, row := range updates {
+		b.WriteString(historyInsert("imago_updates", row, true) + ";\n")
+	}
+	b.WriteString("COMMIT;\n")
+	return b.String()
+}
+
+// appendHistory append SQL statements recording the run to given file
+func (r *Report) appendHistory(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(r.historyStatements())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// recordHistory insert checks and updates of the run in a transaction of
+// the PostgreSQL database of given DSN, creating tables if needed
+func (r *Report) recordHistory(ctx context.Context, dsn string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer closeResource(db)
+	if _, err := db.ExecContext(ctx, historySchema); err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	checks, updates := r.historyRows()
+	for _, rows := range []struct {
+		table string
+		rows  [][]interface{}
+	}{{"imago_checks", checks}, {"imago_updates", updates}} {
+		for _, row := range rows.rows {
+			if _, err := tx.ExecContext(ctx, historyInsert(rows.table, row, false), row...); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,415 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// ImagoPolicy custom resources, see deploy/crd.yaml
+const (
+	imagoPolicyGroupVersion = "imago.philpep.org/v1alpha1"
+	imagoPolicyResource     = "imagopolicies"
+	// imagoPolicyReady is the condition type reporting the outcome of the
+	// last check of a policy
+	imagoPolicyReady = "Ready"
+)
+
+// imagoPolicySpec select workloads of the namespace of an ImagoPolicy and
+// how and when they're checked
+type imagoPolicySpec struct {
+	// Selector and FieldSelector select workloads like -l and
+	// -field-selector, all workloads of the namespace when empty
+	Selector      string `json:"selector,omitempty"`
+	FieldSelector string `json:"fieldSelector,omitempty"`
+	// Strategy is check (the default), update or restart
+	Strategy string `json:"strategy,omitempty"`
+	// Interval is the time between checks, the imago/interval annotation
+	// of the namespace or 1h when empty
+	Interval   string `json:"interval,omitempty"`
+	MaxUpdates *int   `json:"maxUpdates,omitempty"`
+	// Priority orders checks of policies due at the same time, highest
+	// first, and is the update priority of selected workloads without
+	// imago/priority annotation
+	Priority *int `json:"priority,omitempty"`
+}
+
+type imagoPolicyCondition struct {
+	Type               string      `json:"type"`
+	Status             string      `json:"status"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+}
+
+// imagoPolicyContainerStatus is the outcome of the last check of a
+// container
+type imagoPolicyContainerStatus struct {
+	Name string `json:"name"`
+	// Image is the image in spec, CurrentDigest the digest it runs and
+	// LatestDigest the digest its source image resolve to
+	Image         string `json:"image,omitempty"`
+	CurrentDigest string `json:"currentDigest,omitempty"`
+	LatestDigest  string `json:"latestDigest,omitempty"`
+	// Action is the action of the run output (up-to-date, available...)
+	Action   string `json:"action"`
+	NewImage string `json:"newImage,omitempty"`
+}
+
+// imagoPolicyWorkloadStatus is the outcome of the last check of a workload
+// selected by an ImagoPolicy
+type imagoPolicyWorkloadStatus struct {
+	Kind        string       `json:"kind"`
+	Name        string       `json:"name"`
+	LastChecked metav1.Time  `json:"lastChecked"`
+	LastUpdate  *metav1.Time `json:"lastUpdate,omitempty"`
+	// LastError is the error of the last check, if any
+	LastError  string                       `json:"lastError,omitempty"`
+	Containers []imagoPolicyContainerStatus `json:"containers,omitempty"`
+}
+
+type imagoPolicyStatus struct {
+	ObservedGeneration int64        `json:"observedGeneration,omitempty"`
+	LastChecked        *metav1.Time `json:"lastChecked,omitempty"`
+	LastUpdate         *metav1.Time `json:"lastUpdate,omitempty"`
+	// PendingUpdates is the number of containers having an update
+	// available after the last check
+	PendingUpdates int                         `json:"pendingUpdates"`
+	Conditions     []imagoPolicyCondition      `json:"conditions,omitempty"`
+	Workloads      []imagoPolicyWorkloadStatus `json:"workloads,omitempty"`
+}
+
+// imagoPolicy is an ImagoPolicy custom resource
+type imagoPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              imagoPolicySpec   `json:"spec"`
+	Status            imagoPolicyStatus `json:"status,omitempty"`
+}
+
+type imagoPolicyList struct {
+	metav1.ListMeta `json:"metadata"`
+	Items           []imagoPolicy `json:"items"`
+}
+
+// imagoPolicyPath return the API path of ImagoPolicies of given namespace,
+// all namespaces if empty, or of given ImagoPolicy
+func imagoPolicyPath(namespace string, name string) string {
+	p := path.Join("/apis", imagoPolicyGroupVersion)
+	if namespace != "" {
+		p = path.Join(p, "namespaces", namespace)
+	}
+	return path.Join(p, imagoPolicyResource, name)
+}
+
+// parse return the imago policy and interval of an ImagoPolicy, given
+// interval when it has none
+func (p *imagoPolicy) parse(defaultInterval time.Duration) (string, time.Duration, error) {
+	interval := defaultInterval
+	if p.Spec.Interval != "" {
+		d, err := time.ParseDuration(p.Spec.Interval)
+		if err != nil || d <= 0 {
+			return "", 0, fmt.Errorf("invalid interval %q", p.Spec.Interval)
+		}
+		interval = d
+	}
+	switch p.Spec.Strategy {
+	case "", "check":
+		return "", interval, nil
+	case "update", "restart":
+		return p.Spec.Strategy, interval, nil
+	}
+	return "", 0, fmt.Errorf("invalid strategy %q, expected check, update or restart", p.Spec.Strategy)
+}
+
+// policyPriority return the priority of an ImagoPolicy, 0 when unset
+func policyPriority(p *imagoPolicy) int {
+	if p.Spec.Priority == nil {
+		return 0
+	}
+	return *p.Spec.Priority
+}
+
+// due tell whether an ImagoPolicy has to be checked, its interval elapsed
+// or its spec changed since the last check
+func (p *imagoPolicy) due(now time.Time, interval time.Duration) bool {
+	return p.Status.LastChecked == nil || p.Status.ObservedGeneration != p.Generation || !now.Before(p.Status.LastChecked.Add(interval))
+}
+
+// setReady set the Ready condition, keeping its transition time when the
+// status doesn't change
+func (p *imagoPolicy) setReady(now time.Time, ready bool, reason string, message string) {
+	status := string(metav1.ConditionFalse)
+	if ready {
+		status = string(metav1.ConditionTrue)
+	}
+	condition := imagoPolicyCondition{imagoPolicyReady, status, reason, message, metav1.NewTime(now)}
+	for i, c := range p.Status.Conditions {
+		if c.Type == imagoPolicyReady {
+			if c.Status == status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+			p.Status.Conditions[i] = condition
+			return
+		}
+	}
+	p.Status.Conditions = append(p.Status.Conditions, condition)
+}
+
+// setWorkloads set the status of workloads checked in given run report,
+// keeping the last update time of workloads not updated by the run
+func (p *imagoPolicy) setWorkloads(now time.Time, report *Report) {
+	previous := make(map[string]*metav1.Time)
+	for _, w := range p.Status.Workloads {
+		previous[w.Kind+"/"+w.Name] = w.LastUpdate
+	}
+	currentDigests := make(map[string]string)
+	for _, t := range report.tracked {
+		currentDigests[t.resource+" "+t.container] = t.currentDigest
+	}
+	updated := make(map[string]time.Time)
+	for _, e := range report.events {
+		if e.Type == eventApplied {
+			updated[e.Kind+"/"+e.Name] = e.Time
+		}
+	}
+	index := make(map[string]int)
+	workloads := make([]imagoPolicyWorkloadStatus, 0)
+	for _, res := range report.results() {
+		// workloads are namespace/kind/name
+		parts := strings.SplitN(res.Workload, "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		key := parts[1] + "/" + parts[2]
+		i, ok := index[key]
+		if !ok {
+			i = len(workloads)
+			index[key] = i
+			w := imagoPolicyWorkloadStatus{Kind: parts[1], Name: parts[2], LastChecked: metav1.NewTime(now), LastUpdate: previous[key]}
+			if t, ok := updated[key]; ok {
+				lastUpdate := metav1.NewTime(t)
+				w.LastUpdate = &lastUpdate
+			}
+			workloads = append(workloads, w)
+		}
+		w := &workloads[i]
+		if res.Error != "" && w.LastError == "" {
+			w.LastError = res.Error
+		}
+		if res.Container == "" {
+			continue
+		}
+		w.Containers = append(w.Containers, imagoPolicyContainerStatus{
+			Name:          res.Container,
+			Image:         res.Image,
+			CurrentDigest: currentDigests[res.Workload+" "+res.Container],
+			LatestDigest:  res.Digest,
+			Action:        res.Action,
+			NewImage:      res.NewImage,
+		})
+	}
+	sort.SliceStable(workloads, func(i, j int) bool {
+		if workloads[i].Kind != workloads[j].Kind {
+			return workloads[i].Kind < workloads[j].Kind
+		}
+		return workloads[i].Name < workloads[j].Name
+	})
+	p.Status.Workloads = workloads
+}
+
+// listImagoPolicies return ImagoPolicies of the namespace of the config
+func (c *Config) listImagoPolicies() ([]imagoPolicy, error) {
+	policies := make([]imagoPolicy, 0)
+	err := listPaged(metav1.ListOptions{}, c.pageSize, func(opts metav1.ListOptions) (string, error) {
+		data, err := c.cluster.CoreV1().RESTClient().Get().AbsPath(imagoPolicyPath(c.namespace, "")).VersionedParams(&opts, scheme.ParameterCodec).Do(c.context).Raw()
+		if err != nil {
+			return "", err
+		}
+		var list imagoPolicyList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return "", err
+		}
+		policies = append(policies, list.Items...)
+		return list.Continue, nil
+	})
+	return policies, err
+}
+
+// updateImagoPolicyStatus write the status of an ImagoPolicy
+func (c *Config) updateImagoPolicyStatus(p *imagoPolicy) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return retryTransient(func() error {
+		return c.cluster.CoreV1().RESTClient().Put().AbsPath(imagoPolicyPath(p.Namespace, p.Name), "status").SetHeader("Content-Type", "application/json").Body(data).Do(c.context).Error()
+	})
+}
+
+// reconcileImagoPolicy check or update workloads selected by an
+// ImagoPolicy and record the outcome in its status
+func (c *Config) reconcileImagoPolicy(p *imagoPolicy, policy string, now time.Time, dependencyTimeout time.Duration) {
+	pc := *c
+	pc.namespace = p.Namespace
+	pc.policy = policy
+	pc.checkpods = c.checkpods || policy == "restart"
+	pc.report = NewReport()
+	pc.maxUpdates = nil
+	pc.defaultPriority = p.Spec.Priority
+	if p.Spec.MaxUpdates != nil {
+		remainingUpdates := *p.Spec.MaxUpdates
+		pc.maxUpdates = &remainingUpdates
+	}
+	err := Update([]*Config{&pc}, pc.report, newRunState(dependencyTimeout, false), p.Spec.FieldSelector, p.Spec.Selector)
+	p.Status.ObservedGeneration = p.Generation
+	checked := metav1.NewTime(now)
+	p.Status.LastChecked = &checked
+	p.Status.PendingUpdates = len(pc.report.outdated)
+	for _, e := range pc.report.events {
+		if e.Type == eventApplied {
+			applied := metav1.NewTime(e.Time)
+			p.Status.LastUpdate = &applied
+		}
+	}
+	p.setWorkloads(now, pc.report)
+	if err != nil {
+		p.setReady(now, false, "CheckFailed", err.Error())
+	} else {
+		p.setReady(now, true, "Checked", fmt.Sprintf("%d updates available", p.Status.PendingUpdates))
+	}
+	for _, line := range pc.report.Summary() {
+		log.Printf("ImagoPolicy %s/%s: %s", p.Namespace, p.Name, line)
+	}
+}
+
+// reconcileImagoPolicies check ImagoPolicies which are due, in order of
+// priority, return the number of checked policies
+func (c *Config) reconcileImagoPolicies(now time.Time, dependencyTimeout time.Duration) int {
+	policies, err := c.listImagoPolicies()
+	if err != nil {
+		log.Printf("unable to list ImagoPolicies: %s", err)
+		return 0
+	}
+	sort.SliceStable(policies, func(i, j int) bool {
+		return policyPriority(&policies[i]) > policyPriority(&policies[j])
+	})
+	// annotations of namespaces may have changed since the last resync
+	c.namespaceCache = nil
+	reconciled := 0
+	for i := range policies {
+		p := &policies[i]
+		if c.xnamespace.Contains(p.Namespace) {
+			continue
+		}
+		defaultInterval, err := c.namespaceInterval(p.Namespace)
+		if err != nil {
+			log.Printf("ImagoPolicy %s/%s: %s", p.Namespace, p.Name, err)
+		}
+		if defaultInterval == 0 {
+			defaultInterval = time.Hour
+		}
+		policy, interval, err := p.parse(defaultInterval)
+		if err != nil {
+			if p.Status.ObservedGeneration == p.Generation && p.Status.LastChecked != nil {
+				continue
+			}
+			log.Printf("ImagoPolicy %s/%s: %s", p.Namespace, p.Name, err)
+			checked := metav1.NewTime(now)
+			p.Status.ObservedGeneration, p.Status.LastChecked = p.Generation, &checked
+			p.setReady(now, false, "InvalidSpec", err.Error())
+		} else if p.due(now, interval) {
+			log.Printf("checking ImagoPolicy %s/%s", p.Namespace, p.Name)
+			c.reconcileImagoPolicy(p, policy, now, dependencyTimeout)
+			reconciled++
+		} else {
+			continue
+		}
+		if err := c.updateImagoPolicyStatus(p); err != nil {
+			log.Printf("ImagoPolicy %s/%s: unable to update status: %s", p.Namespace, p.Name, err)
+		}
+	}
+	return reconciled
+}
+
+func controllerCommand(args []string) {
+	var selection selectionFlags
+	var registry registryFlags
+	var policies policyFlags
+	var events eventFlags
+	var checkpods bool
+	var resync time.Duration
+	var dependencyTimeout time.Duration
+	flags := newCommandFlags("controller", &selection)
+	flags.DurationVar(&resync, "resync", time.Minute, "how often ImagoPolicies are listed to check those which are due")
+	flags.DurationVar(&dependencyTimeout, "dependency-timeout", 10*time.Minute, "how long to wait for workloads listed in the imago/after annotation of a workload to become healthy before updating it")
+	flags.BoolVar(&checkpods, "check-pods", false, "check image digests of running pods, implied by the restart strategy (default false)")
+	registry.register(flags)
+	policies.register(flags)
+	events.register(flags)
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	if resync <= 0 {
+		exit(exitConfigError, fmt.Errorf("-resync must be positive"))
+	}
+	// ImagoPolicies of namespaces selected by -n, -A and -x are reconciled
+	configs, err := selection.configs("", checkpods, NewReport())
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	reg, err := registry.setup(configs)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	if err := policies.setup(configs); err != nil {
+		exit(exitConfigError, err)
+	}
+	closeEvents, err := events.setup(configs)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	daemon(ctx, resync, func() {
+		reconciled := 0
+		for _, c := range configs {
+			reconciled += c.reconcileImagoPolicies(time.Now(), dependencyTimeout)
+		}
+		if reconciled == 0 {
+			return
+		}
+		for _, line := range reg.Summary() {
+			log.Print(line)
+		}
+		reg.reset()
+		for _, c := range configs {
+			c.resetCaches()
+		}
+		if err := registry.loadCredentials(configs); err != nil {
+			log.Printf("unable to reload registry credentials: %s", err)
+		}
+	})
+	closeEvents()
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// manifestCacheKey is the ConfigMap key holding last known manifests
+const manifestCacheKey = "manifests.json"
+
+// errNotModified is returned when the manifest of a tag is the last known
+// one
+var errNotModified = errors.New("manifest not modified")
+
+// knownManifest is the last known manifest of a tag. Its digest is sent
+// with If-None-Match so that unchanged tags cost a single request without
+// downloading the manifest.
+type knownManifest struct {
+	// Digest is the digest of the manifest (or manifest list)
+	Digest string `json:"digest"`
+	// Resolved is the digest the tag resolved to
+	Resolved string `json:"resolved"`
+	// Description tell how the digest was resolved, for explain
+	Description string `json:"description"`
+	// Platform is the platform manifest lists were resolved to
+	Platform string `json:"platform,omitempty"`
+	// Previous is the digest the tag resolved to before it last moved,
+	// at Changed
+	Previous string    `json:"previous,omitempty"`
+	Changed  time.Time `json:"changed,omitempty"`
+}
+
+// movedTag is a tag which resolve to another digest than in the last run
+type movedTag struct {
+	tag      string
+	previous string
+	digest   string
+}
+
+// setKnownManifests replace last known manifests by the JSON written by
+// knownManifestsJSON
+func (r *RegistryClient) setKnownManifests(b []byte) error {
+	known := make(map[string]knownManifest)
+	if err := json.Unmarshal(b, &known); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.known = known
+	return nil
+}
+
+func (r *RegistryClient) knownManifestsJSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return json.MarshalIndent(r.known, "", "  ")
+}
+
+// LoadKnownManifests load last known manifests of tags from given file,
+// written by SaveKnownManifests, a missing file is ignored
+func (r *RegistryClient) LoadKnownManifests(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.setKnownManifests(b)
+}
+
+// SaveKnownManifests write last known manifests of tags to given file
+func (r *RegistryClient) SaveKnownManifests(path string) error {
+	b, err := r.knownManifestsJSON()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// manifestCacheConfigMap return the namespace and name of a
+// "configmap:namespace/name" manifest cache
+func manifestCacheConfigMap(location string) (string, string, bool, error) {
+	if !strings.HasPrefix(location, "configmap:") {
+		return "", "", false, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "configmap:"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false, fmt.Errorf("invalid manifest cache %s, expected configmap:namespace/name", location)
+	}
+	return parts[0], parts[1], true, nil
+}
+
+// loadManifestCache load last known manifests from given file or
+// "configmap:namespace/name" ConfigMap, missing ones are ignored
+func (c *Config) loadManifestCache(reg *RegistryClient, location string) error {
+	namespace, name, isConfigMap, err := manifestCacheConfigMap(location)
+	if err != nil || !isConfigMap {
+		if err != nil {
+			return err
+		}
+		return reg.LoadKnownManifests(location)
+	}
+	var cm *v1.ConfigMap
+	err = retryTransient(func() (err error) {
+		cm, err = c.cluster.CoreV1().ConfigMaps(namespace).Get(c.context, name, metav1.GetOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data, ok := cm.Data[manifestCacheKey]; ok {
+		return reg.setKnownManifests([]byte(data))
+	}
+	return nil
+}
+
+// saveManifestCache write last known manifests to given file or
+// "configmap:namespace/name" ConfigMap, created if missing
+func (c *Config) saveManifestCache(reg *RegistryClient, location string) error {
+	namespace, name, isConfigMap, err := manifestCacheConfigMap(location)
+	if err != nil || !isConfigMap {
+		if err != nil {
+			return err
+		}
+		return reg.SaveKnownManifests(location)
+	}
+	b, err := reg.knownManifestsJSON()
+	if err != nil {
+		return err
+	}
+	client := c.cluster.CoreV1().ConfigMaps(namespace)
+	return retryTransient(func() error {
+		cm, err := client.Get(c.context, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       map[string]string{manifestCacheKey: string(b)},
+			}
+			_, err = client.Create(c.context, cm, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[manifestCacheKey] = string(b)
+		_, err = client.Update(c.context, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// MovedTags return tags which resolved to another digest than in the last
+// run, known from the manifest cache
+func (r *RegistryClient) MovedTags() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	moved := make([]string, 0, len(r.moved))
+	for _, m := range r.moved {
+		moved = append(moved, fmt.Sprintf("%s moved since last run from %s to %s", m.tag, m.previous, m.digest))
+	}
+	return moved
+}
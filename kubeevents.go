@@ -0,0 +1,95 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imageUpdatedReason is the reason of Kubernetes Events recorded on updated
+// workloads
+const imageUpdatedReason = "ImageUpdated"
+
+// maxEventMessageSize is the maximum size of the message of a Kubernetes
+// Event accepted by the API server
+const maxEventMessageSize = 1024
+
+// imageDigest return the digest of given image, or the image itself when
+// it isn't pinned
+func imageDigest(image string) string {
+	if i := strings.Index(image, "@"); i != -1 {
+		return image[i+1:]
+	}
+	return image
+}
+
+// updatedImagesMessage describe image changes of given updates, e.g.
+// "container web updated from sha256:... to sha256:..."
+func updatedImagesMessage(updates []map[string]containerUpdate) string {
+	lines := make([]string, 0)
+	for _, update := range updates {
+		for container, u := range update {
+			lines = append(lines, fmt.Sprintf("container %s updated from %s to %s", container, imageDigest(u.current), imageDigest(u.image)))
+		}
+	}
+	sort.Strings(lines)
+	message := strings.Join(lines, ", ")
+	if len(message) > maxEventMessageSize {
+		message = message[:maxEventMessageSize-3] + "..."
+	}
+	return message
+}
+
+// recordImageUpdated create a Kubernetes Event on given workload describing
+// its image updates, visible in kubectl describe, failures are logged
+func (c *Config) recordImageUpdated(kind string, meta *metav1.ObjectMeta, updates []map[string]containerUpdate) {
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// same naming as client-go event recorders
+			Name:      fmt.Sprintf("%s.%x", meta.Name, now.UnixNano()),
+			Namespace: meta.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion:      kindAPIVersions[kind],
+			Kind:            kind,
+			Namespace:       meta.Namespace,
+			Name:            meta.Name,
+			UID:             meta.UID,
+			ResourceVersion: meta.ResourceVersion,
+		},
+		Reason:         imageUpdatedReason,
+		Message:        updatedImagesMessage(updates),
+		Source:         v1.EventSource{Component: "imago"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           v1.EventTypeNormal,
+	}
+	err := retryTransient(func() error {
+		_, err := c.cluster.CoreV1().Events(meta.Namespace).Create(c.context, event, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		log.Printf("unable to record %s event on %s/%s/%s: %s", imageUpdatedReason, meta.Namespace, kind, meta.Name, err)
+	}
+}
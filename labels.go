@@ -0,0 +1,128 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// GetImageConfig return the image config of given image digest, manifest
+// lists are resolved to the image of our platform
+func (r *RegistryClient) GetImageConfig(ctx context.Context, ref reference.Named, digest string, auth *DockerRegistryCredentials) (*imgspecv1.Image, error) {
+	m, err := r.GetImageManifest(ctx, ref, digest, auth)
+	if err != nil {
+		return nil, err
+	}
+	if s1, ok := m.(*manifest.Schema1); ok {
+		// schema 1 has no config blob, the config is in the history
+		if len(s1.History) == 0 {
+			return nil, fmt.Errorf("manifest has no history")
+		}
+		var config imgspecv1.Image
+		if err := json.Unmarshal([]byte(s1.History[0].V1Compatibility), &config); err != nil {
+			return nil, err
+		}
+		return &config, nil
+	}
+	b, err := r.GetBlob(ctx, ref, string(m.ConfigInfo().Digest), auth)
+	if err != nil {
+		return nil, err
+	}
+	var config imgspecv1.Image
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// GetBlob return the content of a small blob of given repository, like
+// image configs
+func (r *RegistryClient) GetBlob(ctx context.Context, ref reference.Named, digest string, auth *DockerRegistryCredentials) ([]byte, error) {
+	path := reference.Path(ref)
+	u := fmt.Sprintf("%s/v2/%s/blobs/%s", r.registryEndpoint(reference.Domain(ref)), path, digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "imago")
+	image := path + "@" + digest
+	resp, err := r.do(ctx, req, fmt.Sprintf("repository:%s:pull", path), auth)
+	if err != nil {
+		return nil, &RequestError{Host: reference.Domain(ref), Image: image, Err: err}
+	}
+	defer closeResource(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RequestError{Host: reference.Domain(ref), Image: image, Status: resp.StatusCode}
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+}
+
+// parseRequiredLabels parse label requirements like "quality=passed" or
+// "approved-by" (label set to any non empty value)
+func parseRequiredLabels(values []string) (map[string]string, error) {
+	required := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+			return nil, fmt.Errorf("invalid required label %s, expected key=value or key", value)
+		}
+		if len(parts) == 1 {
+			required[parts[0]] = ""
+		} else {
+			required[parts[0]] = parts[1]
+		}
+	}
+	return required, nil
+}
+
+// checkRequiredLabels return an error describing labels of the image of given
+// digest not matching requirements
+func (c *Config) checkRequiredLabels(image string, digest string, auth *DockerRegistryCredentials) error {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return err
+	}
+	config, err := c.reg.GetImageConfig(c.context, reference.TrimNamed(ref), digest, auth)
+	if err != nil {
+		return fmt.Errorf("unable to get image labels: %s", err)
+	}
+	labels := config.Config.Labels
+	keys := make([]string, 0, len(c.requiredLabels))
+	for key := range c.requiredLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		expected, value := c.requiredLabels[key], labels[key]
+		switch {
+		case value == "":
+			return fmt.Errorf("label %s is not set", key)
+		case expected != "" && value != expected:
+			return fmt.Errorf("label %s is %q, %q is required", key, value, expected)
+		}
+	}
+	return nil
+}
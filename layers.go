@@ -0,0 +1,224 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+)
+
+// imageLayers return the layers of given image digest
+func (r *RegistryClient) imageLayers(ctx context.Context, ref reference.Named, digest string, auth *DockerRegistryCredentials) ([]manifest.LayerInfo, error) {
+	m, err := r.GetImageManifest(ctx, ref, digest, auth)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]manifest.LayerInfo, 0)
+	for _, layer := range m.LayerInfos() {
+		if !layer.EmptyLayer {
+			layers = append(layers, layer)
+		}
+	}
+	return layers, nil
+}
+
+// layerDiff summarize layer changes between two images
+type layerDiff struct {
+	unchanged   int
+	added       int
+	removed     int
+	addedSize   int64
+	removedSize int64
+	// sizeUnknown is set when the manifest doesn't provide layer sizes
+	// (schema 1)
+	sizeUnknown bool
+	baseChanged bool
+}
+
+// diffLayers compare layers of the current and the new image
+func diffLayers(current []manifest.LayerInfo, next []manifest.LayerInfo) *layerDiff {
+	d := &layerDiff{}
+	currentDigests := make(map[string]bool)
+	for _, layer := range current {
+		currentDigests[string(layer.Digest)] = true
+	}
+	nextDigests := make(map[string]bool)
+	for _, layer := range next {
+		nextDigests[string(layer.Digest)] = true
+		if currentDigests[string(layer.Digest)] {
+			d.unchanged++
+			continue
+		}
+		d.added++
+		if layer.Size < 0 {
+			d.sizeUnknown = true
+		} else {
+			d.addedSize += layer.Size
+		}
+	}
+	for _, layer := range current {
+		if nextDigests[string(layer.Digest)] {
+			continue
+		}
+		d.removed++
+		if layer.Size < 0 {
+			d.sizeUnknown = true
+		} else {
+			d.removedSize += layer.Size
+		}
+	}
+	d.baseChanged = len(current) > 0 && len(next) > 0 && current[0].Digest != next[0].Digest
+	return d
+}
+
+// formatSize return a human readable size
+func formatSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
+
+func (d *layerDiff) String() string {
+	size := func(sign string, size int64) string {
+		if d.sizeUnknown {
+			return ""
+		}
+		return fmt.Sprintf(" (%s%s)", sign, formatSize(size))
+	}
+	parts := []string{
+		fmt.Sprintf("%d layers unchanged", d.unchanged),
+		fmt.Sprintf("%d added%s", d.added, size("+", d.addedSize)),
+		fmt.Sprintf("%d removed%s", d.removed, size("-", d.removedSize)),
+	}
+	if d.baseChanged {
+		parts = append(parts, "base layer changed")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// currentDigest return the digest currently used by a container, from its
+// pinned spec image or from running pods, or ""
+func currentDigest(specImage string, running map[string]string) string {
+	if ref, err := reference.ParseNormalizedNamed(specImage); err == nil {
+		if canonical, ok := ref.(reference.Canonical); ok {
+			return string(canonical.Digest())
+		}
+	}
+	pods := make([]string, 0, len(running))
+	for pod := range running {
+		pods = append(pods, pod)
+	}
+	sort.Strings(pods)
+	for _, pod := range pods {
+		if ref, err := reference.ParseNormalizedNamed(running[pod]); err == nil {
+			if canonical, ok := ref.(reference.Canonical); ok {
+				return string(canonical.Digest())
+			}
+		}
+	}
+	return ""
+}
+
+// diffImage compare layers of the image currently used by a container with
+// the image of given digest
+func (c *Config) diffImage(image string, specImage string, running map[string]string, digest string, auth *DockerRegistryCredentials) (*layerDiff, error) {
+	current := currentDigest(specImage, running)
+	if current == "" {
+		return nil, fmt.Errorf("current digest is unknown, use --check-pods for containers not pinned to a digest")
+	}
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, err
+	}
+	ref = reference.TrimNamed(ref)
+	currentLayers, err := c.reg.imageLayers(c.context, ref, current, auth)
+	if err != nil {
+		return nil, err
+	}
+	nextLayers, err := c.reg.imageLayers(c.context, ref, digest, auth)
+	if err != nil {
+		return nil, err
+	}
+	return diffLayers(currentLayers, nextLayers), nil
+}
+
+// layersSize return the total size of given layers, or -1 if unknown
+func layersSize(layers []manifest.LayerInfo) int64 {
+	var size int64
+	for _, layer := range layers {
+		if layer.Size < 0 {
+			return -1
+		}
+		size += layer.Size
+	}
+	return size
+}
+
+// compareLayers fill layer changes and pull size of given container update
+func (c *Config) compareLayers(name string, u *containerUpdate, image string, specImage string, running map[string]string, digest string, auth *DockerRegistryCredentials) {
+	diff, err := c.diffImage(image, specImage, running, digest, auth)
+	if err != nil {
+		log.Printf("    %s unable to compare layers: %s", name, err)
+		if !c.pullSize {
+			return
+		}
+		// nodes might need to pull the whole image
+		ref, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			return
+		}
+		layers, err := c.reg.imageLayers(c.context, reference.TrimNamed(ref), digest, auth)
+		if err != nil {
+			log.Printf("    %s unable to get image size: %s", name, err)
+			return
+		}
+		u.pullSize, u.pullSizeMax = layersSize(layers), true
+	} else {
+		if c.layerDiff {
+			u.layers = diff.String()
+			log.Printf("    %s layers: %s", name, u.layers)
+			c.explainf(name, "layers: %s", u.layers)
+		}
+		if c.pullSize && !diff.sizeUnknown {
+			u.pullSize = diff.addedSize
+		}
+	}
+	if u.pullSize >= 0 {
+		log.Printf("    %s pull size: %s", name, u.pullSizeString())
+		c.explainf(name, "pull size: %s", u.pullSizeString())
+	}
+}
+
+// pullSizeString describe the pull size of the update
+func (u *containerUpdate) pullSizeString() string {
+	if u.pullSizeMax {
+		return "up to " + formatSize(u.pullSize)
+	}
+	return formatSize(u.pullSize)
+}
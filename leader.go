@@ -0,0 +1,151 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Leader election timings, the defaults of Kubernetes controllers
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// parseLeaseRef parse the namespace/name of a Lease
+func parseLeaseRef(ref string) (metav1.ObjectMeta, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return metav1.ObjectMeta{}, fmt.Errorf("invalid lease %s, expected namespace/name", ref)
+	}
+	return metav1.ObjectMeta{Namespace: parts[0], Name: parts[1]}, nil
+}
+
+// leaderIdentity return the identity of this instance in leases, the pod
+// name when running in a cluster
+func leaderIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "imago"
+	}
+	return fmt.Sprintf("%s_%d", hostname, os.Getpid())
+}
+
+// leaderElect call run while holding given Lease, until ctx is canceled.
+// run must return once its context is canceled, on shutdown or when the
+// lease is lost, it is then released and acquired again unless ctx is
+// canceled. leading is called when this instance starts and stops leading.
+func (c *Config) leaderElect(ctx context.Context, lease metav1.ObjectMeta, identity string, leading func(bool), run func(context.Context)) error {
+	for ctx.Err() == nil {
+		if err := c.leadOnce(ctx, lease, identity, leading, run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leadOnce wait to acquire the lease and call run until ctx is canceled or
+// the lease is lost
+func (c *Config) leadOnce(ctx context.Context, lease metav1.ObjectMeta, identity string, leading func(bool), run func(context.Context)) error {
+	// the lease is released once run returned, not on shutdown while
+	// the workload in progress is still being updated
+	electionCtx, cancelElection := context.WithCancel(context.Background())
+	defer cancelElection()
+	var mu sync.Mutex
+	started := false
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !started {
+				cancelElection()
+			}
+			mu.Unlock()
+		case <-electionCtx.Done():
+		}
+	}()
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  lease,
+			Client:     c.cluster.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            lease.Namespace + "/" + lease.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				defer close(done)
+				defer cancelElection()
+				mu.Lock()
+				started = true
+				mu.Unlock()
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("acquired lease %s/%s as %s", lease.Namespace, lease.Name, identity)
+				leading(true)
+				defer leading(false)
+				runCtx, cancel := context.WithCancel(leaderCtx)
+				defer cancel()
+				go func() {
+					select {
+					case <-ctx.Done():
+						cancel()
+					case <-runCtx.Done():
+					}
+				}()
+				run(runCtx)
+			},
+			OnStoppedLeading: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if started {
+					log.Printf("stopped leading lease %s/%s", lease.Namespace, lease.Name)
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Printf("waiting for lease %s/%s held by %s", lease.Namespace, lease.Name, leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run(electionCtx)
+	mu.Lock()
+	wait := started
+	mu.Unlock()
+	if wait {
+		<-done
+	}
+	return nil
+}
@@ -16,7 +16,8 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -26,7 +27,9 @@ import (
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
@@ -36,8 +39,8 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/retry"
 
-	"github.com/containers/image/v5/docker"
-	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/philpep/imago/imagopb"
 )
 
 func closeResource(r io.Closer) {
@@ -47,48 +50,108 @@ func closeResource(r io.Closer) {
 	}
 }
 
-var digestCache = map[string]string{}
-
-// GetDigest return the docker digest of given image name
-func GetDigest(ctx context.Context, name string) (string, error) {
-	if digestCache[name] != "" {
-		return digestCache[name], nil
-	}
-	ref, err := docker.ParseReference("//" + name)
-	if err != nil {
-		return "", err
-	}
-	img, err := ref.NewImage(ctx, nil)
-	if err != nil {
-		return "", err
-	}
-	defer func() {
-		if err := img.Close(); err != nil {
-			log.Print(err)
-		}
-	}()
-	b, _, err := img.Manifest(ctx)
-	if err != nil {
-		return "", err
-	}
-	digest, err := manifest.Digest(b)
-	if err != nil {
-		return "", err
-	}
-	digeststr := string(digest)
-	digestCache[name] = digeststr
-	return digeststr, nil
-}
-
 // Config represent a imago configuration
 type Config struct {
-	cluster     *kubernetes.Clientset
+	cluster kubernetes.Interface
+	reg     *RegistryClient
+	// resolver resolve latest digests of images, the registry client
+	// unless replaced (e.g. in tests)
+	resolver    DigestResolver
+	report      *Report
 	secretCache map[string]*v1.Secret
-	namespace   string
-	policy      string
-	checkpods   bool
-	xnamespace  *arrayFlags
-	context     context.Context
+	// serviceAccountCache cache service accounts of workloads, for their
+	// image pull secrets
+	serviceAccountCache map[string]*v1.ServiceAccount
+	dockerConfig        *dockerConfig
+	// authProviders get credentials of registries dockerConfig has none
+	// for
+	authProviders []authProvider
+	nodeImages    map[string]map[string]bool
+	nodeFallback  bool
+	// namespaceCache cache namespaces of workloads, for their annotations
+	namespaceCache map[string]*v1.Namespace
+	// defaultPriority is the update priority of workloads without
+	// imago/priority annotation given by an ImagoPolicy, if any
+	defaultPriority *int
+	// pageSize is the number of objects requested per list call, 0 for
+	// all at once
+	pageSize int64
+	// concurrency is the number of concurrent digest lookups, see
+	// prefetchDigests
+	concurrency int
+	// replicaSetOwners cache owners of ReplicaSets of running pods
+	replicaSetOwners map[string][]string
+	// layerDiff compare layers of current and new images of updates
+	layerDiff bool
+	// pullSize compute the size of layers to pull for updates
+	pullSize bool
+	// registryAliases map registry prefixes (e.g. pull-through caches) to
+	// the registry they mirror
+	registryAliases map[string]string
+	// registryMirrors map registry prefixes to the prefix digests of their
+	// images are looked up on (e.g. a pull-through cache)
+	registryMirrors map[string]string
+	// channels are the release channels workloads can follow, by name
+	channels map[string]*channel
+	// requiredLabels are image labels required to update, an empty value
+	// require the label to be set
+	requiredLabels map[string]string
+	// eventSinks receive update events
+	eventSinks []eventSink
+	// eventRoutes receive update events of matching workloads
+	eventRoutes []*eventRoute
+	// pendingEvents are images of pending updates published in previous
+	// runs, by namespace/kind/name/container
+	pendingEvents map[string]string
+	// maxUpdates is the number of workloads left to update or restart in
+	// the run, shared by all configs, nil when unlimited
+	maxUpdates *int
+	// enforce revert images edited out of band
+	enforce bool
+	// run track outcomes of workloads of the run, shared by all configs,
+	// nil outside of a run checking all selected workloads
+	run *runState
+	// patchDir is the directory where patches applying updates are written
+	// in check mode
+	patchDir string
+	// diff receive diffs of changes updates would apply in check mode, if
+	// set
+	diff io.Writer
+	// pinOnlyOnce only pin containers not pinned to a digest yet
+	pinOnlyOnce bool
+	// forceResolveAll follow the tag of containers pinned to a digest by
+	// hand, see imagoForceResolveAnnotation
+	forceResolveAll bool
+	// pinFormat is the format of pinned references, pinTagDigest or
+	// pinDigest
+	pinFormat string
+	// denyTags are patterns of tags channels never follow
+	denyTags []string
+	// minTagAge is the minimum age of images of tags channels follow
+	minTagAge time.Duration
+	// minAge is the minimum age of images workloads are updated to, see
+	// imagoMinAgeAnnotation
+	minAge time.Duration
+	// cosignKeys are public keys one of which must have signed images
+	// workloads are updated to, if any
+	cosignKeys []crypto.PublicKey
+	// vulnScanners map registry hosts to the scanner of their images, see
+	// checkVulnerabilities
+	vulnScanners map[string]string
+	// vulnSeverity is the lowest severity rank of vulnerabilities blocking
+	// updates
+	vulnSeverity int
+	// decisionPolicy allow or deny each update, if set
+	decisionPolicy *decisionPolicy
+	namespace      string
+	policy         string
+	checkpods      bool
+	xnamespace     *arrayFlags
+	context        context.Context
+	// explain receive the decision trail of explainContainer (or all
+	// containers) when set
+	explain          io.Writer
+	explainContainer string
 }
 
 // NewConfig initialize a new imago config
@@ -139,48 +202,155 @@ func NewConfig(kubeconfig string, namespace string, allnamespaces bool, xnamespa
 	return c, nil
 }
 
-// Update Deployment, DaemonSet and CronJob matching given selectors
-func (c *Config) Update(fieldSelector, labelSelector string) error {
+// workload is a resource having a pod template
+type workload struct {
+	kind     string
+	meta     *metav1.ObjectMeta
+	template *v1.PodTemplateSpec
+}
+
+// listWorkloads return Deployment, DaemonSet, StatefulSet and CronJob
+// matching given selectors, with errors of kinds that failed to be listed
+func (c *Config) listWorkloads(fieldSelector, labelSelector string) ([]workload, []error) {
 	ctx := c.context
 	client := c.cluster.AppsV1()
 	opts := metav1.ListOptions{FieldSelector: fieldSelector, LabelSelector: labelSelector}
-	deployments, err := client.Deployments(c.namespace).List(ctx, opts)
-	if err != nil {
-		return err
-	}
-	failed := make([]string, 0)
-	for _, d := range deployments.Items {
-		if err = c.process("Deployment", &d.ObjectMeta, &d.Spec.Template); err != nil {
-			log.Print(err)
-			failed = append(failed, fmt.Sprintf("failed to check %s/Deployment/%s: %s", d.ObjectMeta.Namespace, d.Name, err))
+	workloads := make([]workload, 0)
+	failed := make([]error, 0)
+	// a failure to list a kind (missing API or RBAC permission) must not
+	// prevent checking other kinds
+	listFailed := func(kind string, err error) {
+		namespace := c.namespace
+		if namespace == "" {
+			namespace = "all namespaces"
 		}
+		failed = append(failed, fmt.Errorf("failed to list %s in %s: %w", kind, namespace, err))
 	}
-	daemonsets, err := client.DaemonSets(c.namespace).List(ctx, opts)
-	if err != nil {
-		return err
-	}
-	for _, ds := range daemonsets.Items {
-		if err := c.process("DaemonSet", &ds.ObjectMeta, &ds.Spec.Template); err != nil {
-			failed = append(failed, fmt.Sprintf("failed to check %s/DaemonSet/%s: %s", ds.ObjectMeta.Namespace, ds.Name, err))
+	// objects are listed by pages, keeping only the state needed of each
+	// workload
+	list := func(kind string, listPage func(metav1.ListOptions) (string, error)) {
+		if err := listPaged(opts, c.pageSize, listPage); err != nil {
+			listFailed(kind, err)
 		}
 	}
-	statefulsets, err := client.StatefulSets(c.namespace).List(ctx, opts)
-	if err != nil {
-		return err
+	list("Deployments", func(opts metav1.ListOptions) (string, error) {
+		page, err := client.Deployments(c.namespace).List(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		for i := range page.Items {
+			d := &page.Items[i]
+			workloads = append(workloads, newWorkload("Deployment", &d.ObjectMeta, &d.Spec.Template))
+		}
+		return page.Continue, nil
+	})
+	list("DaemonSets", func(opts metav1.ListOptions) (string, error) {
+		page, err := client.DaemonSets(c.namespace).List(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		for i := range page.Items {
+			ds := &page.Items[i]
+			workloads = append(workloads, newWorkload("DaemonSet", &ds.ObjectMeta, &ds.Spec.Template))
+		}
+		return page.Continue, nil
+	})
+	list("StatefulSets", func(opts metav1.ListOptions) (string, error) {
+		page, err := client.StatefulSets(c.namespace).List(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		for i := range page.Items {
+			sts := &page.Items[i]
+			workloads = append(workloads, newWorkload("StatefulSet", &sts.ObjectMeta, &sts.Spec.Template))
+		}
+		return page.Continue, nil
+	})
+	batchClient := c.cluster.BatchV1beta1()
+	list("CronJobs", func(opts metav1.ListOptions) (string, error) {
+		page, err := batchClient.CronJobs(c.namespace).List(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		for i := range page.Items {
+			cron := &page.Items[i]
+			workloads = append(workloads, newWorkload("CronJob", &cron.ObjectMeta, &cron.Spec.JobTemplate.Spec.Template))
+		}
+		return page.Continue, nil
+	})
+	selected := make([]workload, 0, len(workloads))
+	for _, w := range workloads {
+		if !c.xnamespace.Contains(w.meta.Namespace) {
+			selected = append(selected, w)
+		}
 	}
-	for _, sts := range statefulsets.Items {
-		if err := c.process("StatefulSet", &sts.ObjectMeta, &sts.Spec.Template); err != nil {
-			failed = append(failed, fmt.Sprintf("failed to check %s/StatefulSet/%s: %s", sts.ObjectMeta.Namespace, sts.Name, err))
+	return selected, failed
+}
+
+// Update Deployment, DaemonSet, StatefulSet and CronJob of given configs
+// matching given selectors, in order of priority
+func Update(configs []*Config, report *Report, run *runState, fieldSelector, labelSelector string) error {
+	workloads := make([]prioritizedWorkload, 0)
+	failed := make([]string, 0)
+	for _, c := range configs {
+		listed, listErrors := c.listWorkloads(fieldSelector, labelSelector)
+		for _, err := range listErrors {
+			log.Print(err)
+			c.report.AddError(classifyError(err), err)
+			failed = append(failed, err.Error())
+		}
+		if run.schedule != nil {
+			due := make([]workload, 0, len(listed))
+			for _, w := range listed {
+				if run.schedule.checks(c, w.meta.Namespace) {
+					due = append(due, w)
+				}
+			}
+			listed = due
+		}
+		c.precheckRegistries(listed)
+		for _, w := range listed {
+			priority, err := c.workloadPriority(w.meta)
+			if err != nil {
+				err = fmt.Errorf("%s/%s/%s: %w", w.meta.Namespace, w.kind, w.meta.Name, err)
+				log.Print(err)
+				c.report.AddError(configErrorClass, err)
+			}
+			c.run = run
+			run.selected[fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)] = true
+			workloads = append(workloads, prioritizedWorkload{c, w, priority})
 		}
 	}
-	batchClient := c.cluster.BatchV1beta1()
-	cronjobs, err := batchClient.CronJobs(c.namespace).List(ctx, opts)
-	if err != nil {
-		return err
+	if len(configs) > 0 {
+		prefetchDigests(workloads, configs[0].concurrency)
 	}
-	for _, cron := range cronjobs.Items {
-		if err := c.process("CronJob", &cron.ObjectMeta, &cron.Spec.JobTemplate.Spec.Template); err != nil {
-			failed = append(failed, fmt.Sprintf("failed to check %s/CronJob/%s: %s", cron.ObjectMeta.Namespace, cron.Name, err))
+	sortByPriority(workloads)
+	workloads, orderErrors := orderByDependencies(workloads)
+	for _, err := range orderErrors {
+		log.Print(err)
+		report.AddError(configErrorClass, err)
+		failed = append(failed, err.Error())
+	}
+	run.groups = groupWorkloads(workloads, run.groupByRepository)
+	for i, pw := range workloads {
+		if run.stopping() {
+			// update groups not fully checked are never flushed
+			log.Printf("stopping, %d workloads left unchecked", len(workloads)-i)
+			break
+		}
+		c, w := pw.config, pw.workload
+		resource := fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)
+		run.outcomes[resource] = outcomeHeld
+		if err := c.process(w.kind, w.meta, w.template); err != nil {
+			err = fmt.Errorf("failed to check %s/%s/%s: %w", w.meta.Namespace, w.kind, w.meta.Name, err)
+			c.report.AddContainerError(classifyError(err), resource, "", err)
+			failed = append(failed, err.Error())
+		}
+		if g := run.groups[resource]; g != nil {
+			g.checked++
+			if g.checked == g.size {
+				g.flush()
+			}
 		}
 	}
 	if len(failed) > 0 {
@@ -196,7 +366,11 @@ func (c *Config) getSecret(namespace string, name string) (*v1.Secret, error) {
 		c.secretCache = make(map[string]*v1.Secret)
 	}
 	if c.secretCache[key] == nil {
-		secret, err := c.cluster.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		var secret *v1.Secret
+		err := retryTransient(func() (err error) {
+			secret, err = c.cluster.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -211,6 +385,8 @@ type configAnnotationImageSpec struct {
 }
 
 type configAnnotation struct {
+	Version        int                         `json:"version"`
+	ConfigMap      string                      `json:"configMap,omitempty"`
 	Containers     []configAnnotationImageSpec `json:"containers"`
 	InitContainers []configAnnotationImageSpec `json:"initContainers"`
 }
@@ -249,26 +425,56 @@ func mergeContainers(configContainers []configAnnotationImageSpec, containers []
 		result = append(result, configAnnotationImageSpec{
 			Name: name, Image: image})
 	}
+	// keep the annotation stable across runs
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
 	return result
 }
 
-func getConfigAnnotation(meta *metav1.ObjectMeta, spec *v1.PodSpec) (*configAnnotation, error) {
-	config := configAnnotation{}
-	rawConfig := meta.GetAnnotations()[imagoConfigAnnotation]
-	if len(rawConfig) > 0 {
-		err := json.Unmarshal([]byte(rawConfig), &config)
-		if err != nil {
-			return nil, err
-		}
+func (c *Config) getConfigAnnotation(meta *metav1.ObjectMeta, spec *v1.PodSpec) (*configAnnotation, error) {
+	config, err := c.loadConfigAnnotation(meta)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &configAnnotation{Version: configAnnotationVersion}
+	}
+	for _, pruned := range pruneConfigAnnotation(config, spec) {
+		log.Printf("    pruning stale %s entry: %s", imagoConfigAnnotation, pruned)
 	}
 	config.Containers = mergeContainers(config.Containers, spec.Containers)
 	config.InitContainers = mergeContainers(config.InitContainers, spec.InitContainers)
-	return &config, nil
+	return config, nil
+}
+
+// normalizeImage return the fully qualified form of given image reference
+// with configured registry aliases (e.g. pull-through caches) replaced
+func (c *Config) normalizeImage(image string) string {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	normalized := ref.String()
+	for alias, target := range c.registryAliases {
+		if strings.HasPrefix(normalized, alias+"/") {
+			ref, err = reference.ParseNormalizedNamed(target + strings.TrimPrefix(normalized, alias))
+			if err != nil {
+				return normalized
+			}
+			return ref.String()
+		}
+	}
+	return normalized
 }
 
-func needUpdate(name string, image string, specImage string, running map[string]string, checkpods bool) bool {
-	if len(running) == 0 && !checkpods {
-		if image != specImage {
+// sameImage return true if given images references are equivalent, the
+// tag of references pinned to a digest doesn't matter
+func (c *Config) sameImage(a string, b string) bool {
+	return a == b || c.normalizeImage(withoutPinnedTag(a)) == c.normalizeImage(withoutPinnedTag(b))
+}
+
+func (c *Config) needUpdate(name string, image string, specImage string, running map[string]string) bool {
+	if len(running) == 0 && !c.checkpods {
+		if !c.sameImage(image, specImage) {
 			log.Printf("    %s need to be updated from %s to %s", name, specImage, image)
 			return true
 		}
@@ -277,7 +483,7 @@ func needUpdate(name string, image string, specImage string, running map[string]
 	}
 	result := false
 	for pod, digest := range running {
-		if digest != image {
+		if !c.sameImage(digest, image) {
 			log.Printf("    %s on %s need to be updated from %s to %s", name, pod, digest, image)
 			result = true
 		} else {
@@ -287,34 +493,189 @@ func needUpdate(name string, image string, specImage string, running map[string]
 	return result
 }
 
-func (c *Config) getUpdates(configContainers []configAnnotationImageSpec, containers []v1.Container, running map[string]map[string]string) map[string]string {
+// containerUpdate is an update proposed for a container
+type containerUpdate struct {
+	// source is the image followed, current the image in spec
+	source  string
+	current string
+	image   string
+	// reason describe why the digest changed (e.g. tag re-pointed)
+	reason string
+	// layers describe layer changes, with -layer-diff
+	layers string
+	// pullSize is the size of layers nodes need to pull, with -pull-size,
+	// or -1 if unknown
+	pullSize int64
+	// pullSizeMax is set when the current image is unknown, pullSize is
+	// then the size of the whole image
+	pullSizeMax bool
+}
+
+func (c *Config) getUpdates(resource string, configContainers []configAnnotationImageSpec, containers []v1.Container, running map[string]map[string]string, channels map[string]*channel, minAge time.Duration, pullSecrets *dockerConfig) map[string]containerUpdate {
 	ctx := c.context
 	re := regexp.MustCompile(".*@(sha256:.*)")
-	update := make(map[string]string)
+	update := make(map[string]containerUpdate)
 	for _, container := range configContainers {
 		match := re.FindStringSubmatch(container.Image)
 		if len(match) > 1 {
+			c.explainf(container.Name, "no update: source image %s has a fixed digest", container.Image)
+			c.report.AddFixed(trackedImage{resource: resource, container: container.Name, image: container.Image})
 			log.Printf("    %s ok (fixed digest)", container.Name)
 			continue
 		}
-		digest, err := GetDigest(ctx, container.Image)
+		c.explainf(container.Name, "source image is %s", container.Image)
+		auth, err := c.registryCredentials(container.Image, pullSecrets)
 		if err != nil {
+			c.explainf(container.Name, "no update: unable to get registry credentials: %s", err)
+			log.Printf("    %s unable to get registry credentials: %s", container.Name, err)
+			c.report.AddContainerError(configErrorClass, resource, container.Name, fmt.Errorf("%s %s: unable to get registry credentials: %s", resource, container.Name, err))
+			continue
+		}
+		if auth != nil {
+			c.explainf(container.Name, "using credentials of user %s from %s", auth.Username, c.registryCredentialsSource(container.Image, pullSecrets))
+		} else {
+			c.explainf(container.Name, "no credentials configured, requesting anonymously")
+		}
+		lookupImage := container.Image
+		ch, ok := channels[container.Name]
+		if !ok {
+			ch = channels[""]
+		}
+		if ch != nil {
+			lookupImage, err = c.channelImage(container.Image, ch, auth)
+			if err != nil {
+				c.explainf(container.Name, "no update: unable to follow channel %s: %s", ch, err)
+				log.Printf("    %s unable to follow channel %s: %s", container.Name, ch, err)
+				c.report.AddContainerError(registryErrorClass, resource, container.Name, fmt.Errorf("%s %s: unable to follow channel %s: %s", resource, container.Name, ch, err))
+				continue
+			}
+			c.explainf(container.Name, "following channel %s, latest tag is %s", ch, lookupImage)
+		}
+		digest, err := c.resolveDigest(ctx, lookupImage, auth, pullSecrets)
+		if mirrored, ok := c.mirrorImage(lookupImage); ok && err == nil && c.reg != nil {
+			mirrorAuth, _ := c.registryCredentials(mirrored, pullSecrets)
+			c.explainf(container.Name, "mirror resolved %s to %s (%s)", mirrored, digest, c.reg.Resolved(mirrored, mirrorAuth))
+		} else if err == nil && c.reg != nil {
+			c.explainf(container.Name, "registry resolved %s to %s (%s)", lookupImage, digest, c.reg.Resolved(lookupImage, auth))
+		}
+		if err != nil && c.nodeFallback {
+			// nodes may still hold an older digest of the tag, only
+			// pin containers not pinned yet so they are never
+			// downgraded
+			if specImage(containers, container.Name) == container.Image {
+				log.Printf("    %s unable to get digest: %s, looking on nodes", container.Name, err)
+				c.explainf(container.Name, "registry lookup failed: %s, looking on nodes", err)
+				digest, err = c.GetNodeDigest(lookupImage)
+				if err == nil {
+					c.explainf(container.Name, "nodes resolve %s to %s", lookupImage, digest)
+				}
+			} else {
+				c.explainf(container.Name, "registry lookup failed: %s, not looking on nodes since the container is already pinned", err)
+			}
+		}
+		if err != nil {
+			if hint := requestHint(err); hint != "" {
+				err = fmt.Errorf("%w (%s)", err, hint)
+			}
+			c.explainf(container.Name, "no update: unable to get digest: %s", err)
 			log.Printf("    %s unable to get digest: %s", container.Name, err)
+			if !errors.Is(err, errRegistryUnreachable) {
+				c.report.AddContainerError(registryErrorClass, resource, container.Name, fmt.Errorf("%s %s: unable to get digest: %w", resource, container.Name, err))
+			}
 			continue
 		}
-		image := strings.Split(container.Image, ":")[0] + "@" + digest
+		image := c.pinImage(container.Image, lookupImage, digest)
 		for _, specContainer := range containers {
 			if specContainer.Name != container.Name {
 				continue
 			}
-			if needUpdate(container.Name, image, specContainer.Image, running[container.Name], c.checkpods) {
-				update[container.Name] = image
+			c.report.AddTracked(trackedImage{
+				resource:      resource,
+				container:     container.Name,
+				image:         specContainer.Image,
+				source:        container.Image,
+				latest:        lookupImage,
+				currentDigest: currentDigest(specContainer.Image, running[container.Name]),
+				latestDigest:  digest,
+			})
+			if c.pinOnlyOnce && strings.Contains(specContainer.Image, "@") {
+				log.Printf("    %s ok (already pinned, -pin-only-once)", container.Name)
+				c.explainf(container.Name, "no update: %s is already pinned and -pin-only-once is set", specContainer.Image)
+				continue
+			}
+			if c.needUpdate(container.Name, image, specContainer.Image, running[container.Name]) {
+				if len(c.requiredLabels) > 0 {
+					if err := c.checkRequiredLabels(lookupImage, digest, auth); err != nil {
+						log.Printf("    %s update blocked: %s", container.Name, err)
+						c.explainf(container.Name, "no update: %s", err)
+						continue
+					}
+					c.explainf(container.Name, "required labels are set on %s", image)
+				}
+				if minAge > 0 {
+					if err := c.checkMinAge(lookupImage, digest, auth, minAge); err != nil {
+						log.Printf("    %s update delayed: %s", container.Name, err)
+						c.explainf(container.Name, "no update: %s", err)
+						continue
+					}
+					c.explainf(container.Name, "%s is older than minimum age %s", image, minAge)
+				}
+				if len(c.cosignKeys) > 0 {
+					if err := c.verifySignature(lookupImage, digest, auth); err != nil {
+						log.Printf("    %s update skipped: %s: %s", container.Name, image, err)
+						c.explainf(container.Name, "no update: %s: %s", image, err)
+						c.report.AddContainerError(otherErrorClass, resource, container.Name, fmt.Errorf("%s %s: update to %s skipped: %w", resource, container.Name, image, err))
+						continue
+					}
+					c.explainf(container.Name, "%s has a valid cosign signature", image)
+				}
+				if scanner := c.vulnScanners[imageHost(lookupImage)]; scanner != "" {
+					if err := c.checkVulnerabilities(scanner, lookupImage, currentDigest(specContainer.Image, running[container.Name]), digest, auth); err != nil {
+						log.Printf("    %s update skipped: %s: %s", container.Name, image, err)
+						c.explainf(container.Name, "no update: %s: %s", image, err)
+						c.report.AddContainerError(otherErrorClass, resource, container.Name, fmt.Errorf("%s %s: update to %s skipped: %w", resource, container.Name, image, err))
+						continue
+					}
+					c.explainf(container.Name, "%s introduce no vulnerability of severity %s or higher", image, severities[c.vulnSeverity])
+				}
+				u := containerUpdate{source: lookupImage, current: specContainer.Image, image: image, reason: c.updateReason(lookupImage, digest, ch, auth), pullSize: -1}
+				log.Printf("    %s: %s", container.Name, u.reason)
+				c.explainf(container.Name, "update proposed: %s differs from %s (%s)", specContainer.Image, image, u.reason)
+				if c.layerDiff || c.pullSize {
+					c.compareLayers(container.Name, &u, lookupImage, specContainer.Image, running[container.Name], digest, auth)
+				}
+				update[container.Name] = u
+			} else {
+				c.explainf(container.Name, "no update: %s is up to date", specContainer.Image)
 			}
 		}
 	}
 	return update
 }
 
+// specImage return the image of given container in spec
+func specImage(containers []v1.Container, name string) string {
+	for _, c := range containers {
+		if c.Name == name {
+			return c.Image
+		}
+	}
+	return ""
+}
+
+// explainf write a step of the decision taken for given container (or for the
+// whole workload if container is empty) when explaining
+func (c *Config) explainf(container string, format string, args ...interface{}) {
+	if c.explain == nil || (container != "" && c.explainContainer != "" && container != c.explainContainer) {
+		return
+	}
+	prefix := "  "
+	if container != "" {
+		prefix += container + ": "
+	}
+	fmt.Fprintf(c.explain, prefix+format+"\n", args...)
+}
+
 func getSelector(labels map[string]string) string {
 	filters := make([]string, 0)
 	for key, value := range labels {
@@ -330,21 +691,17 @@ func (c *Config) getRunningContainers(kind string, meta *metav1.ObjectMeta, temp
 		return runningInitContainers, runningContainers, nil
 	}
 	labelSelector := getSelector(template.ObjectMeta.Labels)
-	running, err := c.cluster.CoreV1().Pods(meta.Namespace).List(ctx, metav1.ListOptions{FieldSelector: "status.phase=Running", LabelSelector: labelSelector})
-	if err != nil {
-		return runningInitContainers, runningContainers, err
-	}
 	match := func(pod *v1.Pod) bool {
 		for _, owner := range pod.OwnerReferences {
 			switch owner.Kind {
 			case "ReplicaSet":
-				rs, err := c.cluster.AppsV1().ReplicaSets(meta.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+				rsOwners, err := c.getReplicaSetOwners(ctx, meta.Namespace, owner.Name)
 				if err != nil {
 					log.Print(err)
 					continue
 				}
-				for _, rsOwner := range rs.OwnerReferences {
-					if rsOwner.Kind == kind && rsOwner.Name == meta.Name {
+				for _, rsOwner := range rsOwners {
+					if rsOwner == kind+"/"+meta.Name {
 						return true
 					}
 				}
@@ -372,71 +729,199 @@ func (c *Config) getRunningContainers(kind string, meta *metav1.ObjectMeta, temp
 		}
 		containers[name][podName] = reMatch[2]
 	}
-	for _, pod := range running.Items {
-		if match(&pod) {
-			runningInitContainers[pod.Name] = make(map[string]string)
-			runningContainers[pod.Name] = make(map[string]string)
-			for _, container := range pod.Status.InitContainerStatuses {
-				addImage(runningInitContainers, container.Name, pod.Name, container.ImageID)
-			}
-			for _, container := range pod.Status.ContainerStatuses {
-				addImage(runningContainers, container.Name, pod.Name, container.ImageID)
+	opts := metav1.ListOptions{FieldSelector: "status.phase=Running", LabelSelector: labelSelector}
+	err := listPaged(opts, c.pageSize, func(opts metav1.ListOptions) (string, error) {
+		running, err := c.cluster.CoreV1().Pods(meta.Namespace).List(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		for _, pod := range running.Items {
+			if match(&pod) {
+				runningInitContainers[pod.Name] = make(map[string]string)
+				runningContainers[pod.Name] = make(map[string]string)
+				for _, container := range pod.Status.InitContainerStatuses {
+					addImage(runningInitContainers, container.Name, pod.Name, container.ImageID)
+				}
+				for _, container := range pod.Status.ContainerStatuses {
+					addImage(runningContainers, container.Name, pod.Name, container.ImageID)
+				}
 			}
 		}
+		return running.Continue, nil
+	})
+	if err != nil {
+		return runningInitContainers, runningContainers, err
 	}
 	return runningInitContainers, runningContainers, nil
 }
 
 func (c *Config) process(kind string, meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
-	ctx := c.context
 	if c.xnamespace.Contains(meta.Namespace) {
 		// namespace excluded from selection
 		return nil
 	}
 	log.Printf("checking %s/%s/%s", meta.Namespace, kind, meta.Name)
-	config, err := getConfigAnnotation(meta, &template.Spec)
+	edited, err := c.enforceConfig(kind, meta, template)
 	if err != nil {
 		return err
 	}
+	config, err := c.getConfigAnnotation(meta, &template.Spec)
+	if err != nil {
+		return err
+	}
+	if c.forceResolve(meta) {
+		c.resolvePinnedSources(config.InitContainers)
+		c.resolvePinnedSources(config.Containers)
+	}
+	switch {
+	case c.policy != "":
+		c.explainf("", "policy: %s", c.policy)
+	case c.checkpods:
+		c.explainf("", "policy: check only, comparing with running pods")
+	default:
+		c.explainf("", "policy: check only, comparing with the pod template")
+	}
+	channels, err := c.workloadChannels(meta)
+	if err != nil {
+		log.Printf("    %s", err)
+		c.report.AddContainerError(configErrorClass, fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name), "", fmt.Errorf("%s/%s/%s: %s", meta.Namespace, kind, meta.Name, err))
+		return nil
+	}
+	minAge, err := c.workloadMinAge(meta)
+	if err != nil {
+		log.Printf("    %s", err)
+		c.report.AddContainerError(configErrorClass, fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name), "", fmt.Errorf("%s/%s/%s: %s", meta.Namespace, kind, meta.Name, err))
+		return nil
+	}
 	runningInitContainers, runningContainers, err := c.getRunningContainers(kind, meta, template)
 	if err != nil {
 		return err
 	}
-	updateInitContainers := c.getUpdates(config.InitContainers, template.Spec.InitContainers, runningInitContainers)
-	updateContainers := c.getUpdates(config.Containers, template.Spec.Containers, runningContainers)
-	if c.policy == "" || (len(updateContainers) == 0 && len(updateInitContainers) == 0) {
+	pullSecrets := c.loadPullSecrets(meta.Namespace, &template.Spec)
+	resource := fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name)
+	updateInitContainers := c.getUpdates(resource, config.InitContainers, template.Spec.InitContainers, runningInitContainers, channels, minAge, pullSecrets)
+	updateContainers := c.getUpdates(resource, config.Containers, template.Spec.Containers, runningContainers, channels, minAge, pullSecrets)
+	c.skipRolledBack(meta, updateInitContainers)
+	c.skipRolledBack(meta, updateContainers)
+	c.applyDecisionPolicy(kind, meta, updateInitContainers, pullSecrets)
+	c.applyDecisionPolicy(kind, meta, updateContainers, pullSecrets)
+	c.revertEdits([]map[string]containerUpdate{updateInitContainers, updateContainers}, edited)
+	if c.policy == "" {
+		for _, update := range []map[string]containerUpdate{updateInitContainers, updateContainers} {
+			for name, u := range update {
+				c.report.AddOutdated(resource, name, u)
+			}
+		}
+		c.emitEvents(eventPending, kind, meta, []map[string]containerUpdate{updateInitContainers, updateContainers}, nil)
+		if c.diff != nil && (len(updateContainers) > 0 || len(updateInitContainers) > 0) {
+			if err := c.writeDiff(kind, meta, template, config, updateInitContainers, updateContainers); err != nil {
+				return err
+			}
+		}
+		if c.patchDir != "" && (len(updateContainers) > 0 || len(updateInitContainers) > 0) {
+			return c.writePatch(kind, meta.Namespace, meta.Name, config, updateInitContainers, updateContainers)
+		}
+		return nil
+	}
+	if len(updateContainers) == 0 && len(updateInitContainers) == 0 {
+		c.setOutcome(resource, outcomeUpToDate)
+		if g := c.group(resource); g != nil {
+			g.upToDate++
+		}
 		return nil
 	}
+	p := &pendingUpdate{c, kind, meta, config, updateInitContainers, updateContainers}
+	g := c.group(resource)
+	hold := c.dependenciesReady(meta)
+	if hold == "" && g == nil && c.maxUpdates != nil && *c.maxUpdates <= 0 {
+		hold = "-max-updates reached"
+	}
+	if hold == "" && g == nil {
+		hold = c.admitRollout()
+	}
+	if hold == "" && g == nil {
+		hold = c.admitWave(meta.Namespace)
+	}
+	switch {
+	case hold != "":
+		p.hold(hold)
+		return nil
+	case g != nil:
+		// applied with other workloads of the group once all are checked
+		g.pending = append(g.pending, p)
+		return nil
+	}
+	return p.apply()
+}
+
+// pendingUpdate is an update of a workload to apply
+type pendingUpdate struct {
+	c              *Config
+	kind           string
+	meta           *metav1.ObjectMeta
+	config         *configAnnotation
+	initContainers map[string]containerUpdate
+	containers     map[string]containerUpdate
+}
+
+func (p *pendingUpdate) resource() string {
+	return fmt.Sprintf("%s/%s/%s", p.meta.Namespace, p.kind, p.meta.Name)
+}
+
+func (p *pendingUpdate) updates() []map[string]containerUpdate {
+	return []map[string]containerUpdate{p.initContainers, p.containers}
+}
+
+// hold report the update as available without applying it
+func (p *pendingUpdate) hold(reason string) {
+	c, resource := p.c, p.resource()
+	log.Printf("not updating %s, %s", resource, reason)
+	for _, update := range p.updates() {
+		for name, u := range update {
+			c.report.AddOutdated(resource, name, u)
+		}
+	}
+	c.emitEvents(eventPending, p.kind, p.meta, p.updates(), nil)
+}
+
+// apply the update according to the policy
+func (p *pendingUpdate) apply() error {
+	c, kind, meta, config := p.c, p.kind, p.meta, p.config
+	updateInitContainers, updateContainers := p.initContainers, p.containers
+	resource := p.resource()
 	log.Printf("%s %s/%s/%s", c.policy, meta.Namespace, kind, meta.Name)
 	var policyUpdateResource func(*metav1.ObjectMeta, *v1.PodTemplateSpec) error
 	switch c.policy {
 	case "update":
 		policyUpdateResource = func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
-			jsonConfig, err := json.Marshal(config)
-			if err != nil {
+			if err := c.storeConfigAnnotation(kind, meta, config); err != nil {
 				return err
 			}
-			jsonConfigString := string(jsonConfig)
-			if meta.Annotations == nil {
-				meta.Annotations = make(map[string]string)
-			}
-			meta.Annotations[imagoConfigAnnotation] = jsonConfigString
-			var updateSpec = func(containers []v1.Container, update map[string]string) {
+			previous := make(map[string]string)
+			var updateSpec = func(containers []v1.Container, update map[string]containerUpdate) {
 				for i, container := range containers {
-					if newImage, ok := update[container.Name]; ok {
-						containers[i].Image = newImage
+					if u, ok := update[container.Name]; ok {
+						previous[container.Name] = container.Image
+						containers[i].Image = u.image
 					}
 				}
 			}
 			updateSpec(template.Spec.Containers, updateContainers)
 			updateSpec(template.Spec.InitContainers, updateInitContainers)
-			return nil
+			if err := storePinnedImages(meta, template); err != nil {
+				return err
+			}
+			return storePreviousImages(meta, previous)
 		}
 	case "restart":
 		policyUpdateResource = func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
 			if meta.Annotations[imagoConfigAnnotation] != "" {
 				log.Printf("deleting %s annotation and reset images", imagoConfigAnnotation)
+				if err := c.deleteConfigMap(kind, meta); err != nil {
+					return err
+				}
 				delete(meta.Annotations, imagoConfigAnnotation)
+				delete(meta.Annotations, imagoPinnedImagesAnnotation)
 				var updateSpec = func(containers []v1.Container, updates []configAnnotationImageSpec) {
 					for i, container := range containers {
 						for _, origContainer := range updates {
@@ -459,16 +944,50 @@ func (c *Config) process(kind string, meta *metav1.ObjectMeta, template *v1.PodT
 			return nil
 		}
 	}
+	err := c.updateWorkload(kind, meta.Namespace, meta.Name, policyUpdateResource)
+	if err != nil {
+		c.emitEvents(eventFailed, kind, meta, []map[string]containerUpdate{updateInitContainers, updateContainers}, err)
+		return err
+	}
+	if c.maxUpdates != nil {
+		*c.maxUpdates--
+	}
+	c.setOutcome(resource, outcomeApplied)
+	c.addToWave(kind, meta)
+	c.emitEvents(eventApplied, kind, meta, []map[string]containerUpdate{updateInitContainers, updateContainers}, nil)
+	if c.policy == "update" {
+		c.recordImageUpdated(kind, meta, []map[string]containerUpdate{updateInitContainers, updateContainers})
+	}
+	if err := c.waitRollout(kind, meta); err != nil {
+		if c.run.rollout.rollback {
+			if rollbackErr := p.rollback(); rollbackErr != nil {
+				err = fmt.Errorf("%w, %s", err, rollbackErr)
+			} else {
+				err = fmt.Errorf("%w, rolled back to previous images", err)
+				c.setOutcome(resource, outcomeHeld)
+			}
+		}
+		log.Print(err)
+		c.report.AddContainerError(classifyError(err), resource, "", err)
+		c.emitEvents(eventFailed, kind, meta, []map[string]containerUpdate{updateInitContainers, updateContainers}, err)
+	}
+	return nil
+}
+
+// updateWorkload fetch the latest version of given workload, apply mutate on
+// its metadata and pod template and update it, retrying on conflicts
+func (c *Config) updateWorkload(kind string, namespace string, name string, mutate func(*metav1.ObjectMeta, *v1.PodTemplateSpec) error) error {
+	ctx := c.context
 	var updateResource func() error
 	switch kind {
 	case "Deployment":
 		updateResource = func() error {
-			client := c.cluster.AppsV1().Deployments(meta.Namespace)
-			resource, err := client.Get(ctx, meta.Name, metav1.GetOptions{})
+			client := c.cluster.AppsV1().Deployments(namespace)
+			resource, err := client.Get(ctx, name, metav1.GetOptions{})
 			if err != nil {
 				return err
 			}
-			if err = policyUpdateResource(&resource.ObjectMeta, &resource.Spec.Template); err != nil {
+			if err = mutate(&resource.ObjectMeta, &resource.Spec.Template); err != nil {
 				return err
 			}
 			_, err = client.Update(ctx, resource, metav1.UpdateOptions{})
@@ -476,12 +995,12 @@ func (c *Config) process(kind string, meta *metav1.ObjectMeta, template *v1.PodT
 		}
 	case "DaemonSet":
 		updateResource = func() error {
-			client := c.cluster.AppsV1().DaemonSets(meta.Namespace)
-			resource, err := client.Get(ctx, meta.Name, metav1.GetOptions{})
+			client := c.cluster.AppsV1().DaemonSets(namespace)
+			resource, err := client.Get(ctx, name, metav1.GetOptions{})
 			if err != nil {
 				return err
 			}
-			if err = policyUpdateResource(&resource.ObjectMeta, &resource.Spec.Template); err != nil {
+			if err = mutate(&resource.ObjectMeta, &resource.Spec.Template); err != nil {
 				return err
 			}
 			_, err = client.Update(ctx, resource, metav1.UpdateOptions{})
@@ -489,12 +1008,12 @@ func (c *Config) process(kind string, meta *metav1.ObjectMeta, template *v1.PodT
 		}
 	case "StatefulSet":
 		updateResource = func() error {
-			client := c.cluster.AppsV1().StatefulSets(meta.Namespace)
-			resource, err := client.Get(ctx, meta.Name, metav1.GetOptions{})
+			client := c.cluster.AppsV1().StatefulSets(namespace)
+			resource, err := client.Get(ctx, name, metav1.GetOptions{})
 			if err != nil {
 				return err
 			}
-			if err = policyUpdateResource(&resource.ObjectMeta, &resource.Spec.Template); err != nil {
+			if err = mutate(&resource.ObjectMeta, &resource.Spec.Template); err != nil {
 				return err
 			}
 			_, err = client.Update(ctx, resource, metav1.UpdateOptions{})
@@ -502,12 +1021,12 @@ func (c *Config) process(kind string, meta *metav1.ObjectMeta, template *v1.PodT
 		}
 	case "CronJob":
 		updateResource = func() error {
-			client := c.cluster.BatchV1beta1().CronJobs(meta.Namespace)
-			resource, err := client.Get(ctx, meta.Name, metav1.GetOptions{})
+			client := c.cluster.BatchV1beta1().CronJobs(namespace)
+			resource, err := client.Get(ctx, name, metav1.GetOptions{})
 			if err != nil {
 				return err
 			}
-			if err = policyUpdateResource(&resource.ObjectMeta, &resource.Spec.JobTemplate.Spec.Template); err != nil {
+			if err = mutate(&resource.ObjectMeta, &resource.Spec.JobTemplate.Spec.Template); err != nil {
 				return err
 			}
 			_, err = client.Update(ctx, resource, metav1.UpdateOptions{})
@@ -516,10 +1035,9 @@ func (c *Config) process(kind string, meta *metav1.ObjectMeta, template *v1.PodT
 	default:
 		return fmt.Errorf("unhandled kind %s", kind)
 	}
-	if err := retry.RetryOnConflict(retry.DefaultRetry, updateResource); err != nil {
-		return err
-	}
-	return nil
+	return retryTransient(func() error {
+		return retry.RetryOnConflict(retry.DefaultRetry, updateResource)
+	})
 }
 
 func inClusterClientPossible() bool {
@@ -540,7 +1058,7 @@ func defaultKubeConfig() string {
 func inClusterNamespace() string {
 	data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 	if err != nil {
-		log.Fatal(err)
+		exit(exitConfigError, err)
 	}
 	if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
 		return ns
@@ -551,7 +1069,7 @@ func inClusterNamespace() string {
 func outClusterNamespace(kubeconfig string) string {
 	config := clientcmd.GetConfigFromFileOrDie(kubeconfig)
 	if len(config.Contexts) == 0 || config.Contexts[config.CurrentContext] == nil {
-		log.Fatal("No kubernetes contexts availables")
+		exit(exitConfigError, fmt.Errorf("No kubernetes contexts availables"))
 	}
 	return config.Contexts[config.CurrentContext].Namespace
 }
@@ -559,7 +1077,7 @@ func outClusterNamespace(kubeconfig string) string {
 func homeDir() string {
 	user, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		exit(exitConfigError, err)
 	}
 	return user.HomeDir
 }
@@ -584,51 +1102,392 @@ func (i *arrayFlags) Contains(value string) bool {
 	return false
 }
 
+// Map parse flags in key=value format
+func (i *arrayFlags) Map() (map[string]string, error) {
+	result := make(map[string]string)
+	for _, x := range *i {
+		parts := strings.SplitN(x, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid value %s, expected key=value", x)
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result, nil
+}
+
+// exit log given error and exit with given code
+func exit(code int, err error) {
+	log.Print(err)
+	os.Exit(code)
+}
+
 func main() {
-	var kubeconfig string
-	var labelSelector string
-	var fieldSelector string
-	var allnamespaces bool
-	var namespace arrayFlags
-	var xnamespace arrayFlags
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command.run(os.Args[2:])
+			return
+		}
+	}
+	var selection selectionFlags
+	var registry registryFlags
+	var policies policyFlags
+	var events eventFlags
 	var update bool
 	var restart bool
 	var checkpods bool
-	flag.StringVar(&kubeconfig, "kubeconfig", defaultKubeConfig(), "kube config file")
-	flag.Var(&namespace, "n", "Check deployments and daemonsets in given namespaces (default to current namespace)")
-	flag.Var(&xnamespace, "x", "Check deployments and daemonsets in all namespaces except given namespaces (implies --all-namespaces)")
-	flag.StringVar(&labelSelector, "l", "", "Kubernetes labels selectors\nWarning: applies to Deployment, DaemonSet, StatefulSet and CronJob, not pods !")
-	flag.StringVar(&fieldSelector, "field-selector", "", "Kubernetes field-selector\nexample: metadata.name=myapp")
-	flag.BoolVar(&allnamespaces, "all-namespaces", false, "Check deployments and daemonsets on all namespaces (default false)")
-	flag.BoolVar(&allnamespaces, "A", false, "Check deployments and daemonsets on all namespaces (shorthand) (default false)")
+	var patchDir string
+	var diff bool
+	var defaults string
+	var maxUpdates int
+	var dependencyTimeout time.Duration
+	var groupUpdates bool
+	var namespacesPerWave int
+	var waveTimeout time.Duration
+	var waitRollouts bool
+	var waitTimeout time.Duration
+	var maxUnhealthy int
+	var rollbackOnFailure bool
+	var daemonMode bool
+	var interval time.Duration
+	var healthAddr string
+	var apiAddr string
+	var apiTLSCert string
+	var apiTLSKey string
+	var grpcAddr string
+	var grpcTLSCert string
+	var grpcTLSKey string
+	var leaderElection string
+	report := NewReport()
+	selection.register(flag.CommandLine)
 	flag.BoolVar(&update, "update", false, "update deployments and daemonsets to use newer images (default false)")
 	flag.BoolVar(&restart, "restart", false, "rollout restart deployments and daemonsets to use newer images, implies -check-pods and assume imagePullPolicy is Always (default false)")
+	flag.IntVar(&maxUpdates, "max-updates", -1, "update or restart at most given number of workloads, in order of their imago/priority annotation, remaining updates are reported as available, -1 for no limit")
+	flag.DurationVar(&dependencyTimeout, "dependency-timeout", 10*time.Minute, "how long to wait for workloads listed in the imago/after annotation of a workload to become healthy before updating it")
+	flag.BoolVar(&groupUpdates, "group-updates", false, "update workloads using the same image repository all at once, or none of them if one can't be updated (default false)")
+	flag.IntVar(&namespacesPerWave, "namespaces-per-wave", 0, "update at most given number of namespaces at once, waiting for rollouts of a wave to complete before updating next namespaces, 0 for no limit")
+	flag.DurationVar(&waveTimeout, "wave-timeout", 10*time.Minute, "how long to wait for rollouts of a wave of namespaces to complete, remaining updates are held after a timeout")
+	flag.BoolVar(&waitRollouts, "wait", false, "update workloads one at a time, waiting for the rollout of each updated workload to become healthy before updating the next one (default false)")
+	flag.DurationVar(&waitTimeout, "wait-timeout", 10*time.Minute, "how long to wait for the rollout of an updated workload to become healthy with -wait")
+	flag.IntVar(&maxUnhealthy, "max-unhealthy", 1, "with -wait, hold remaining updates once given number of rollouts didn't become healthy, 0 for no limit")
+	flag.BoolVar(&rollbackOnFailure, "rollback-on-failure", false, fmt.Sprintf("restore previous images of updated workloads whose rollout didn't become healthy within -wait-timeout, implies -wait, rolled back images are recorded in the %s annotation and not updated to again (default false)", imagoRolledBackAnnotation))
+	flag.BoolVar(&daemonMode, "daemon", false, "keep running and check or update workloads every -interval instead of exiting after a single run (default false)")
+	flag.DurationVar(&interval, "interval", time.Hour, "time between runs in -daemon mode, up to 10% of jitter is added")
+	flag.StringVar(&healthAddr, "health-addr", "", "serve /healthz and /readyz probes on given address, /healthz fails when no run completed for 3 -interval in -daemon mode and /readyz until the first run completed and on shutdown\nexample: :8080")
+	flag.StringVar(&apiAddr, "api-addr", "", "serve the status API and the dashboard of the last run on given address, clients authenticate with IMAGO_API_TOKEN as bearer token or as basic auth password of user imago\nexample: :8443")
+	flag.StringVar(&apiTLSCert, "api-tls-cert", "", "serve -api-addr over TLS with given certificate file, loaded again when renewed")
+	flag.StringVar(&apiTLSKey, "api-tls-key", "", "TLS private key file of -api-tls-cert")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "in -daemon mode, serve the gRPC API of imago.proto (TriggerCheck, TriggerUpdate, GetRunStatus, StreamEvents) on given address, clients authenticate with IMAGO_API_TOKEN as bearer token, only a loopback address can be served without -grpc-tls-cert\nexample: :9090")
+	flag.StringVar(&grpcTLSCert, "grpc-tls-cert", "", "serve -grpc-addr over TLS with given certificate file, loaded again when renewed")
+	flag.StringVar(&grpcTLSKey, "grpc-tls-key", "", "TLS private key file of -grpc-tls-cert")
+	flag.StringVar(&leaderElection, "leader-election-lease", "", "in -daemon mode, run only while holding given namespace/name coordination.k8s.io Lease, so only one of several replicas checks and updates workloads at a time\nexample: default/imago")
 	flag.BoolVar(&checkpods, "check-pods", false, "check image digests of running pods (default false)")
+	flag.StringVar(&report.exportDependencies, "export-dependencies", "", "write all checked images, their current and latest digests and workloads using them as JSON in given file")
+	flag.Var(&report.uploads, "upload-report", "upload the JSON run report to given s3://bucket/key, gs://bucket/key or https:// URL, {cluster}, {date}, {time} and {run} are expanded (can be repeated)\nexample: s3://reports/imago/{cluster}/{date}/{run}.json")
+	flag.Var(&report.auditUploads, "upload-audit-log", "upload updates found, applied or failed during the run as JSON lines to given s3://bucket/key, gs://bucket/key or https:// URL, placeholders are expanded as with -upload-report (can be repeated)\nexample: s3://audit/imago/{cluster}/{date}/{run}.jsonl")
+	flag.StringVar(&report.output, "output", "", "write a report of each workload and container checked on stdout when the run ends: json or yaml, logs are written on stderr")
+	flag.BoolVar(&report.detailedExitCode, "detailed-exitcode", false, "exit with 0 when everything is up to date, 2 when updates are available or were applied and 1 on any error, instead of exit codes per error class and 0 when updates are available or applied (default false)")
+	flag.StringVar(&report.history, "history-sql", "", "append checks and updates of the run as SQL statements to given file, to be loaded in SQLite or PostgreSQL")
+	flag.StringVar(&report.historyDSN, "history-dsn", "", "record checks and updates of each run in given PostgreSQL database, tables are created if needed, the password defaults to PGPASSWORD\nexample: postgres://imago@postgres:5432/imago?sslmode=require")
+	flag.Var(&report.notifyURLs, "notify-url", "POST the JSON output of each run, as written with -output json, to given http(s) URL, signed with HMAC-SHA256 in the X-Imago-Signature header when IMAGO_NOTIFY_SECRET is set (can be repeated)\nexample: https://hooks.example.com/imago")
+	flag.StringVar(&report.pushgateway, "pushgateway-url", "", "push metrics of each run (duration, updates, errors) to given Prometheus Pushgateway, grouped by job imago and cluster -cluster-name\nexample: http://pushgateway.monitoring:9091")
+	flag.StringVar(&report.cluster, "cluster-name", "default", "cluster name used in uploaded reports, notifications and metrics")
+	flag.StringVar(&report.gitlabCodeQuality, "gitlab-codequality", "", "write errors and outdated images as a GitLab code quality report in given file")
+	flag.StringVar(&defaults, "defaults", defaultsConfigMap, "load default values of flags not given on the command line from given namespace/name ConfigMap, keys are flag names, empty to disable")
+	flag.BoolVar(&diff, "diff", false, fmt.Sprintf("in check mode, print a unified diff of images and %s annotation of workloads updates would change (default false)", imagoConfigAnnotation))
+	flag.StringVar(&patchDir, "write-patches", "", "in check mode, write a patch applying updates of each workload in given directory, to be applied with kubectl patch")
+	registry.register(flag.CommandLine)
+	policies.register(flag.CommandLine)
+	events.register(flag.CommandLine)
+	flag.Usage = usage
 	flag.Parse()
-	if allnamespaces && len(namespace) > 0 {
-		log.Fatal("You can't use -n with --all-namespaces")
+	loadedDefaults, err := loadDefaults(flag.CommandLine, selection.kubeconfig, defaults)
+	if err != nil {
+		exit(exitConfigError, err)
 	}
-	if len(namespace) == 0 {
-		namespace = append(namespace, "")
+	var policy string
+	if patchDir != "" && (update || restart) {
+		exit(exitConfigError, fmt.Errorf("-write-patches can't be used with -update or -restart"))
 	}
-	if len(xnamespace) > 0 {
-		allnamespaces = true
+	if report.output != "" && report.output != "json" && report.output != "yaml" {
+		exit(exitConfigError, fmt.Errorf("unsupported -output format %s, expected json or yaml", report.output))
+	}
+	for _, u := range report.notifyURLs {
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			exit(exitConfigError, fmt.Errorf("unsupported -notify-url %s, expected an http(s) URL", u))
+		}
+	}
+	if diff && (update || restart) {
+		exit(exitConfigError, fmt.Errorf("-diff can't be used with -update or -restart"))
+	}
+	if restart && policies.pinOnlyOnce {
+		exit(exitConfigError, fmt.Errorf("-pin-only-once can't be used with -restart"))
+	}
+	if restart && policies.enforce {
+		exit(exitConfigError, fmt.Errorf("-enforce can't be used with -restart"))
+	}
+	var lease metav1.ObjectMeta
+	if leaderElection != "" {
+		if !daemonMode {
+			exit(exitConfigError, fmt.Errorf("-leader-election-lease requires -daemon"))
+		}
+		ref, err := parseLeaseRef(leaderElection)
+		if err != nil {
+			exit(exitConfigError, err)
+		}
+		lease = ref
+	}
+	if apiAddr != "" && os.Getenv(apiTokenEnv) == "" {
+		exit(exitConfigError, fmt.Errorf("-api-addr requires %s", apiTokenEnv))
+	}
+	if (apiTLSCert == "") != (apiTLSKey == "") {
+		exit(exitConfigError, fmt.Errorf("-api-tls-cert and -api-tls-key must be given together"))
+	}
+	if grpcAddr != "" && !daemonMode {
+		exit(exitConfigError, fmt.Errorf("-grpc-addr requires -daemon"))
+	}
+	if grpcAddr != "" && os.Getenv(apiTokenEnv) == "" {
+		exit(exitConfigError, fmt.Errorf("-grpc-addr requires %s", apiTokenEnv))
+	}
+	if (grpcTLSCert == "") != (grpcTLSKey == "") {
+		exit(exitConfigError, fmt.Errorf("-grpc-tls-cert and -grpc-tls-key must be given together"))
+	}
+	if grpcAddr != "" && grpcTLSCert == "" && !isLoopbackAddr(grpcAddr) {
+		exit(exitConfigError, fmt.Errorf("-grpc-addr %s isn't a loopback address, it requires -grpc-tls-cert and -grpc-tls-key", grpcAddr))
+	}
+	if daemonMode && interval <= 0 {
+		exit(exitConfigError, fmt.Errorf("-interval must be positive"))
+	}
+	if maxUpdates >= 0 && !update && !restart {
+		exit(exitConfigError, fmt.Errorf("-max-updates requires -update or -restart"))
+	}
+	if rollbackOnFailure && restart {
+		exit(exitConfigError, fmt.Errorf("-rollback-on-failure can't be used with -restart"))
+	}
+	if rollbackOnFailure && !update {
+		exit(exitConfigError, fmt.Errorf("-rollback-on-failure requires -update"))
+	}
+	if rollbackOnFailure {
+		waitRollouts = true
+	}
+	if waitRollouts && !update && !restart {
+		exit(exitConfigError, fmt.Errorf("-wait requires -update or -restart"))
 	}
-	var policy string
 	if restart {
 		policy = "restart"
 		checkpods = true
 	} else if update {
 		policy = "update"
 	}
-	for _, ns := range namespace {
-		ctx := context.Background()
-		c, err := NewConfig(kubeconfig, ns, allnamespaces, &xnamespace, policy, checkpods, ctx)
-		if err != nil {
-			log.Fatal(err)
+	configs, err := selection.configs(policy, checkpods, report)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	reg, err := registry.setup(configs)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	if err := policies.setup(configs); err != nil {
+		exit(exitConfigError, err)
+	}
+	closeEvents, err := events.setup(configs)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	if patchDir != "" {
+		if err := os.MkdirAll(patchDir, 0755); err != nil {
+			exit(exitConfigError, err)
+		}
+		for _, c := range configs {
+			c.patchDir = patchDir
+		}
+	}
+	if diff {
+		for _, c := range configs {
+			c.diff = os.Stdout
+		}
+	}
+	// on SIGTERM, the workload being checked or updated is completed,
+	// remaining workloads are skipped and the report is written
+	ctx, stop := signalContext()
+	defer stop()
+	var health *healthServer
+	if healthAddr != "" || apiAddr != "" {
+		var staleAfter time.Duration
+		if daemonMode {
+			staleAfter = 3 * interval
+		}
+		health = newHealthServer(staleAfter)
+		go func() {
+			<-ctx.Done()
+			health.stop()
+		}()
+	}
+	if healthAddr != "" {
+		if err := health.listen(healthAddr); err != nil {
+			exit(exitConfigError, err)
+		}
+	}
+	if apiAddr != "" {
+		if err := listenAPI(apiAddr, os.Getenv(apiTokenEnv), apiTLSCert, apiTLSKey, health); err != nil {
+			exit(exitConfigError, err)
+		}
+	}
+	newRun := func(ctx context.Context) *runState {
+		run := newRunState(dependencyTimeout, groupUpdates)
+		if namespacesPerWave > 0 {
+			run.wave = &updateWave{size: namespacesPerWave, timeout: waveTimeout, namespaces: make(map[string]bool)}
+		}
+		if waitRollouts {
+			run.rollout = &rolloutWatch{timeout: waitTimeout, maxUnhealthy: maxUnhealthy, rollback: rollbackOnFailure}
+		}
+		run.stop = ctx.Done()
+		return run
+	}
+	// in -daemon mode, namespaces are checked at most every imago/interval
+	schedule := newNamespaceSchedule()
+	updateAll := func(ctx context.Context, report *Report) {
+		remainingUpdates := maxUpdates
+		for _, c := range configs {
+			c.report = report
+			if maxUpdates >= 0 {
+				c.maxUpdates = &remainingUpdates
+			}
+		}
+		state := newRun(ctx)
+		if daemonMode {
+			schedule.start(time.Now())
+			state.schedule = schedule
+		}
+		// errors are recorded in the report
+		_ = Update(configs, report, state, selection.fieldSelector, selection.labelSelector)
+		if events.slack != nil {
+			if err := events.slack.notify(configs[0], report); err != nil {
+				log.Printf("unable to notify Slack: %s", err)
+			}
+		}
+		if events.mail != nil {
+			if err := events.mail.notify(report); err != nil {
+				log.Printf("unable to send email digest: %s", err)
+			}
+		}
+		if registry.manifestCache != "" {
+			if err := configs[0].saveManifestCache(reg, registry.manifestCache); err != nil {
+				log.Printf("unable to write manifest cache: %s", err)
+			}
 		}
-		if err := c.Update(fieldSelector, labelSelector); err != nil {
-			log.Fatal(err)
+		for _, line := range reg.Summary() {
+			log.Print(line)
+		}
+		if health != nil {
+			health.runDone(report)
+		}
+	}
+	if !daemonMode {
+		updateAll(ctx, report)
+		closeEvents()
+		finish(report)
+	}
+	// runs triggered through the gRPC API wait for the run in progress
+	var runMu sync.Mutex
+	var api *grpcServer
+	if grpcAddr != "" {
+		api = newGRPCServer(os.Getenv(apiTokenEnv), policy != "", func(req *imagopb.TriggerRequest, update bool, triggered *Report) {
+			runMu.Lock()
+			defer runMu.Unlock()
+			api.running(triggered)
+			remainingUpdates := maxUpdates
+			runConfigs := make([]*Config, 0)
+			for _, c := range configs {
+				namespaces := req.GetNamespaces()
+				if len(namespaces) == 0 {
+					namespaces = []string{c.namespace}
+				}
+				for _, namespace := range namespaces {
+					// only namespaces selected on the command line
+					if c.namespace != "" && namespace != c.namespace || c.xnamespace.Contains(namespace) {
+						continue
+					}
+					rc := *c
+					rc.namespace, rc.report, rc.maxUpdates = namespace, triggered, nil
+					if maxUpdates >= 0 {
+						rc.maxUpdates = &remainingUpdates
+					}
+					if !update {
+						rc.policy = ""
+					}
+					runConfigs = append(runConfigs, &rc)
+				}
+			}
+			if len(runConfigs) == 0 {
+				triggered.AddError(configErrorClass, fmt.Errorf("namespaces %s aren't selected", strings.Join(req.GetNamespaces(), ", ")))
+				return
+			}
+			_ = Update(runConfigs, triggered, newRun(ctx), req.GetFieldSelector(), req.GetLabelSelector())
+			log.Printf("triggered run %s done (exit code %d)", triggered.run, triggered.ExitCode())
+		})
+		for _, c := range configs {
+			c.eventSinks = append(c.eventSinks[:len(c.eventSinks):len(c.eventSinks)], api)
+		}
+		if err := api.listen(grpcAddr, grpcTLSCert, grpcTLSKey); err != nil {
+			exit(exitConfigError, err)
+		}
+	}
+	// in -daemon mode, imago restarts itself once the defaults ConfigMap
+	// changed, after the run in progress and releasing the lease
+	daemonCtx, reload := context.WithCancel(ctx)
+	defer reload()
+	reloading := false
+	run := func(ctx context.Context) {
+		daemon(ctx, interval, func() {
+			runMu.Lock()
+			defer runMu.Unlock()
+			updateAll(ctx, report)
+			writeReport(report)
+			log.Printf("run %s done (exit code %d)", report.run, report.ExitCode())
+			// next runs start with fresh digests and credentials, keeping
+			// clients, tokens and last known manifests
+			report = report.nextRun()
+			reg.reset()
+			for _, c := range configs {
+				c.resetCaches()
+			}
+			if err := registry.loadCredentials(configs); err != nil {
+				log.Printf("unable to reload registry credentials: %s", err)
+				report.AddError(configErrorClass, err)
+			}
+			if defaults != "" {
+				data, err := getDefaults(configs[0], defaults)
+				if err != nil {
+					log.Printf("unable to reload defaults: %s", err)
+					report.AddError(configErrorClass, err)
+				} else if defaultsChanged(loadedDefaults, data) {
+					log.Printf("defaults ConfigMap %s changed, restarting", defaults)
+					reloading = true
+					reload()
+				}
+			}
+		})
+	}
+	if leaderElection == "" {
+		run(daemonCtx)
+	} else {
+		leading := func(leading bool) {
+			if health != nil {
+				health.setLeading(leading)
+			}
+			if api != nil {
+				api.setStandby(!leading)
+			}
+		}
+		leading(false)
+		if err := configs[0].leaderElect(daemonCtx, lease, leaderIdentity(), leading, run); err != nil {
+			exit(exitConfigError, err)
+		}
+	}
+	closeEvents()
+	if reloading && ctx.Err() == nil {
+		if err := reexec(); err != nil {
+			exit(exitConfigError, err)
 		}
 	}
 }
@@ -0,0 +1,70 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagoMinAgeAnnotation override -min-age for a workload, "0" disable the
+// cooldown
+const imagoMinAgeAnnotation = "imago/min-age"
+
+// workloadMinAge return the minimum age of images given workload is updated
+// to
+func (c *Config) workloadMinAge(meta *metav1.ObjectMeta) (time.Duration, error) {
+	value, ok := meta.GetAnnotations()[imagoMinAgeAnnotation]
+	if !ok {
+		return c.minAge, nil
+	}
+	minAge, err := parseAge(value)
+	if err != nil || minAge < 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q, expected a duration like 30m or 7d", imagoMinAgeAnnotation, value)
+	}
+	return minAge, nil
+}
+
+// imageCreated return the creation date of the image of given digest
+func (c *Config) imageCreated(image string, digest string, auth *DockerRegistryCredentials) (time.Time, error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return time.Time{}, err
+	}
+	config, err := c.reg.GetImageConfig(c.context, reference.TrimNamed(ref), digest, auth)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to get image creation date: %s", err)
+	}
+	if config.Created == nil {
+		return time.Time{}, fmt.Errorf("image has no creation date")
+	}
+	return *config.Created, nil
+}
+
+// checkMinAge return an error if the image of given digest was created less
+// than minAge ago
+func (c *Config) checkMinAge(image string, digest string, auth *DockerRegistryCredentials, minAge time.Duration) error {
+	created, err := c.imageCreated(image, digest, auth)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(created); age < minAge {
+		return fmt.Errorf("image created %s ago, less than minimum age %s", age.Truncate(time.Second), minAge)
+	}
+	return nil
+}
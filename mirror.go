@@ -0,0 +1,57 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// mirrorImage return the reference given image is looked up with when its
+// registry (or repository prefix) has a mirror
+func (c *Config) mirrorImage(image string) (string, bool) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", false
+	}
+	normalized := ref.String()
+	for source, target := range c.registryMirrors {
+		if strings.HasPrefix(normalized, source+"/") {
+			mirrored, err := reference.ParseNormalizedNamed(target + strings.TrimPrefix(normalized, source))
+			if err != nil {
+				return "", false
+			}
+			return mirrored.String(), true
+		}
+	}
+	return "", false
+}
+
+// resolveDigest return the digest of given image, looked up on its mirror
+// with credentials of the mirror if it has one. Images written in workloads
+// keep their registry.
+func (c *Config) resolveDigest(ctx context.Context, image string, auth *DockerRegistryCredentials, pullSecrets *dockerConfig) (string, error) {
+	mirrored, ok := c.mirrorImage(image)
+	if !ok {
+		return c.resolver.GetDigest(ctx, image, auth)
+	}
+	auth, err := c.registryCredentials(mirrored, pullSecrets)
+	if err != nil {
+		return "", err
+	}
+	return c.resolver.GetDigest(ctx, mirrored, auth)
+}
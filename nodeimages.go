@@ -0,0 +1,96 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/image/v5/docker/reference"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// getNodeImages return digests of images present in nodes local store, as
+// reported by kubelet in node status, indexed by normalized tagged reference
+func (c *Config) getNodeImages() (map[string]map[string]bool, error) {
+	if c.nodeImages != nil {
+		return c.nodeImages, nil
+	}
+	nodeImages := make(map[string]map[string]bool)
+	err := listPaged(metav1.ListOptions{}, c.pageSize, func(opts metav1.ListOptions) (string, error) {
+		nodes, err := c.cluster.CoreV1().Nodes().List(c.context, opts)
+		if err != nil {
+			return "", err
+		}
+		for _, node := range nodes.Items {
+			for _, image := range node.Status.Images {
+				tags, digests := make([]reference.NamedTagged, 0), make([]reference.Canonical, 0)
+				for _, name := range image.Names {
+					ref, err := reference.ParseNormalizedNamed(name)
+					if err != nil {
+						continue
+					}
+					switch r := ref.(type) {
+					case reference.Canonical:
+						digests = append(digests, r)
+					case reference.NamedTagged:
+						tags = append(tags, r)
+					}
+				}
+				for _, tag := range tags {
+					for _, digest := range digests {
+						if tag.Name() != digest.Name() {
+							continue
+						}
+						if nodeImages[tag.String()] == nil {
+							nodeImages[tag.String()] = make(map[string]bool)
+						}
+						nodeImages[tag.String()][string(digest.Digest())] = true
+					}
+				}
+			}
+		}
+		return nodes.Continue, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.nodeImages = nodeImages
+	return nodeImages, nil
+}
+
+// GetNodeDigest return the digest given image resolve to in nodes local
+// store, this is used as a fallback when the registry isn't reachable
+func (c *Config) GetNodeDigest(image string) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	ref = reference.TagNameOnly(ref)
+	nodeImages, err := c.getNodeImages()
+	if err != nil {
+		return "", err
+	}
+	digests := nodeImages[ref.String()]
+	if len(digests) == 0 {
+		return "", fmt.Errorf("%s not found on any node", ref.String())
+	}
+	if len(digests) > 1 {
+		return "", fmt.Errorf("%s resolve to %d different digests on nodes", ref.String(), len(digests))
+	}
+	for digest := range digests {
+		return digest, nil
+	}
+	return "", nil
+}
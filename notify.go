@@ -0,0 +1,61 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notifySecretEnv is the environment variable holding the key signing
+// payloads sent to -notify-url
+const notifySecretEnv = "IMAGO_NOTIFY_SECRET"
+
+// notifySignatureHeader hold the hex encoded HMAC-SHA256 of the payload,
+// prefixed by sha256= like GitHub webhooks
+const notifySignatureHeader = "X-Imago-Signature"
+
+// notify POST the structured output of the run to given URL, signed with
+// secret if not empty
+func (r *Report) notify(ctx context.Context, destination string, secret string) error {
+	data, err := json.Marshal(r.runOutput())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, destination, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imago")
+	req.Header.Set("X-Imago-Run", r.run)
+	if secret != "" {
+		req.Header.Set(notifySignatureHeader, "sha256="+hex.EncodeToString(hmacSHA256([]byte(secret), string(data))))
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	closeResource(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response from %s: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
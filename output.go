@@ -0,0 +1,150 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Actions taken on containers, in the run output
+const (
+	actionUpToDate  = "up to date"
+	actionFixed     = "fixed digest"
+	actionAvailable = "update available"
+	actionUpdated   = "updated"
+	actionFailed    = "failed"
+	actionError     = "error"
+)
+
+// containerFailure is an error checking a container, or a whole workload
+// when container is empty
+type containerFailure struct {
+	resource  string
+	container string
+	err       string
+}
+
+// AddContainerError record an error of given class checking given container
+// of a workload, or the whole workload when container is empty
+func (r *Report) AddContainerError(class string, resource string, container string, err error) {
+	r.AddError(class, err)
+	r.failures = append(r.failures, containerFailure{resource, container, err.Error()})
+}
+
+// containerResult is the outcome of a container in the run output, or of a
+// whole workload when Container is empty
+type containerResult struct {
+	Workload  string `json:"workload"`
+	Container string `json:"container,omitempty"`
+	// Image is the image in spec and Digest the digest it resolve to in
+	// the registry
+	Image    string `json:"image,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Action   string `json:"action"`
+	NewImage string `json:"newImage,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// runOutput is the structured output of a run written with -output
+type runOutput struct {
+	Run      string            `json:"run"`
+	Cluster  string            `json:"cluster"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	ExitCode int               `json:"exitCode"`
+	Results  []containerResult `json:"results"`
+	Errors   []reportError     `json:"errors"`
+}
+
+// results return the outcome of each container checked in the run, in the
+// order they were checked
+func (r *Report) results() []containerResult {
+	index := make(map[string]int)
+	results := make([]containerResult, 0)
+	result := func(resource string, container string) *containerResult {
+		key := resource + " " + container
+		i, ok := index[key]
+		if !ok {
+			i = len(results)
+			index[key] = i
+			results = append(results, containerResult{Workload: resource, Container: container})
+		}
+		return &results[i]
+	}
+	for _, t := range r.fixed {
+		res := result(t.resource, t.container)
+		res.Image, res.Action = t.image, actionFixed
+	}
+	for _, t := range r.tracked {
+		res := result(t.resource, t.container)
+		res.Image, res.Digest, res.Action = t.image, t.latestDigest, actionUpToDate
+	}
+	for _, f := range r.failures {
+		res := result(f.resource, f.container)
+		res.Action, res.Error = actionError, f.err
+	}
+	for _, o := range r.outdated {
+		res := result(o.resource, o.container)
+		res.Action, res.NewImage, res.Reason = actionAvailable, o.image, o.details()
+	}
+	for _, e := range r.events {
+		res := result(fmt.Sprintf("%s/%s/%s", e.Namespace, e.Kind, e.Name), e.Container)
+		switch e.Type {
+		case eventApplied:
+			res.Action, res.NewImage, res.Reason = actionUpdated, e.Image, e.Reason
+		case eventFailed:
+			res.Action, res.NewImage, res.Error = actionFailed, e.Image, e.Error
+		}
+	}
+	return results
+}
+
+// runOutput return the structured output of the run
+func (r *Report) runOutput() *runOutput {
+	report := r.runReport()
+	return &runOutput{
+		Run:      report.Run,
+		Cluster:  report.Cluster,
+		Started:  report.Started,
+		Finished: report.Finished,
+		ExitCode: report.ExitCode,
+		Results:  r.results(),
+		Errors:   report.Errors,
+	}
+}
+
+// writeOutput write the structured output of the run in given format, json
+// or yaml
+func (r *Report) writeOutput(out io.Writer, format string) error {
+	data, err := json.MarshalIndent(r.runOutput(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if format == "yaml" {
+		if data, err = yaml.JSONToYAML(data); err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
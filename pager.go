@@ -0,0 +1,130 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxReplicaSetOwners bound the number of ReplicaSet owners kept while
+// matching pods to workloads
+const maxReplicaSetOwners = 10000
+
+// listPaged call list with opts for each page of at most pageSize items (all
+// items at once when 0), until the collection is exhausted. list process
+// items of the page and return its continue token, so that a single page
+// is held in memory at a time.
+func listPaged(opts metav1.ListOptions, pageSize int64, list func(metav1.ListOptions) (string, error)) error {
+	opts.Limit = pageSize
+	for {
+		var next string
+		err := retryTransient(func() (err error) {
+			next, err = list(opts)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		opts.Continue = next
+	}
+}
+
+// imagoAnnotations return annotations of imago in given annotations, other
+// annotations (e.g. kubectl last-applied-configuration) can be large
+func imagoAnnotations(annotations map[string]string) map[string]string {
+	var kept map[string]string
+	for key, value := range annotations {
+		if strings.HasPrefix(key, "imago") {
+			if kept == nil {
+				kept = make(map[string]string)
+			}
+			kept[key] = value
+		}
+	}
+	return kept
+}
+
+// newWorkload return a workload keeping only what imago needs of given
+// object: names, labels, imago annotations, images and image pull secrets.
+// Updates are applied to the object fetched again from the API.
+func newWorkload(kind string, meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) workload {
+	containers := func(containers []v1.Container) []v1.Container {
+		if len(containers) == 0 {
+			return nil
+		}
+		kept := make([]v1.Container, len(containers))
+		for i, container := range containers {
+			kept[i] = v1.Container{Name: container.Name, Image: container.Image}
+		}
+		return kept
+	}
+	return workload{
+		kind: kind,
+		meta: &metav1.ObjectMeta{
+			Name:        meta.Name,
+			Namespace:   meta.Namespace,
+			UID:         meta.UID,
+			Labels:      meta.Labels,
+			Annotations: imagoAnnotations(meta.Annotations),
+		},
+		template: &v1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      template.Labels,
+				Annotations: imagoAnnotations(template.Annotations),
+			},
+			Spec: v1.PodSpec{
+				InitContainers:     containers(template.Spec.InitContainers),
+				Containers:         containers(template.Spec.Containers),
+				ServiceAccountName: template.Spec.ServiceAccountName,
+				ImagePullSecrets:   template.Spec.ImagePullSecrets,
+			},
+		},
+	}
+}
+
+// getReplicaSetOwners return owners of given ReplicaSet as kind/name, the
+// cache is reset when it reach maxReplicaSetOwners
+func (c *Config) getReplicaSetOwners(ctx context.Context, namespace string, name string) ([]string, error) {
+	key := fmt.Sprintf("%s/%s", namespace, name)
+	if owners, ok := c.replicaSetOwners[key]; ok {
+		return owners, nil
+	}
+	var rs *appsv1.ReplicaSet
+	err := retryTransient(func() (err error) {
+		rs, err = c.cluster.AppsV1().ReplicaSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	owners := make([]string, 0, len(rs.OwnerReferences))
+	for _, owner := range rs.OwnerReferences {
+		owners = append(owners, owner.Kind+"/"+owner.Name)
+	}
+	if c.replicaSetOwners == nil || len(c.replicaSetOwners) >= maxReplicaSetOwners {
+		c.replicaSetOwners = make(map[string][]string)
+	}
+	c.replicaSetOwners[key] = owners
+	return owners, nil
+}
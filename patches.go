@@ -0,0 +1,75 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// patchContainers return strategic merge patch entries of containers having
+// an update
+func patchContainers(update map[string]containerUpdate) []map[string]string {
+	names := make([]string, 0, len(update))
+	for name := range update {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	containers := make([]map[string]string, 0, len(update))
+	for _, name := range names {
+		containers = append(containers, map[string]string{"name": name, "image": update[name].image})
+	}
+	return containers
+}
+
+// writePatch write a strategic merge patch applying updates of given
+// workload in patchDir, it can be applied later with kubectl patch
+func (c *Config) writePatch(kind string, namespace string, name string, config *configAnnotation, updateInitContainers map[string]containerUpdate, updateContainers map[string]containerUpdate) error {
+	config.Version = configAnnotationVersion
+	config.ConfigMap = ""
+	jsonConfig, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	podSpec := make(map[string]interface{})
+	if len(updateContainers) > 0 {
+		podSpec["containers"] = patchContainers(updateContainers)
+	}
+	if len(updateInitContainers) > 0 {
+		podSpec["initContainers"] = patchContainers(updateInitContainers)
+	}
+	spec := map[string]interface{}{"template": map[string]interface{}{"spec": podSpec}}
+	if kind == "CronJob" {
+		spec = map[string]interface{}{"jobTemplate": map[string]interface{}{"spec": spec}}
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{imagoConfigAnnotation: string(jsonConfig)},
+		},
+		"spec": spec,
+	}
+	data, err := json.MarshalIndent(patch, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(c.patchDir, fmt.Sprintf("%s.%s.%s.json", namespace, strings.ToLower(kind), name))
+	log.Printf("    writing %s (kubectl patch -n %s %s %s --patch-file %s)", filename, namespace, strings.ToLower(kind), name, filename)
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Formats of pinned image references
+const (
+	// pinTagDigest keep the tag the digest was resolved from, e.g.
+	// nginx:1.25@sha256:...
+	pinTagDigest = "tag@digest"
+	// pinDigest only keep the digest, e.g. nginx@sha256:..., for container
+	// runtimes rejecting the combined form
+	pinDigest = "digest"
+)
+
+// parsePinFormat check given pinned references format
+func parsePinFormat(format string) (string, error) {
+	switch format {
+	case pinTagDigest, pinDigest:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid pin format %s, expected %s or %s", format, pinTagDigest, pinDigest)
+}
+
+// splitTag split given image reference, without its digest, in name and
+// tag (empty if there is none). The name may contain a registry port.
+func splitTag(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, ""
+}
+
+// withoutPinnedTag drop the tag of given reference if it's pinned to a
+// digest, the digest alone identify the image
+func withoutPinnedTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		name, _ := splitTag(image)
+		return name + image[i:]
+	}
+	return image
+}
+
+// pinImage return the reference pinning the image source to digest, the
+// digest being resolved from the tag of lookup (the source itself, or the
+// tag of its channel)
+func (c *Config) pinImage(source string, lookup string, digest string) string {
+	name, _ := splitTag(source)
+	if _, tag := splitTag(lookup); tag != "" && c.pinFormat != pinDigest {
+		return name + ":" + tag + "@" + digest
+	}
+	return name + "@" + digest
+}
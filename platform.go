@@ -0,0 +1,82 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// platformAuto resolve manifest lists to the platform of cluster nodes
+const platformAuto = "auto"
+
+// SetPlatform resolve manifest lists (and OCI image indexes) to the image of
+// given os/arch[/variant] platform instead of the platform imago runs on
+func (r *RegistryClient) SetPlatform(platform string) error {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid platform %q, expected os/arch[/variant] (e.g. linux/arm64)", platform)
+	}
+	r.platform = &types.SystemContext{OSChoice: parts[0], ArchitectureChoice: parts[1]}
+	if len(parts) == 3 {
+		r.platform.VariantChoice = parts[2]
+	}
+	return nil
+}
+
+// platformName return the os/arch[/variant] manifest lists are resolved to
+func (r *RegistryClient) platformName() string {
+	if r.platform == nil {
+		return runtime.GOOS + "/" + runtime.GOARCH
+	}
+	name := r.platform.OSChoice + "/" + r.platform.ArchitectureChoice
+	if r.platform.VariantChoice != "" {
+		name += "/" + r.platform.VariantChoice
+	}
+	return name
+}
+
+// nodePlatform return the os/arch platform of cluster nodes, nodes of
+// mixed platforms can't be resolved to a single image
+func (c *Config) nodePlatform() (string, error) {
+	platforms := make(map[string]bool)
+	err := listPaged(metav1.ListOptions{}, c.pageSize, func(opts metav1.ListOptions) (string, error) {
+		nodes, err := c.cluster.CoreV1().Nodes().List(c.context, opts)
+		if err != nil {
+			return "", err
+		}
+		for _, node := range nodes.Items {
+			platforms[node.Status.NodeInfo.OperatingSystem+"/"+node.Status.NodeInfo.Architecture] = true
+		}
+		return nodes.Continue, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to detect the platform of nodes: %w", err)
+	}
+	names := make([]string, 0, len(platforms))
+	for name := range platforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) != 1 {
+		return "", fmt.Errorf("unable to detect the platform of nodes, found %d platforms (%s), use -platform os/arch", len(names), strings.Join(names, ", "))
+	}
+	return names[0], nil
+}
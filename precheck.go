@@ -0,0 +1,172 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// registryError is a registry precheck failure with an actionable message
+type registryError struct {
+	host    string
+	problem string
+	hint    string
+	err     error
+}
+
+func (e *registryError) Error() string {
+	return fmt.Sprintf("registry %s: %s: %s (%s)", e.host, e.problem, e.err, e.hint)
+}
+
+// classifyRegistryError turn a connection error to a registry into an
+// actionable message
+func classifyRegistryError(host string, err error) *registryError {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return &registryError{host, "DNS resolution failed", "check the registry name and the cluster DNS", err}
+	case errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &certInvalid), strings.Contains(err.Error(), "tls:"):
+		return &registryError{host, "TLS error", "check the registry certificate, trust its CA with -registry-ca", err}
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		return &registryError{host, "proxy error", "check HTTPS_PROXY and NO_PROXY environment variables", err}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &opErr) && opErr.Timeout():
+		return &registryError{host, "connection timed out", "check network policies and egress firewall rules", err}
+	case errors.As(err, &opErr):
+		return &registryError{host, "connection failed", "check the registry is running and reachable from imago", err}
+	}
+	return &registryError{host, "request failed", "check the registry is reachable from imago", err}
+}
+
+// Ping check the registry API of given host is reachable and that
+// credentials are accepted. The result is kept for the remainder of the
+// run, digest lookups on unreachable registries fail immediately.
+func (r *RegistryClient) Ping(ctx context.Context, host string, auth *DockerRegistryCredentials) error {
+	r.mu.Lock()
+	err, ok := r.pings[host]
+	r.mu.Unlock()
+	if ok {
+		return err
+	}
+	err = r.ping(ctx, host, auth)
+	r.mu.Lock()
+	r.pings[host] = err
+	r.mu.Unlock()
+	return err
+}
+
+func (r *RegistryClient) ping(ctx context.Context, host string, auth *DockerRegistryCredentials) error {
+	u := r.registryEndpoint(host) + "/v2/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "imago")
+	resp, err := r.send(req)
+	if err != nil {
+		return classifyRegistryError(host, err)
+	}
+	closeResource(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		if auth == nil {
+			return nil
+		}
+	default:
+		return &registryError{host, "unexpected response", "check this is a docker registry and that no proxy intercept requests", errors.New(resp.Status)}
+	}
+	// check credentials like docker login does
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	status := http.StatusOK
+	switch scheme {
+	case "bearer":
+		_, _, err = r.getToken(ctx, params, "", auth)
+		var tokenErr *tokenError
+		if errors.As(err, &tokenErr) {
+			status = tokenErr.status
+		} else if err != nil {
+			return classifyRegistryError(host, err)
+		}
+	case "basic":
+		retry := req.Clone(ctx)
+		retry.SetBasicAuth(auth.Username, auth.Password)
+		resp, err = r.send(retry)
+		if err != nil {
+			return classifyRegistryError(host, err)
+		}
+		closeResource(resp.Body)
+		status = resp.StatusCode
+	}
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		// public images might still be available anonymously
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.warnings = append(r.warnings, fmt.Sprintf("registry %s: authentication failed: %d %s (check credentials configured for %s, only public images can be resolved)", host, status, http.StatusText(status), host))
+	}
+	return nil
+}
+
+// precheckRegistries ping each distinct registry used by given workloads
+// before resolving digests
+func (c *Config) precheckRegistries(workloads []workload) {
+	if c.reg == nil {
+		return
+	}
+	hosts := make(map[string]bool)
+	addHosts := func(containers []v1.Container) {
+		for _, container := range containers {
+			if host, err := imageRegistryHost(container.Image); err == nil {
+				hosts[host] = true
+			}
+		}
+	}
+	for _, w := range workloads {
+		addHosts(w.template.Spec.InitContainers)
+		addHosts(w.template.Spec.Containers)
+	}
+	for host := range hosts {
+		auth, err := c.hostCredentials(host, nil)
+		if err != nil {
+			log.Print(err)
+		}
+		if err := c.reg.Ping(c.context, host, auth); err != nil {
+			log.Print(err)
+			c.report.AddError(registryErrorClass, err)
+		}
+	}
+}
+
+// Summary describe registry problems encountered during the run which
+// didn't prevent resolving digests, and tags which moved since the last run
+func (r *RegistryClient) Summary() []string {
+	r.mu.Lock()
+	warnings := append([]string{}, r.warnings...)
+	r.mu.Unlock()
+	return append(append(warnings, r.ThrottlingSummary()...), r.MovedTags()...)
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+// maxRequestsPerRegistry bound concurrent requests sent to a registry host
+const maxRequestsPerRegistry = 4
+
+// digestLookup is a digest to resolve ahead of checking workloads
+type digestLookup struct {
+	c     *Config
+	image string
+	auth  *DockerRegistryCredentials
+	// pullSecrets are credentials of the workload, for its mirror
+	pullSecrets *dockerConfig
+}
+
+// prefetchLookups return distinct lookups of source images of given
+// workloads. Containers following a channel or having a fixed digest are
+// left to the check of their workload.
+func prefetchLookups(workloads []prioritizedWorkload) []digestLookup {
+	lookups := make([]digestLookup, 0)
+	seen := make(map[string]bool)
+	for _, pw := range workloads {
+		c := pw.config
+		if c.reg == nil || c.xnamespace.Contains(pw.meta.Namespace) {
+			continue
+		}
+		config, err := c.loadConfigAnnotation(pw.meta)
+		if err != nil {
+			continue
+		}
+		channels, err := c.workloadChannels(pw.meta)
+		if err != nil || channels[""] != nil {
+			continue
+		}
+		if config == nil {
+			config = &configAnnotation{}
+		}
+		sources := append(mergeContainers(config.InitContainers, pw.template.Spec.InitContainers), mergeContainers(config.Containers, pw.template.Spec.Containers)...)
+		pullSecrets := c.loadPullSecrets(pw.meta.Namespace, &pw.template.Spec)
+		for _, source := range sources {
+			if strings.Contains(source.Image, "@") || channels[source.Name] != nil {
+				continue
+			}
+			auth, err := c.registryCredentials(source.Image, pullSecrets)
+			if err != nil {
+				continue
+			}
+			key := digestCacheKey(source.Image, auth)
+			if !seen[key] {
+				seen[key] = true
+				lookups = append(lookups, digestLookup{c, source.Image, auth, pullSecrets})
+			}
+		}
+	}
+	return lookups
+}
+
+// prefetchDigests resolve digests of source images of given workloads with
+// given number of concurrent lookups, workloads are then checked one by one
+// with digests from the registry client cache. Errors are left to the
+// check of workloads.
+func prefetchDigests(workloads []prioritizedWorkload, concurrency int) {
+	if concurrency <= 1 {
+		return
+	}
+	lookups := prefetchLookups(workloads)
+	if len(lookups) < 2 {
+		return
+	}
+	log.Printf("resolving %d images with %d concurrent lookups", len(lookups), concurrency)
+	jobs := make(chan digestLookup)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range jobs {
+				_, _ = l.c.resolveDigest(l.c.context, l.image, l.auth, l.pullSecrets)
+			}
+		}()
+	}
+	for _, l := range lookups {
+		jobs <- l
+	}
+	close(jobs)
+	wg.Wait()
+}
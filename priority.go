@@ -0,0 +1,82 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagoPriorityAnnotation order updates of workloads, higher priorities are
+// applied first. On a namespace, it is the priority of its workloads
+// without annotation, which have priority 0 otherwise.
+const imagoPriorityAnnotation = "imago/priority"
+
+// prioritizedWorkload is a workload to check with its config and priority
+type prioritizedWorkload struct {
+	config *Config
+	workload
+	priority int
+}
+
+// parsePriority parse the imagoPriorityAnnotation of given annotations, ok
+// is false when it is missing
+func parsePriority(annotations map[string]string) (priority int, ok bool, err error) {
+	value, ok := annotations[imagoPriorityAnnotation]
+	if !ok {
+		return 0, false, nil
+	}
+	priority, err = strconv.Atoi(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s annotation %q, expected an integer", imagoPriorityAnnotation, value)
+	}
+	return priority, true, nil
+}
+
+// workloadPriority return the update priority of given workload: its
+// annotation, the priority of the ImagoPolicy selecting it, or the
+// annotation of its namespace, 0 when invalid
+func (c *Config) workloadPriority(meta *metav1.ObjectMeta) (int, error) {
+	if priority, ok, err := parsePriority(meta.Annotations); ok || err != nil {
+		return priority, err
+	}
+	if c.defaultPriority != nil {
+		return *c.defaultPriority, nil
+	}
+	ns := c.getNamespace(meta.Namespace)
+	if ns == nil {
+		return 0, nil
+	}
+	priority, _, err := parsePriority(ns.Annotations)
+	if err != nil {
+		return 0, fmt.Errorf("namespace %s: %w", meta.Namespace, err)
+	}
+	return priority, nil
+}
+
+// sortByPriority sort workloads by decreasing priority, then by namespace
+// so that namespaces are updated one after the other, keeping the listing
+// order otherwise
+func sortByPriority(workloads []prioritizedWorkload) {
+	sort.SliceStable(workloads, func(i, j int) bool {
+		if workloads[i].priority != workloads[j].priority {
+			return workloads[i].priority > workloads[j].priority
+		}
+		return workloads[i].meta.Namespace < workloads[j].meta.Namespace
+	})
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func (c *Config) getServiceAccount(namespace string, name string) (*v1.ServiceAccount, error) {
+	key := fmt.Sprintf("%s/%s", namespace, name)
+	if c.serviceAccountCache == nil {
+		c.serviceAccountCache = make(map[string]*v1.ServiceAccount)
+	}
+	if c.serviceAccountCache[key] == nil {
+		var sa *v1.ServiceAccount
+		err := retryTransient(func() (err error) {
+			sa, err = c.cluster.CoreV1().ServiceAccounts(namespace).Get(c.context, name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.serviceAccountCache[key] = sa
+	}
+	return c.serviceAccountCache[key], nil
+}
+
+// loadPullSecrets return registry credentials of image pull secrets of
+// given pod spec and of its service account, or nil if there is none.
+// Like kubelet, secrets which can't be read are skipped.
+func (c *Config) loadPullSecrets(namespace string, spec *v1.PodSpec) *dockerConfig {
+	return readPullSecrets(namespace, spec, c.getServiceAccount, c.getSecret)
+}
+
+// readPullSecrets return registry credentials of image pull secrets of
+// given pod spec and of its service account, read with given functions
+func readPullSecrets(namespace string, spec *v1.PodSpec, getServiceAccount func(namespace string, name string) (*v1.ServiceAccount, error), getSecret func(namespace string, name string) (*v1.Secret, error)) *dockerConfig {
+	refs := make([]v1.LocalObjectReference, 0)
+	refs = append(refs, spec.ImagePullSecrets...)
+	serviceAccount := spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	sa, err := getServiceAccount(namespace, serviceAccount)
+	switch {
+	case err == nil:
+		refs = append(refs, sa.ImagePullSecrets...)
+	case !apierrors.IsNotFound(err):
+		log.Printf("    unable to get image pull secrets of service account %s/%s: %s", namespace, serviceAccount, err)
+	}
+	var config *dockerConfig
+	for _, ref := range refs {
+		secret, err := getSecret(namespace, ref.Name)
+		if err != nil {
+			log.Printf("    unable to get image pull secret %s/%s: %s", namespace, ref.Name, err)
+			continue
+		}
+		secretConfig, err := parseDockerConfigSecret(secret)
+		if err != nil {
+			log.Printf("    %s", err)
+			continue
+		}
+		if config == nil {
+			config = &dockerConfig{}
+		}
+		config.merge(secretConfig, fmt.Sprintf("image pull secret %s/%s", namespace, ref.Name))
+	}
+	return config
+}
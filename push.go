@@ -0,0 +1,142 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pushSink send phone push notifications of applied and failed updates to
+// a ntfy or Gotify server, pending updates would notify on every run
+type pushSink struct {
+	client *http.Client
+	// service is ntfy or gotify
+	service string
+	// url is the ntfy topic URL or the Gotify message endpoint
+	url  string
+	user *url.Userinfo
+}
+
+// isPushURL return whether given URL is a ntfy+http(s) or gotify+http(s)
+// URL
+func isPushURL(sinkURL string) bool {
+	return strings.HasPrefix(sinkURL, "ntfy+") || strings.HasPrefix(sinkURL, "gotify+")
+}
+
+// newPushSink parse ntfy+https://[token@]host/topic or
+// gotify+https://apptoken@host[/path] URLs
+func newPushSink(sinkURL string) (*pushSink, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(u.Scheme, "+", 2)
+	if len(parts) != 2 || (parts[1] != "http" && parts[1] != "https") {
+		return nil, fmt.Errorf("unsupported notification URL %s, expected ntfy+https://host/topic or gotify+https://apptoken@host", sinkURL)
+	}
+	s := &pushSink{client: &http.Client{Timeout: 10 * time.Second}, service: parts[0], user: u.User}
+	u.Scheme, u.User = parts[1], nil
+	switch s.service {
+	case "ntfy":
+		if strings.Trim(u.Path, "/") == "" {
+			return nil, fmt.Errorf("missing topic in ntfy URL %s", sinkURL)
+		}
+	case "gotify":
+		if s.user == nil {
+			return nil, fmt.Errorf("missing application token in Gotify URL %s", sinkURL)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/message"
+	default:
+		return nil, fmt.Errorf("unsupported notification service %s, expected ntfy or gotify", s.service)
+	}
+	s.url = u.String()
+	return s, nil
+}
+
+// notification return the title, message and whether the event is an
+// error
+func notification(e *updateEvent) (string, string, bool) {
+	resource := fmt.Sprintf("%s/%s/%s", e.Namespace, e.Kind, e.Name)
+	message := fmt.Sprintf("%s: %s (%s)", e.Container, e.Image, e.Reason)
+	if e.Type == eventFailed {
+		return "imago failed to update " + resource, message + "\n" + e.Error, true
+	}
+	return "imago updated " + resource, message, false
+}
+
+func (s *pushSink) send(e *updateEvent) error {
+	if e.Type != eventApplied && e.Type != eventFailed {
+		return nil
+	}
+	title, message, failed := notification(e)
+	var req *http.Request
+	var err error
+	switch s.service {
+	case "ntfy":
+		req, err = http.NewRequest(http.MethodPost, s.url, strings.NewReader(message))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Title", title)
+		if failed {
+			req.Header.Set("Priority", "high")
+			req.Header.Set("Tags", "warning")
+		} else {
+			req.Header.Set("Tags", "arrow_up")
+		}
+		if s.user != nil {
+			if password, ok := s.user.Password(); ok {
+				req.SetBasicAuth(s.user.Username(), password)
+			} else {
+				req.Header.Set("Authorization", "Bearer "+s.user.Username())
+			}
+		}
+	case "gotify":
+		priority := 5
+		if failed {
+			priority = 8
+		}
+		body, err := json.Marshal(map[string]interface{}{"title": title, "message": message, "priority": priority})
+		if err != nil {
+			return err
+		}
+		req, err = http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", s.user.Username())
+	}
+	req.Header.Set("User-Agent", "imago")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	closeResource(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response from %s: %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *pushSink) close() error {
+	return nil
+}
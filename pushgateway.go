@@ -0,0 +1,88 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pushgatewayJob is the job label of metrics pushed to the Pushgateway
+const pushgatewayJob = "imago"
+
+// metrics return metrics of the run in Prometheus text exposition format
+func (r *Report) metrics(finished time.Time) string {
+	var b strings.Builder
+	metric := func(name string, help string, kind string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("imago_run_duration_seconds", "Duration of the last run.", "gauge")
+	fmt.Fprintf(&b, "imago_run_duration_seconds %g\n", finished.Sub(r.started).Seconds())
+	metric("imago_run_last_timestamp_seconds", "Time the last run ended.", "gauge")
+	fmt.Fprintf(&b, "imago_run_last_timestamp_seconds %d\n", finished.Unix())
+	metric("imago_run_exit_code", "Exit code of the last run.", "gauge")
+	fmt.Fprintf(&b, "imago_run_exit_code %d\n", r.ExitCode())
+	updates := map[string]int{eventPending: 0, eventApplied: 0, eventFailed: 0}
+	for _, e := range r.events {
+		updates[e.Type]++
+	}
+	metric("imago_updates", "Container updates of the last run by state.", "gauge")
+	for _, state := range []string{eventPending, eventApplied, eventFailed} {
+		fmt.Fprintf(&b, "imago_updates{state=%q} %d\n", state, updates[state])
+	}
+	metric("imago_errors", "Errors of the last run by class.", "gauge")
+	for _, c := range errorClasses {
+		fmt.Fprintf(&b, "imago_errors{class=%q} %d\n", c.class, len(r.errors[c.class]))
+	}
+	metric("imago_outdated_containers", "Containers with an update available in the last run.", "gauge")
+	fmt.Fprintf(&b, "imago_outdated_containers %d\n", len(r.outdated))
+	return b.String()
+}
+
+// pushgatewayPath return the grouping key path of given label, base64
+// encoded when the value holds a slash
+func pushgatewayPath(label string, value string) string {
+	if strings.Contains(value, "/") || value == "" {
+		return fmt.Sprintf("/%s@base64/%s", label, base64.RawURLEncoding.EncodeToString([]byte(value)))
+	}
+	return fmt.Sprintf("/%s/%s", label, url.PathEscape(value))
+}
+
+// pushMetrics replace metrics of the cluster in the imago job of given
+// Pushgateway with metrics of the run
+func (r *Report) pushMetrics(ctx context.Context, gateway string) error {
+	u := strings.TrimSuffix(gateway, "/") + "/metrics" + pushgatewayPath("job", pushgatewayJob) + pushgatewayPath("cluster", r.cluster)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader([]byte(r.metrics(time.Now()))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	req.Header.Set("User-Agent", "imago")
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	closeResource(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response from %s: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
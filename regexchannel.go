@@ -0,0 +1,117 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// regexChannelPrefix introduce channels selecting tags with a regular
+// expression, like "regex:^release-\d+$", for tagging schemes which aren't
+// semver (CalVer, build numbers...)
+const regexChannelPrefix = "regex:"
+
+// maxRegexChannelTags is the number of tags matching a regex: channel whose
+// creation date is fetched, highest tags first, as it costs a manifest and
+// a config request per tag
+const maxRegexChannelTags = 20
+
+// parseRegexChannel return a channel tracking the most recently created
+// image of tags matching given regular expression
+func parseRegexChannel(name string, expr string) (*channel, error) {
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel %s: %w", name, err)
+	}
+	return &channel{name: name, rule: regexChannelPrefix + expr, pattern: pattern}, nil
+}
+
+// newestFirst order given tags of ref by creation date of their image, most
+// recent first. Only the first maxRegexChannelTags tags are considered, tags
+// whose creation date is unknown are skipped.
+func (c *Config) newestFirst(ref reference.Named, tags []string, auth *DockerRegistryCredentials) []string {
+	if len(tags) > maxRegexChannelTags {
+		log.Printf("    %d tags of %s match the channel, only considering the %d highest ones", len(tags), reference.FamiliarString(ref), maxRegexChannelTags)
+		tags = tags[:maxRegexChannelTags]
+	}
+	created := make(map[string]time.Time)
+	dated := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tagged, err := reference.WithTag(ref, tag)
+		if err != nil {
+			continue
+		}
+		date, err := c.tagCreated(tagged, auth)
+		if err != nil {
+			log.Printf("    skipping %s: %s", reference.FamiliarString(tagged), err)
+			continue
+		}
+		created[tag] = date
+		dated = append(dated, tag)
+	}
+	sort.SliceStable(dated, func(i, j int) bool {
+		return created[dated[i]].After(created[dated[j]])
+	})
+	return dated
+}
+
+// tagCreated return the creation date of the image of given tag
+func (c *Config) tagCreated(tagged reference.NamedTagged, auth *DockerRegistryCredentials) (time.Time, error) {
+	digest, err := c.reg.GetDigest(c.context, tagged.String(), auth)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return c.imageCreated(tagged.String(), digest, auth)
+}
+
+// naturalLess compare given tags lexically, except for runs of digits which
+// are compared by value, so that release-10 comes after release-9
+func naturalLess(a string, b string) bool {
+	for a != "" && b != "" {
+		i, j := digitsPrefix(a), digitsPrefix(b)
+		if i > 0 && j > 0 {
+			x, y := strings.TrimLeft(a[:i], "0"), strings.TrimLeft(b[:j], "0")
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+			if x != y {
+				return x < y
+			}
+			a, b = a[i:], b[j:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// digitsPrefix return the length of the run of digits starting s
+func digitsPrefix(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,773 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxManifestSize is the maximum size of a manifest we accept to read
+const maxManifestSize = 4 * 1024 * 1024
+
+// defaultManifestAccept is the list of manifest media types sent in the
+// Accept header when no list is configured for the registry
+var defaultManifestAccept = []string{
+	manifest.DockerV2Schema2MediaType,
+	manifest.DockerV2ListMediaType,
+	imgspecv1.MediaTypeImageManifest,
+	imgspecv1.MediaTypeImageIndex,
+	manifest.DockerV2Schema1SignedMediaType,
+	manifest.DockerV2Schema1MediaType,
+}
+
+// errRegistryUnreachable is returned for images of registries which failed
+// the precheck, they are reported once in the run summary
+var errRegistryUnreachable = errors.New("registry is unreachable")
+
+// Causes of failed registry requests, RequestError match them with
+// errors.Is so callers can react to the cause
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrTimeout      = errors.New("timed out")
+)
+
+// RequestError is a failed registry request for an image
+type RequestError struct {
+	Host  string
+	Image string
+	// Status is the HTTP status of the response, 0 when the request
+	// failed without a response
+	Status int
+	Err    error
+}
+
+func (e *RequestError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("registry %s: %s: %d %s", e.Host, e.Image, e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("registry %s: %s: %s", e.Host, e.Image, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Is match the cause of the failure
+func (e *RequestError) Is(target error) bool {
+	if target == ErrTimeout {
+		var netErr net.Error
+		if errors.Is(e.Err, context.DeadlineExceeded) || errors.As(e.Err, &netErr) && netErr.Timeout() {
+			return true
+		}
+	}
+	return statusIs(e.Status, target)
+}
+
+// statusIs return whether given HTTP status has given cause
+func statusIs(status int, target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return status == http.StatusUnauthorized || status == http.StatusForbidden
+	case ErrNotFound:
+		return status == http.StatusNotFound
+	case ErrRateLimited:
+		return status == http.StatusTooManyRequests
+	case ErrTimeout:
+		return status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout
+	}
+	return false
+}
+
+// requestHint return advice on the cause of a failed registry request
+func requestHint(err error) string {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return "check credentials configured for the registry"
+	case errors.Is(err, ErrNotFound):
+		return "check the image and tag exist"
+	case errors.Is(err, ErrRateLimited):
+		return "the registry is rate limiting requests, configure credentials or a pull-through cache"
+	case errors.Is(err, ErrTimeout):
+		return "the registry is slow or unreachable, check network policies and egress firewall rules"
+	}
+	return ""
+}
+
+// DockerRegistryCredentials are the credentials used to authenticate on a
+// registry
+type DockerRegistryCredentials struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token exchanged for registry
+	// tokens instead of the password, like docker does with the
+	// identitytoken of its config
+	IdentityToken string
+}
+
+// DigestResolver resolve an image reference to the digest of its manifest
+type DigestResolver interface {
+	GetDigest(ctx context.Context, image string, auth *DockerRegistryCredentials) (string, error)
+}
+
+// RegistryClient resolve image digests using the docker registry HTTP API V2
+type RegistryClient struct {
+	client *http.Client
+	// tlsConfigs hold TLS settings of registry hosts (e.g. private CAs),
+	// requests to these hosts are sent with hostClients
+	tlsConfigs  map[string]*tls.Config
+	hostClients map[string]*http.Client
+	// insecureRegistries are hosts reached over plain HTTP
+	insecureRegistries map[string]bool
+	// accept hold the manifest media types to request, per registry host
+	accept map[string][]string
+	// mu protect caches below, the client can be used by concurrent
+	// lookups
+	mu sync.Mutex
+	// cache hold resolved digests per image and credentials, see
+	// digestCacheKey
+	cache map[string]cachedDigest
+	// cacheTTL is how long digests are kept across runs of -daemon mode,
+	// 0 to forget them at the end of each run
+	cacheTTL time.Duration
+	// noCache resolve images again on each lookup
+	noCache bool
+	// resolved hold how digests in cache were resolved, for explain
+	resolved map[string]string
+	// known hold the last known manifest of tags, see knownManifest
+	known map[string]knownManifest
+	// moved hold tags resolved to another digest than their last known
+	// manifest
+	moved []movedTag
+	// tokens are bearer tokens per realm, service, scope and credentials
+	tokens map[string]registryToken
+	pacers map[string]*hostPacer
+	// lookups hold digest lookups in flight, per image and credentials
+	lookups map[string]*lookupCall
+	// imageLocks serialize lookups of an image with different credentials
+	imageLocks map[string]*sync.Mutex
+	// platform is the platform manifest lists are resolved to, the one
+	// imago runs on when nil
+	platform *types.SystemContext
+	// pings hold registry precheck results
+	pings    map[string]error
+	warnings []string
+}
+
+// defaultTokenLifetime is the lifetime of bearer tokens returned without
+// expires_in, per the docker token authentication specification
+const defaultTokenLifetime = 60 * time.Second
+
+// registryToken is a bearer token and when it expires
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+// cachedDigest is a resolved digest and when it was resolved
+type cachedDigest struct {
+	digest   string
+	resolved time.Time
+}
+
+// NewRegistryClient initialize a new registry client
+func NewRegistryClient() *RegistryClient {
+	return &RegistryClient{
+		client:             &http.Client{Timeout: 30 * time.Second},
+		accept:             make(map[string][]string),
+		tlsConfigs:         make(map[string]*tls.Config),
+		hostClients:        make(map[string]*http.Client),
+		insecureRegistries: make(map[string]bool),
+		cache:              make(map[string]cachedDigest),
+		resolved:           make(map[string]string),
+		known:              make(map[string]knownManifest),
+		tokens:             make(map[string]registryToken),
+		lookups:            make(map[string]*lookupCall),
+		imageLocks:         make(map[string]*sync.Mutex),
+		pacers:             make(map[string]*hostPacer),
+		pings:              make(map[string]error),
+	}
+}
+
+// SetAccept configure the manifest media types to request on given registry
+// host, in order of preference
+func (r *RegistryClient) SetAccept(host string, mediaTypes []string) {
+	r.accept[host] = mediaTypes
+}
+
+func (r *RegistryClient) getAccept(host string) []string {
+	if accept, ok := r.accept[host]; ok {
+		return accept
+	}
+	return defaultManifestAccept
+}
+
+// registryEndpoint return the base URL of the registry API for given host,
+// over plain HTTP for insecure registries
+func (r *RegistryClient) registryEndpoint(host string) string {
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	if r.insecureRegistries[host] {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// SetInsecureRegistry talk to given registry host over plain HTTP, like
+// dockerd insecure-registries
+func (r *RegistryClient) SetInsecureRegistry(host string) {
+	r.insecureRegistries[host] = true
+}
+
+// parseChallenge parse a WWW-Authenticate header, return the scheme and its
+// parameters
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	scheme := strings.ToLower(parts[0])
+	if len(parts) < 2 {
+		return scheme, params
+	}
+	rest := parts[1]
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// tokenCacheKey return the key of tokens of given challenge, scope and
+// credentials
+func tokenCacheKey(params map[string]string, scope string, auth *DockerRegistryCredentials) string {
+	cacheKey := strings.Join([]string{params["realm"], params["service"], scope}, " ")
+	if auth != nil {
+		cacheKey += " " + auth.id()
+	}
+	return cacheKey
+}
+
+// evictToken forget the cached token of given challenge, scope and
+// credentials, e.g. when the registry rejected it
+func (r *RegistryClient) evictToken(params map[string]string, scope string, auth *DockerRegistryCredentials) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tokens, tokenCacheKey(params, scope, auth))
+}
+
+// getToken request a bearer token on the authorization server described by
+// the challenge parameters, or return a cached token not expired yet, in
+// which case cached is true. We always request a pull only scope, whatever
+// the registry challenge asked for (or if it didn't provide any scope).
+func (r *RegistryClient) getToken(ctx context.Context, params map[string]string, scope string, auth *DockerRegistryCredentials) (token string, cached bool, err error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", false, fmt.Errorf("missing realm in authentication challenge")
+	}
+	cacheKey := tokenCacheKey(params, scope, auth)
+	r.mu.Lock()
+	t, ok := r.tokens[cacheKey]
+	r.mu.Unlock()
+	if ok && time.Now().Before(t.expires) {
+		return t.token, true, nil
+	}
+	token, err = r.requestToken(ctx, params, scope, auth)
+	return token, false, err
+}
+
+// requestToken request a new bearer token and cache it until it expires
+func (r *RegistryClient) requestToken(ctx context.Context, params map[string]string, scope string, auth *DockerRegistryCredentials) (string, error) {
+	realm := params["realm"]
+	requested := time.Now()
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	if auth != nil && u.Scheme != "https" {
+		return "", fmt.Errorf("refusing to send credentials to non https realm %s", realm)
+	}
+	query := u.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	var req *http.Request
+	if auth != nil && auth.IdentityToken != "" {
+		// OAuth2 refresh token grant of the docker token authentication
+		// specification
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {auth.IdentityToken},
+			"client_id":     {"imago"},
+		}
+		for key, values := range query {
+			form[key] = values
+		}
+		u.RawQuery = ""
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		u.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if auth != nil {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+	resp, err := r.send(req)
+	if err != nil {
+		return "", err
+	}
+	defer closeResource(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", &tokenError{realm: realm, status: resp.StatusCode}
+	}
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+	token := tokenResponse.Token
+	if token == "" {
+		token = tokenResponse.AccessToken
+	}
+	lifetime := defaultTokenLifetime
+	if tokenResponse.ExpiresIn > 0 {
+		lifetime = time.Duration(tokenResponse.ExpiresIn) * time.Second
+	}
+	// renew tokens a bit before they expire, requests using them can
+	// be slow or retried
+	r.mu.Lock()
+	r.tokens[tokenCacheKey(params, scope, auth)] = registryToken{token: token, expires: requested.Add(lifetime - lifetime/10)}
+	r.mu.Unlock()
+	return token, nil
+}
+
+type tokenError struct {
+	realm  string
+	status int
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("unable to get token from %s: %d %s", e.realm, e.status, http.StatusText(e.status))
+}
+
+// Is match the cause of the failure
+func (e *tokenError) Is(target error) bool {
+	return statusIs(e.status, target)
+}
+
+func (r *RegistryClient) authorize(ctx context.Context, req *http.Request, challenge string, scope string, auth *DockerRegistryCredentials) (*http.Response, error) {
+	scheme, params := parseChallenge(challenge)
+	retry := req.Clone(ctx)
+	switch scheme {
+	case "bearer":
+		token, cached, err := r.getToken(ctx, params, scope, auth)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			retry.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := r.send(retry)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || !cached {
+			return resp, err
+		}
+		// the cached token was revoked or expired early, get a new
+		// one once before failing
+		closeResource(resp.Body)
+		r.evictToken(params, scope, auth)
+		if token, err = r.requestToken(ctx, params, scope, auth); err != nil {
+			return nil, err
+		}
+		retry = req.Clone(ctx)
+		if token != "" {
+			retry.Header.Set("Authorization", "Bearer "+token)
+		}
+	case "basic":
+		if auth == nil {
+			return nil, fmt.Errorf("%s requires authentication", req.URL.Host)
+		}
+		retry.SetBasicAuth(auth.Username, auth.Password)
+	case "":
+		return nil, fmt.Errorf("%s requires authentication but didn't send a challenge", req.URL.Host)
+	default:
+		return nil, fmt.Errorf("unsupported authentication scheme %s on %s", scheme, req.URL.Host)
+	}
+	return r.send(retry)
+}
+
+// do send request and handle registry authentication challenges. When
+// credentials are rejected, we retry anonymously since the image might be
+// public while credentials are for other repositories of the registry.
+func (r *RegistryClient) do(ctx context.Context, req *http.Request, scope string, auth *DockerRegistryCredentials) (*http.Response, error) {
+	resp, err := r.send(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	closeResource(resp.Body)
+	resp, err = r.authorize(ctx, req, challenge, scope, auth)
+	if auth == nil {
+		return resp, err
+	}
+	var tokenErr *tokenError
+	if errors.As(err, &tokenErr) && (tokenErr.status == http.StatusUnauthorized || tokenErr.status == http.StatusForbidden) {
+		log.Printf("    credentials rejected by %s, retrying anonymously", tokenErr.realm)
+		return r.authorize(ctx, req, challenge, scope, nil)
+	}
+	if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		log.Printf("    credentials rejected by %s, retrying anonymously", req.URL.Host)
+		closeResource(resp.Body)
+		return r.authorize(ctx, req, challenge, scope, nil)
+	}
+	return resp, err
+}
+
+// GetManifest fetch the manifest of given image reference, return the
+// manifest and its media type
+func (r *RegistryClient) GetManifest(ctx context.Context, ref reference.Named, tagOrDigest string, auth *DockerRegistryCredentials) ([]byte, string, error) {
+	return r.getManifest(ctx, ref, tagOrDigest, "", auth)
+}
+
+// getManifest fetch the manifest of given image reference unless its digest
+// is knownDigest, errNotModified is returned in this case without
+// downloading the manifest
+func (r *RegistryClient) getManifest(ctx context.Context, ref reference.Named, tagOrDigest string, knownDigest string, auth *DockerRegistryCredentials) ([]byte, string, error) {
+	host := reference.Domain(ref)
+	path := reference.Path(ref)
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", r.registryEndpoint(host), path, tagOrDigest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(r.getAccept(host), ", "))
+	req.Header.Set("User-Agent", "imago")
+	if knownDigest != "" {
+		req.Header.Set("If-None-Match", fmt.Sprintf("%q", knownDigest))
+	}
+	image := path + ":" + tagOrDigest
+	if strings.Contains(tagOrDigest, ":") {
+		image = path + "@" + tagOrDigest
+	}
+	resp, err := r.do(ctx, req, fmt.Sprintf("repository:%s:pull", path), auth)
+	if err != nil {
+		return nil, "", &RequestError{Host: host, Image: image, Err: err}
+	}
+	defer closeResource(resp.Body)
+	// registries ignoring If-None-Match still tell the digest in headers
+	if knownDigest != "" && (resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusOK && resp.Header.Get("Docker-Content-Digest") == knownDigest) {
+		return nil, "", errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &RequestError{Host: host, Image: image, Status: resp.StatusCode}
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", err
+	}
+	return b, manifestMediaType(resp.Header.Get("Content-Type"), b), nil
+}
+
+// manifestMediaType return the media type of a manifest, registries (or
+// CDNs in front of them) sometimes serve manifests with a generic content
+// type, in which case it's guessed from the manifest itself
+func manifestMediaType(contentType string, b []byte) string {
+	if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = parsed
+	}
+	for _, mediaType := range defaultManifestAccept {
+		if contentType == mediaType {
+			return mediaType
+		}
+	}
+	if guessed := manifest.GuessMIMEType(b); guessed != "" {
+		return guessed
+	}
+	return contentType
+}
+
+// GetImageManifest return the parsed manifest of given image digest,
+// manifest lists are resolved to the image of our platform
+func (r *RegistryClient) GetImageManifest(ctx context.Context, ref reference.Named, digest string, auth *DockerRegistryCredentials) (manifest.Manifest, error) {
+	b, mediaType, err := r.GetManifest(ctx, ref, digest, auth)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.MIMETypeIsMultiImage(mediaType) {
+		list, err := manifest.ListFromBlob(b, mediaType)
+		if err != nil {
+			return nil, err
+		}
+		instance, err := list.ChooseInstance(r.platform)
+		if err != nil {
+			return nil, err
+		}
+		if b, mediaType, err = r.GetManifest(ctx, ref, string(instance), auth); err != nil {
+			return nil, err
+		}
+	}
+	return manifest.FromBlob(b, mediaType)
+}
+
+// linkNextRe match the next page URL of a Link header
+var linkNextRe = regexp.MustCompile(`<([^>]+)>;\s*rel="?next"?`)
+
+// ListTags return tags of given repository, following pagination
+func (r *RegistryClient) ListTags(ctx context.Context, ref reference.Named, auth *DockerRegistryCredentials) ([]string, error) {
+	host := reference.Domain(ref)
+	path := reference.Path(ref)
+	endpoint, err := url.Parse(r.registryEndpoint(host))
+	if err != nil {
+		return nil, err
+	}
+	next := fmt.Sprintf("%s/v2/%s/tags/list", endpoint, path)
+	tags := make([]string, 0)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", "imago")
+		resp, err := r.do(ctx, req, fmt.Sprintf("repository:%s:pull", path), auth)
+		if err != nil {
+			return nil, &RequestError{Host: host, Image: path, Err: err}
+		}
+		if resp.StatusCode != http.StatusOK {
+			closeResource(resp.Body)
+			return nil, &RequestError{Host: host, Image: path, Status: resp.StatusCode}
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&page)
+		closeResource(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+		next = ""
+		if match := linkNextRe.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			// the next page URL is usually relative to the registry
+			u, err := endpoint.Parse(match[1])
+			if err != nil {
+				return nil, err
+			}
+			next = u.String()
+		}
+	}
+	return tags, nil
+}
+
+// lookupCall is a digest lookup in flight
+type lookupCall struct {
+	done   chan struct{}
+	digest string
+	err    error
+}
+
+// GetDigest return the docker digest of given image name. Concurrent
+// lookups of the same image with the same credentials share a single
+// lookup, lookups with other credentials wait for it to complete and then
+// only cost a conditional request.
+func (r *RegistryClient) GetDigest(ctx context.Context, name string, auth *DockerRegistryCredentials) (string, error) {
+	key := digestCacheKey(name, auth)
+	r.mu.Lock()
+	if cached, ok := r.cache[key]; ok && !r.noCache {
+		r.mu.Unlock()
+		return cached.digest, nil
+	}
+	if call, ok := r.lookups[key]; ok {
+		r.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.digest, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	r.lookups[key] = call
+	if r.imageLocks[name] == nil {
+		r.imageLocks[name] = &sync.Mutex{}
+	}
+	imageLock := r.imageLocks[name]
+	r.mu.Unlock()
+
+	imageLock.Lock()
+	call.digest, call.err = r.getDigest(ctx, name, auth)
+	imageLock.Unlock()
+	r.mu.Lock()
+	delete(r.lookups, key)
+	r.mu.Unlock()
+	close(call.done)
+	return call.digest, call.err
+}
+
+func (r *RegistryClient) getDigest(ctx context.Context, name string, auth *DockerRegistryCredentials) (string, error) {
+	key := digestCacheKey(name, auth)
+	r.mu.Lock()
+	pingErr := r.pings[imageHost(name)]
+	r.mu.Unlock()
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", err
+	}
+	tagged, ok := reference.TagNameOnly(ref).(reference.NamedTagged)
+	if !ok {
+		return "", fmt.Errorf("%s has no tag", name)
+	}
+	if pingErr != nil {
+		return "", fmt.Errorf("%s: %w", reference.Domain(ref), errRegistryUnreachable)
+	}
+	r.mu.Lock()
+	known := r.known[tagged.String()]
+	r.mu.Unlock()
+	if known.Platform != r.platformName() {
+		// resolved for another platform
+		known = knownManifest{}
+	}
+	b, mediaType, err := r.getManifest(ctx, tagged, tagged.Tag(), known.Digest, auth)
+	if errors.Is(err, errNotModified) {
+		r.mu.Lock()
+		r.cache[key] = cachedDigest{known.Resolved, time.Now()}
+		r.resolved[key] = known.Description + ", not modified since last run"
+		r.mu.Unlock()
+		return known.Resolved, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	manifestDigest, err := manifest.Digest(b)
+	if err != nil {
+		return "", err
+	}
+	var digeststr string
+	resolved := fmt.Sprintf("%s manifest", mediaType)
+	if manifest.MIMETypeIsMultiImage(mediaType) {
+		// like container runtimes do, use the image of our platform
+		list, err := manifest.ListFromBlob(b, mediaType)
+		if err != nil {
+			return "", err
+		}
+		instance, err := list.ChooseInstance(r.platform)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		digeststr = string(instance)
+		resolved += fmt.Sprintf(", using the instance for %s", r.platformName())
+	} else {
+		digeststr = string(manifestDigest)
+	}
+	entry := knownManifest{Digest: string(manifestDigest), Resolved: digeststr, Description: resolved, Platform: r.platformName(), Previous: known.Previous, Changed: known.Changed}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if known.Resolved != "" && known.Resolved != digeststr {
+		entry.Previous, entry.Changed = known.Resolved, time.Now().UTC()
+		if r.known[tagged.String()].Resolved == known.Resolved {
+			r.moved = append(r.moved, movedTag{tagged.String(), known.Resolved, digeststr})
+		}
+	}
+	r.cache[key] = cachedDigest{digeststr, time.Now()}
+	r.resolved[key] = resolved
+	r.known[tagged.String()] = entry
+	return digeststr, nil
+}
+
+// digestCacheKey return the cache key of the digest of given image looked
+// up with given credentials, digests resolved with some credentials must
+// not be returned to lookups using other (or no) credentials
+func digestCacheKey(name string, auth *DockerRegistryCredentials) string {
+	if auth == nil {
+		return name
+	}
+	return name + " " + auth.id()
+}
+
+// id identify credentials in cache keys without exposing the password,
+// credentials are equivalent when they have the same id
+func (auth *DockerRegistryCredentials) id() string {
+	return fmt.Sprintf("%s:%x", auth.Username, sha256.Sum256([]byte(auth.Password+"\x00"+auth.IdentityToken)))
+}
+
+// imageHost return the registry host of given image, or ""
+func imageHost(name string) string {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(ref)
+}
+
+// Resolved describe how the digest of given image was resolved, for explain
+func (r *RegistryClient) Resolved(name string, auth *DockerRegistryCredentials) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resolved[digestCacheKey(name, auth)]
+}
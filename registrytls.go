@@ -0,0 +1,86 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// hostTLSConfig return the TLS configuration of given registry host,
+// created from system defaults the first time
+func (r *RegistryClient) hostTLSConfig(host string) *tls.Config {
+	if r.tlsConfigs[host] == nil {
+		r.tlsConfigs[host] = &tls.Config{}
+	}
+	return r.tlsConfigs[host]
+}
+
+// AddRegistryCA trust CA certificates of given PEM file for given registry
+// host, in addition to system CAs
+func (r *RegistryClient) AddRegistryCA(host string, path string) error {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config := r.hostTLSConfig(host)
+	if config.RootCAs == nil {
+		if config.RootCAs, err = x509.SystemCertPool(); err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+	}
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no PEM certificate found in %s", path)
+	}
+	return nil
+}
+
+// AddClientCertificate present the client certificate of given PEM files
+// to given registry host, for registries requiring mutual TLS
+func (r *RegistryClient) AddClientCertificate(host string, certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	config := r.hostTLSConfig(host)
+	config.Certificates = append(config.Certificates, cert)
+	return nil
+}
+
+// SetInsecureSkipVerify disable verification of the TLS certificate of
+// given registry host
+func (r *RegistryClient) SetInsecureSkipVerify(host string) {
+	r.hostTLSConfig(host).InsecureSkipVerify = true
+}
+
+// clientFor return the HTTP client sending requests to given host, with
+// its own transport when the host has a specific TLS configuration
+func (r *RegistryClient) clientFor(host string) *http.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config, ok := r.tlsConfigs[host]
+	if !ok {
+		return r.client
+	}
+	if r.hostClients[host] == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		r.hostClients[host] = &http.Client{Timeout: r.client.Timeout, Transport: transport}
+	}
+	return r.hostClients[host]
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Exit codes of imago
+const (
+	exitOK               = 0
+	exitError            = 1
+	exitUpdatesAvailable = 2
+	exitConfigError      = 3
+	exitRegistryError    = 4
+	exitKubernetesError  = 5
+)
+
+// Error classes, in order of precedence for the exit code
+const (
+	configErrorClass     = "configuration"
+	kubernetesErrorClass = "kubernetes"
+	registryErrorClass   = "registry"
+	otherErrorClass      = "other"
+)
+
+var errorClasses = []struct {
+	class string
+	code  int
+}{
+	{configErrorClass, exitConfigError},
+	{kubernetesErrorClass, exitKubernetesError},
+	{registryErrorClass, exitRegistryError},
+	{otherErrorClass, exitError},
+}
+
+// Report summarize the outcome of a run
+type Report struct {
+	errors   map[string][]string
+	outdated []outdatedImage
+	// pullSize is the total size of layers to pull for outdated containers
+	// of known pull size
+	pullSize int64
+	// tracked hold all images checked during the run
+	tracked []trackedImage
+	// fixed hold containers having a source image with a fixed digest,
+	// which aren't checked
+	fixed []trackedImage
+	// events hold updates found or applied during the run
+	events []*updateEvent
+	// failures are errors of the run checking a container or a workload
+	failures []containerFailure
+	// detailedExitCode exit with exitError on any error and with
+	// exitUpdatesAvailable when updates are available or applied
+	detailedExitCode bool
+	// output is the format of the structured output of the run written on
+	// stdout, json or yaml, none if empty
+	output string
+	// history is the path of the SQL history file to append to, if any
+	history string
+	// historyDSN is the PostgreSQL database recording the run, if any
+	historyDSN string
+	// exportDependencies is the path of the dependency export to write, if
+	// any
+	exportDependencies string
+	// run identify the run in uploaded reports
+	run     string
+	cluster string
+	started time.Time
+	// uploads are destinations of the run report
+	uploads arrayFlags
+	// auditUploads are destinations of the audit log of the run
+	auditUploads arrayFlags
+	// notifyURLs receive the structured output of the run
+	notifyURLs arrayFlags
+	// pushgateway is the URL of the Prometheus Pushgateway receiving
+	// metrics of the run, if any
+	pushgateway string
+	// gitlabCodeQuality is the path of the GitLab code quality report to
+	// write, if any
+	gitlabCodeQuality string
+}
+
+// NewReport initialize an empty run report
+func NewReport() *Report {
+	started := time.Now().UTC()
+	return &Report{errors: make(map[string][]string), run: newRunID(started), cluster: "default", started: started}
+}
+
+// nextRun return an empty report of the next run, written to the same
+// outputs, in -daemon mode
+func (r *Report) nextRun() *Report {
+	next := NewReport()
+	next.history = r.history
+	next.historyDSN = r.historyDSN
+	next.exportDependencies = r.exportDependencies
+	next.cluster = r.cluster
+	next.uploads = r.uploads
+	next.auditUploads = r.auditUploads
+	next.notifyURLs = r.notifyURLs
+	next.pushgateway = r.pushgateway
+	next.gitlabCodeQuality = r.gitlabCodeQuality
+	next.output = r.output
+	next.detailedExitCode = r.detailedExitCode
+	return next
+}
+
+// classifyError return the class of an error returned while processing a
+// workload
+func classifyError(err error) string {
+	var status apierrors.APIStatus
+	var urlErr *url.Error
+	var regErr *registryError
+	var reqErr *RequestError
+	switch {
+	case errors.As(err, &regErr), errors.As(err, &reqErr):
+		return registryErrorClass
+	case errors.As(err, &status), errors.As(err, &urlErr):
+		return kubernetesErrorClass
+	}
+	return otherErrorClass
+}
+
+// AddError record an error of given class
+func (r *Report) AddError(class string, err error) {
+	r.errors[class] = append(r.errors[class], err.Error())
+}
+
+// outdatedImage is a container having an update available
+type outdatedImage struct {
+	resource  string
+	container string
+	containerUpdate
+}
+
+// details describe why and how the image changed
+func (o *outdatedImage) details() string {
+	details := o.reason
+	if o.layers != "" {
+		details += "; " + o.layers
+	}
+	if o.pullSize >= 0 {
+		details += "; pull size " + o.pullSizeString()
+	}
+	return details
+}
+
+func (o *outdatedImage) String() string {
+	return fmt.Sprintf("%s %s can be updated to %s (%s)", o.resource, o.container, o.image, o.details())
+}
+
+// AddOutdated record a container having an update available
+func (r *Report) AddOutdated(resource string, container string, u containerUpdate) {
+	if u.pullSize >= 0 {
+		r.pullSize += u.pullSize
+	}
+	r.outdated = append(r.outdated, outdatedImage{resource, container, u})
+}
+
+// AddEvent record an update event of the run
+func (r *Report) AddEvent(e *updateEvent) {
+	r.events = append(r.events, e)
+}
+
+// ExitCode return the exit code matching the run outcome
+func (r *Report) ExitCode() int {
+	for _, c := range errorClasses {
+		if len(r.errors[c.class]) > 0 {
+			if r.detailedExitCode {
+				return exitError
+			}
+			return c.code
+		}
+	}
+	// held and available updates only fail the run with
+	// -detailed-exitcode, a CronJob running -update would otherwise be
+	// retried on each run holding updates
+	if !r.detailedExitCode {
+		return exitOK
+	}
+	if len(r.outdated) > 0 {
+		return exitUpdatesAvailable
+	}
+	for _, e := range r.events {
+		if e.Type == eventApplied {
+			return exitUpdatesAvailable
+		}
+	}
+	return exitOK
+}
+
+// Summary describe the run outcome
+func (r *Report) Summary() []string {
+	summary := make([]string, 0)
+	for _, c := range errorClasses {
+		for _, err := range r.errors[c.class] {
+			summary = append(summary, fmt.Sprintf("%s error: %s", c.class, err))
+		}
+	}
+	for _, outdated := range r.outdated {
+		summary = append(summary, fmt.Sprintf("update available: %s", &outdated))
+	}
+	for _, skew := range r.digestSkews() {
+		summary = append(summary, fmt.Sprintf("digest skew: %s", skew))
+	}
+	counts := make([]string, 0)
+	for _, c := range errorClasses {
+		if n := len(r.errors[c.class]); n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s errors", n, c.class))
+		}
+	}
+	if len(r.outdated) > 0 {
+		outdated := fmt.Sprintf("%d updates available", len(r.outdated))
+		if r.pullSize > 0 {
+			outdated += fmt.Sprintf(" (%s to pull)", formatSize(r.pullSize))
+		}
+		counts = append(counts, outdated)
+	}
+	if len(counts) > 0 {
+		summary = append(summary, fmt.Sprintf("summary: %s (exit code %d)", strings.Join(counts, ", "), r.ExitCode()))
+	}
+	return summary
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// loadRunReport read a run report from given file, or from <run>.json
+// found under given directory
+func loadRunReport(ref string, dir string) (*runReport, error) {
+	path := ref
+	if _, err := os.Stat(path); os.IsNotExist(err) && dir != "" {
+		path = ""
+		errFound := errors.New("found")
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && info.Name() == ref+".json" {
+				path = p
+				return errFound
+			}
+			return nil
+		})
+		if err != nil && err != errFound {
+			return nil, err
+		}
+		if path == "" {
+			return nil, fmt.Errorf("run %s not found in %s", ref, dir)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &runReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, fmt.Errorf("invalid run report %s: %w", path, err)
+	}
+	return report, nil
+}
+
+// images return the image of each container of the report, indexed by
+// namespace/kind/name/container
+func (r *runReport) images() map[string]string {
+	images := make(map[string]string)
+	for _, d := range r.Dependencies {
+		image := d.DepName + ":" + d.CurrentValue
+		if d.CurrentDigest != "" {
+			image += "@" + d.CurrentDigest
+		}
+		for _, w := range d.Workloads {
+			images[w] = image
+		}
+	}
+	return images
+}
+
+// runDiff summarize changes between two run reports
+type runDiff struct {
+	changed     []string
+	added       []string
+	removed     []string
+	outdated    []string
+	upToDate    []string
+	newErrors   []string
+	fixedErrors []string
+}
+
+func diffRunReports(previous, current *runReport) *runDiff {
+	diff := &runDiff{}
+	before, after := previous.images(), current.images()
+	for container, image := range after {
+		old, ok := before[container]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, fmt.Sprintf("%s: %s", container, image))
+		case old != image:
+			diff.changed = append(diff.changed, fmt.Sprintf("%s: %s -> %s", container, old, image))
+		}
+	}
+	for container, image := range before {
+		if _, ok := after[container]; !ok {
+			diff.removed = append(diff.removed, fmt.Sprintf("%s: %s", container, image))
+		}
+	}
+	outdated := func(r *runReport) map[string]string {
+		index := make(map[string]string)
+		for _, o := range r.Outdated {
+			index[o.Workload+"/"+o.Container] = fmt.Sprintf("%s/%s can be updated to %s (%s)", o.Workload, o.Container, o.Image, o.Details)
+		}
+		return index
+	}
+	outdatedBefore, outdatedAfter := outdated(previous), outdated(current)
+	for container, line := range outdatedAfter {
+		if _, ok := outdatedBefore[container]; !ok {
+			diff.outdated = append(diff.outdated, line)
+		}
+	}
+	for container := range outdatedBefore {
+		if _, ok := outdatedAfter[container]; !ok {
+			diff.upToDate = append(diff.upToDate, container)
+		}
+	}
+	errorSet := func(r *runReport) map[string]bool {
+		set := make(map[string]bool)
+		for _, e := range r.Errors {
+			set[fmt.Sprintf("%s error: %s", e.Class, e.Message)] = true
+		}
+		return set
+	}
+	errorsBefore, errorsAfter := errorSet(previous), errorSet(current)
+	for e := range errorsAfter {
+		if !errorsBefore[e] {
+			diff.newErrors = append(diff.newErrors, e)
+		}
+	}
+	for e := range errorsBefore {
+		if !errorsAfter[e] {
+			diff.fixedErrors = append(diff.fixedErrors, e)
+		}
+	}
+	for _, lines := range [][]string{diff.changed, diff.added, diff.removed, diff.outdated, diff.upToDate, diff.newErrors, diff.fixedErrors} {
+		sort.Strings(lines)
+	}
+	return diff
+}
+
+// write the diff as text
+func (d *runDiff) write(w io.Writer, previous, current *runReport) {
+	fmt.Fprintf(w, "Changes from run %s (%s) to run %s (%s), cluster %s\n",
+		previous.Run, previous.Started.Format(time.RFC3339), current.Run, current.Started.Format(time.RFC3339), current.Cluster)
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"Images changed", d.changed},
+		{"New containers", d.added},
+		{"Removed containers", d.removed},
+		{"Newly outdated", d.outdated},
+		{"No longer outdated", d.upToDate},
+		{"New errors", d.newErrors},
+		{"Resolved errors", d.fixedErrors},
+	}
+	for _, s := range sections {
+		fmt.Fprintf(w, "\n%s (%d):\n", s.title, len(s.lines))
+		for _, line := range s.lines {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+}
+
+func reportCommand(args []string) {
+	var since string
+	var dir string
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s report: %s\n", os.Args[0], commands["report"].description)
+		fmt.Fprintf(flags.Output(), "  %s report -since <report|run> <report|run>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&since, "since", "", "previous run report file or run identifier to compare with")
+	flags.StringVar(&dir, "reports", "", "directory searched for <run>.json files when a run identifier is given, e.g. a local copy of the -upload-report bucket")
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	if since == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+	previous, err := loadRunReport(since, dir)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	current, err := loadRunReport(flags.Arg(0), dir)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	diffRunReports(previous, current).write(os.Stdout, previous, current)
+}
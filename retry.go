@@ -0,0 +1,68 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// transientBackoff is the backoff of kubernetes API calls failing with a
+// transient error, about 15 seconds of retries
+var transientBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// isTransient return whether given kubernetes API error is likely to go
+// away when retrying: throttling, timeouts, unavailable or internal errors
+// of the API server (e.g. etcd leader changes) and dropped connections.
+// Conflicts are handled by retrying the whole read-modify-write, see
+// updateWorkload.
+func isTransient(err error) bool {
+	switch {
+	case apierrors.IsTooManyRequests(err),
+		apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsServiceUnavailable(err),
+		apierrors.IsInternalError(err):
+		return true
+	case utilnet.IsConnectionReset(err), utilnet.IsConnectionRefused(err), utilnet.IsProbableEOF(err):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryTransient call fn until it succeed, fail with an error which isn't
+// transient or retries are exhausted
+func retryTransient(fn func() error) error {
+	return retry.OnError(transientBackoff, func(err error) bool {
+		if !isTransient(err) {
+			return false
+		}
+		log.Printf("transient kubernetes API error, retrying: %s", err)
+		return true
+	}, fn)
+}
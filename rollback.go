@@ -0,0 +1,160 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagoPreviousImagesAnnotation record images of containers replaced by the
+// last update of a workload, as a JSON object indexed by container name
+const imagoPreviousImagesAnnotation = "imago-previous-images"
+
+// storePreviousImages record given images replaced by an update in
+// imagoPreviousImagesAnnotation
+func storePreviousImages(meta *metav1.ObjectMeta, images map[string]string) error {
+	data, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[imagoPreviousImagesAnnotation] = string(data)
+	return nil
+}
+
+// loadPreviousImages return images recorded in imagoPreviousImagesAnnotation
+// of given workload, nil when there is none
+func loadPreviousImages(meta *metav1.ObjectMeta) (map[string]string, error) {
+	value, ok := meta.Annotations[imagoPreviousImagesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	images := make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &images); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", imagoPreviousImagesAnnotation, err)
+	}
+	return images, nil
+}
+
+// restorePreviousImages set images of containers of given template to given
+// previous images, returning images replaced indexed by container name
+func restorePreviousImages(template *v1.PodTemplateSpec, previous map[string]string) map[string]string {
+	replaced := make(map[string]string)
+	restore := func(containers []v1.Container) {
+		for i, container := range containers {
+			if image, ok := previous[container.Name]; ok && image != container.Image {
+				replaced[container.Name] = container.Image
+				containers[i].Image = image
+			}
+		}
+	}
+	restore(template.Spec.InitContainers)
+	restore(template.Spec.Containers)
+	return replaced
+}
+
+// rollbackWorkload restore images given workload ran before its last
+// update. Images replaced by the rollback become the previous images, and
+// are recorded in imagoRolledBackAnnotation so that imago doesn't update to
+// them again.
+func (c *Config) rollbackWorkload(kind string, meta *metav1.ObjectMeta, template *v1.PodTemplateSpec, dryRun bool) error {
+	resource := fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name)
+	previous, err := loadPreviousImages(meta)
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		return fmt.Errorf("no previous images recorded in %s annotation", imagoPreviousImagesAnnotation)
+	}
+	replaced := restorePreviousImages(template.DeepCopy(), previous)
+	if len(replaced) == 0 {
+		log.Printf("%s: already running previous images", resource)
+		return nil
+	}
+	for container, image := range replaced {
+		log.Printf("%s: rolling back container %s from %s to %s", resource, container, image, previous[container])
+	}
+	if dryRun {
+		return nil
+	}
+	return c.updateWorkload(kind, meta.Namespace, meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+		previous, err := loadPreviousImages(meta)
+		if err != nil {
+			return err
+		}
+		replaced := restorePreviousImages(template, previous)
+		for _, image := range replaced {
+			addRolledBackImage(meta, image)
+		}
+		if err := storePinnedImages(meta, template); err != nil {
+			return err
+		}
+		return storePreviousImages(meta, replaced)
+	})
+}
+
+func rollbackCommand(args []string) {
+	var selection selectionFlags
+	var dryRun bool
+	flags := newCommandFlags("rollback", &selection)
+	flags.BoolVar(&dryRun, "dry-run", false, "only show images that would be restored (default false)")
+	usage := flags.Usage
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s rollback <kind>/<name> [flags]\n", os.Args[0])
+		usage()
+	}
+	// allow flags after the workload reference
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+	ref := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		exit(exitConfigError, err)
+	}
+	if flags.NArg() > 0 {
+		exit(exitConfigError, fmt.Errorf("unexpected arguments %s", strings.Join(flags.Args(), " ")))
+	}
+	kind, name, err := parseWorkloadRef(ref)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	selection.fieldSelector = "metadata.name=" + name
+	report := NewReport()
+	found := false
+	forEachWorkload(&selection, report, func(c *Config, w workload) error {
+		if w.kind != kind {
+			return nil
+		}
+		found = true
+		return c.rollbackWorkload(w.kind, w.meta, w.template, dryRun)
+	})
+	if !found && report.ExitCode() == exitOK {
+		report.AddError(configErrorClass, fmt.Errorf("%s %s not found", kind, name))
+	}
+	finish(report)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// imagoRolledBackAnnotation list images rolled back after their rollout
+// didn't become healthy, workloads aren't updated to them again
+const imagoRolledBackAnnotation = "imago/rolled-back"
+
+// maxRolledBackImages bound the number of images kept in
+// imagoRolledBackAnnotation
+const maxRolledBackImages = 10
+
+// rolloutWatch wait for the rollout of each updated workload to become
+// healthy before updating the next one
+type rolloutWatch struct {
+	timeout time.Duration
+	// maxUnhealthy is the number of rollouts not becoming healthy after
+	// which remaining updates are held, 0 for no limit
+	maxUnhealthy int
+	unhealthy    int
+	// rollback restore previous images of workloads whose rollout didn't
+	// become healthy
+	rollback bool
+}
+
+// admitRollout return why no more workload can be updated in the run, or an
+// empty string
+func (c *Config) admitRollout() string {
+	if c.run == nil || c.run.rollout == nil {
+		return ""
+	}
+	w := c.run.rollout
+	if w.maxUnhealthy > 0 && w.unhealthy >= w.maxUnhealthy {
+		return fmt.Sprintf("-max-unhealthy reached, %d rollouts didn't become healthy", w.unhealthy)
+	}
+	return ""
+}
+
+// waitRollout wait for the rollout of given updated workload to become
+// healthy, CronJobs aren't waited for
+func (c *Config) waitRollout(kind string, meta *metav1.ObjectMeta) error {
+	if c.run == nil || c.run.rollout == nil || kind == "CronJob" {
+		return nil
+	}
+	w := c.run.rollout
+	log.Printf("waiting for rollout of %s/%s/%s", meta.Namespace, kind, meta.Name)
+	err := wait.PollImmediate(5*time.Second, w.timeout, func() (bool, error) {
+		return c.workloadHealthy(kind, meta.Namespace, meta.Name)
+	})
+	if err != nil {
+		w.unhealthy++
+		return fmt.Errorf("rollout of %s/%s/%s didn't become healthy: %w", meta.Namespace, kind, meta.Name, err)
+	}
+	return nil
+}
+
+// rollback restore images the update replaced after its rollout didn't
+// become healthy, recording new images in imagoRolledBackAnnotation.
+// Restarts can't be rolled back.
+func (p *pendingUpdate) rollback() error {
+	c := p.c
+	if c.policy != "update" {
+		return fmt.Errorf("unable to roll back %s", c.policy)
+	}
+	log.Printf("rolling back %s", p.resource())
+	return c.updateWorkload(p.kind, p.meta.Namespace, p.meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+		restore := func(containers []v1.Container, update map[string]containerUpdate) {
+			for i, container := range containers {
+				if u, ok := update[container.Name]; ok {
+					containers[i].Image = u.current
+					addRolledBackImage(meta, u.image)
+				}
+			}
+		}
+		restore(template.Spec.Containers, p.containers)
+		restore(template.Spec.InitContainers, p.initContainers)
+		return storePinnedImages(meta, template)
+	})
+}
+
+// addRolledBackImage record given image in imagoRolledBackAnnotation,
+// keeping the last maxRolledBackImages images
+func addRolledBackImage(meta *metav1.ObjectMeta, image string) {
+	images := append(rolledBackImages(meta), image)
+	if len(images) > maxRolledBackImages {
+		images = images[len(images)-maxRolledBackImages:]
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[imagoRolledBackAnnotation] = strings.Join(images, ",")
+}
+
+// rolledBackImages return images listed in imagoRolledBackAnnotation of
+// given workload
+func rolledBackImages(meta *metav1.ObjectMeta) []string {
+	value := meta.Annotations[imagoRolledBackAnnotation]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// skipRolledBack remove updates to images rolled back from given workload
+func (c *Config) skipRolledBack(meta *metav1.ObjectMeta, updates map[string]containerUpdate) {
+	images := rolledBackImages(meta)
+	for name, u := range updates {
+		for _, image := range images {
+			if image == u.image {
+				log.Printf("    %s update skipped: %s was rolled back", name, u.image)
+				c.explainf(name, "no update: %s was rolled back, see the %s annotation", u.image, imagoRolledBackAnnotation)
+				delete(updates, name)
+				break
+			}
+		}
+	}
+}
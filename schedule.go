@@ -0,0 +1,113 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagoIntervalAnnotation on a namespace is the minimum time between checks
+// of its workloads in -daemon mode, and the default interval of its
+// ImagoPolicies
+const imagoIntervalAnnotation = "imago/interval"
+
+// getNamespace return given namespace, cached until resetCaches, or nil if
+// it can't be read (e.g. imago isn't allowed to), annotations of namespaces
+// are then ignored
+func (c *Config) getNamespace(namespace string) *v1.Namespace {
+	if ns, ok := c.namespaceCache[namespace]; ok {
+		return ns
+	}
+	var ns *v1.Namespace
+	err := retryTransient(func() (err error) {
+		ns, err = c.cluster.CoreV1().Namespaces().Get(c.context, namespace, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("unable to get namespace %s, its annotations are ignored: %s", namespace, err)
+		}
+		ns = nil
+	}
+	if c.namespaceCache == nil {
+		c.namespaceCache = make(map[string]*v1.Namespace)
+	}
+	c.namespaceCache[namespace] = ns
+	return ns
+}
+
+// namespaceInterval return the imagoIntervalAnnotation of given namespace,
+// 0 when it has none
+func (c *Config) namespaceInterval(namespace string) (time.Duration, error) {
+	ns := c.getNamespace(namespace)
+	if ns == nil || ns.Annotations[imagoIntervalAnnotation] == "" {
+		return 0, nil
+	}
+	value := ns.Annotations[imagoIntervalAnnotation]
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("namespace %s: invalid %s annotation %q, expected a positive duration", namespace, imagoIntervalAnnotation, value)
+	}
+	return interval, nil
+}
+
+// namespaceSchedule skip namespaces checked less than their
+// imagoIntervalAnnotation ago, in -daemon mode. Namespaces without
+// annotation are checked on every run.
+type namespaceSchedule struct {
+	lastChecked map[string]time.Time
+	// started is the start time of the current run and due whether
+	// namespaces are checked by it
+	started time.Time
+	due     map[string]bool
+}
+
+func newNamespaceSchedule() *namespaceSchedule {
+	return &namespaceSchedule{lastChecked: make(map[string]time.Time)}
+}
+
+// start begin a run at given time
+func (s *namespaceSchedule) start(now time.Time) {
+	s.started = now
+	s.due = make(map[string]bool)
+}
+
+// checks tell whether workloads of given namespace are checked by the
+// current run, recording the check
+func (s *namespaceSchedule) checks(c *Config, namespace string) bool {
+	if due, ok := s.due[namespace]; ok {
+		return due
+	}
+	interval, err := c.namespaceInterval(namespace)
+	if err != nil {
+		log.Print(err)
+		c.report.AddError(configErrorClass, err)
+	}
+	last, ok := s.lastChecked[namespace]
+	due := !ok || !s.started.Before(last.Add(interval))
+	if due {
+		s.lastChecked[namespace] = s.started
+	} else {
+		log.Printf("namespace %s checked at %s, next check after %s", namespace, last.Format(time.RFC3339), last.Add(interval).Format(time.RFC3339))
+	}
+	s.due[namespace] = due
+	return due
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// semverChannelPrefix introduce channels defined by a version range, like
+// "semver:^1.4", in -channel rules and imago/channel annotations
+const semverChannelPrefix = "semver:"
+
+// semverBound is a comparison with a version, like >=1.4.0
+type semverBound struct {
+	op string
+	v  *semver
+}
+
+func (b semverBound) match(v *semver) bool {
+	cmp := v.compare(b.v)
+	switch b.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return cmp == 0
+}
+
+// parseSemverRange parse space separated constraints which all have to
+// match: ^1.4 (>=1.4.0 <2.0.0), ~1.4 (>=1.4.0 <1.5.0), comparisons like
+// >=1.2 or <2 and exact versions
+func parseSemverRange(expr string) ([]semverBound, error) {
+	bounds := make([]semverBound, 0)
+	for _, constraint := range strings.Fields(expr) {
+		op := ""
+		for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+			if strings.HasPrefix(constraint, prefix) {
+				op = prefix
+				break
+			}
+		}
+		match := semverRe.FindStringSubmatch(strings.TrimPrefix(constraint, op))
+		if match == nil || match[4] != "" {
+			return nil, fmt.Errorf("invalid version constraint %s", constraint)
+		}
+		v, _ := parseSemver(strings.TrimPrefix(constraint, op))
+		switch op {
+		case "^", "~":
+			upper := &semver{major: v.major + 1}
+			switch {
+			case op == "~" && match[2] != "":
+				upper = &semver{major: v.major, minor: v.minor + 1}
+			case op == "^" && v.major == 0 && match[2] != "" && (v.minor > 0 || match[3] == ""):
+				upper = &semver{minor: v.minor + 1}
+			case op == "^" && v.major == 0 && match[3] != "":
+				upper = &semver{patch: v.patch + 1}
+			}
+			bounds = append(bounds, semverBound{">=", v}, semverBound{"<", upper})
+		case "", "=":
+			bounds = append(bounds, semverBound{"=", v})
+		default:
+			bounds = append(bounds, semverBound{op, v})
+		}
+	}
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("empty version constraint")
+	}
+	return bounds, nil
+}
+
+// parseSemverChannel return a channel tracking the highest version in given
+// range
+func parseSemverChannel(name string, expr string) (*channel, error) {
+	bounds, err := parseSemverRange(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel %s: %w", name, err)
+	}
+	return &channel{name: name, rule: semverChannelPrefix + expr, bounds: bounds}, nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// digestSkew is an image tag running different digests in different
+// workloads
+type digestSkew struct {
+	Image        string `json:"image"`
+	LatestDigest string `json:"latestDigest"`
+	// Digests map each current digest to namespaces running it
+	Digests map[string][]string `json:"digests"`
+}
+
+func (s *digestSkew) String() string {
+	digests := make([]string, 0, len(s.Digests))
+	for digest := range s.Digests {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+	parts := make([]string, 0, len(digests))
+	for _, digest := range digests {
+		part := fmt.Sprintf("%s in %s", digest, strings.Join(s.Digests[digest], ", "))
+		if digest == s.LatestDigest {
+			part += " (latest)"
+		}
+		parts = append(parts, part)
+	}
+	return fmt.Sprintf("%s runs %d different digests: %s", s.Image, len(s.Digests), strings.Join(parts, "; "))
+}
+
+// digestSkews return image tags running different digests across checked
+// workloads, only containers of known current digest are considered
+func (r *Report) digestSkews() []*digestSkew {
+	index := make(map[string]*digestSkew)
+	namespaces := make(map[string]map[string]map[string]bool)
+	for _, t := range r.tracked {
+		if t.currentDigest == "" {
+			continue
+		}
+		repository, tag, err := tagOf(t.source)
+		if err != nil {
+			continue
+		}
+		image := repository.String() + ":" + tag
+		s, ok := index[image]
+		if !ok {
+			s = &digestSkew{Image: image, LatestDigest: t.latestDigest, Digests: make(map[string][]string)}
+			index[image] = s
+			namespaces[image] = make(map[string]map[string]bool)
+		}
+		namespace := strings.SplitN(t.resource, "/", 2)[0]
+		if namespaces[image][t.currentDigest] == nil {
+			namespaces[image][t.currentDigest] = make(map[string]bool)
+		}
+		if !namespaces[image][t.currentDigest][namespace] {
+			namespaces[image][t.currentDigest][namespace] = true
+			s.Digests[t.currentDigest] = append(s.Digests[t.currentDigest], namespace)
+		}
+	}
+	skews := make([]*digestSkew, 0)
+	for _, s := range index {
+		if len(s.Digests) < 2 {
+			continue
+		}
+		for _, ns := range s.Digests {
+			sort.Strings(ns)
+		}
+		skews = append(skews, s)
+	}
+	sort.Slice(skews, func(i, j int) bool {
+		return skews[i].Image < skews[j].Image
+	})
+	return skews
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagoSlackChannelAnnotation route Slack summaries of workloads of the
+// annotated namespace to given channel
+const imagoSlackChannelAnnotation = "imago/slack-channel"
+
+// maxSlackLines bound the number of workloads listed per section of a Slack
+// summary
+const maxSlackLines = 20
+
+// slackNotifier post a summary of each run to a Slack incoming webhook
+type slackNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func newSlackNotifier(webhookURL string) (*slackNotifier, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported Slack webhook URL %s, expected https://hooks.slack.com/services/...", webhookURL)
+	}
+	return &slackNotifier{client: &http.Client{Timeout: 10 * time.Second}, url: webhookURL}, nil
+}
+
+// slackSummary is the summary of a run posted to a Slack channel, the
+// default channel of the webhook when channel is empty
+type slackSummary struct {
+	channel string
+	updated []string
+	skipped []string
+	failed  []string
+}
+
+// digestChange describe the digest change of an update, e.g.
+// nginx:1.25 4a1b7c2d9e0f → 9f8e7d6c5b4a
+func digestChange(previous string, image string) string {
+	digestOf := func(image string) string {
+		if i := strings.Index(image, "@"); i != -1 {
+			return image[i+1:]
+		}
+		return ""
+	}
+	name := image
+	if i := strings.Index(name, "@"); i != -1 {
+		name = name[:i]
+	}
+	return fmt.Sprintf("%s `%s` → `%s`", name, shortDigest(digestOf(previous)), shortDigest(digestOf(image)))
+}
+
+// text render the summary as Slack mrkdwn
+func (s *slackSummary) text(cluster string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*imago run on %s*: %d updated, %d skipped, %d failed\n", cluster, len(s.updated), len(s.skipped), len(s.failed))
+	section := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n*%s*\n", title)
+		for i, line := range lines {
+			if i == maxSlackLines {
+				fmt.Fprintf(&b, "• and %d more\n", len(lines)-maxSlackLines)
+				break
+			}
+			fmt.Fprintf(&b, "• %s\n", line)
+		}
+	}
+	section("Updated", s.updated)
+	section("Skipped", s.skipped)
+	section("Failed", s.failed)
+	return b.String()
+}
+
+// namespaceChannel return the Slack channel of given namespace from its
+// imagoSlackChannelAnnotation, empty for the default channel
+func (c *Config) namespaceChannel(namespace string, channels map[string]string) string {
+	channel, ok := channels[namespace]
+	if ok {
+		return channel
+	}
+	ns, err := c.cluster.CoreV1().Namespaces().Get(c.context, namespace, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("unable to get Slack channel of namespace %s: %s", namespace, err)
+	} else {
+		channel = ns.Annotations[imagoSlackChannelAnnotation]
+	}
+	channels[namespace] = channel
+	return channel
+}
+
+// notify post a summary of updated, skipped and failed workloads of the run
+// to the channel of their namespace, nothing is posted when nothing
+// happened
+func (s *slackNotifier) notify(c *Config, report *Report) error {
+	channels := make(map[string]string)
+	summaries := make(map[string]*slackSummary)
+	summary := func(namespace string) *slackSummary {
+		channel := c.namespaceChannel(namespace, channels)
+		if summaries[channel] == nil {
+			summaries[channel] = &slackSummary{channel: channel}
+		}
+		return summaries[channel]
+	}
+	for _, e := range report.events {
+		line := fmt.Sprintf("`%s/%s/%s` %s: %s", e.Namespace, e.Kind, e.Name, e.Container, digestChange(e.Previous, e.Image))
+		switch {
+		case e.Type == eventApplied:
+			summary(e.Namespace).updated = append(summary(e.Namespace).updated, line)
+		case e.Type == eventFailed:
+			summary(e.Namespace).failed = append(summary(e.Namespace).failed, line+": "+e.Error)
+		case e.Policy != "":
+			summary(e.Namespace).skipped = append(summary(e.Namespace).skipped, line)
+		}
+	}
+	for _, f := range report.failures {
+		namespace := strings.SplitN(f.resource, "/", 2)[0]
+		summary(namespace).failed = append(summary(namespace).failed, f.err)
+	}
+	names := make([]string, 0, len(summaries))
+	for name := range summaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failed := make([]string, 0)
+	for _, name := range names {
+		if err := s.post(summaries[name], report.cluster); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// post given summary to the webhook
+func (s *slackNotifier) post(summary *slackSummary, cluster string) error {
+	message := map[string]string{"text": summary.text(cluster)}
+	if summary.channel != "" {
+		message["channel"] = summary.channel
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imago")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	closeResource(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response from Slack: %s", resp.Status)
+	}
+	return nil
+}
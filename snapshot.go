@@ -0,0 +1,209 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// snapshot record images of workloads at a point in time
+type snapshot struct {
+	Created   time.Time          `json:"created"`
+	Workloads []snapshotWorkload `json:"workloads"`
+}
+
+type snapshotWorkload struct {
+	Namespace      string              `json:"namespace"`
+	Kind           string              `json:"kind"`
+	Name           string              `json:"name"`
+	InitContainers []snapshotContainer `json:"initContainers,omitempty"`
+	Containers     []snapshotContainer `json:"containers"`
+}
+
+// snapshotContainer is the spec image of a container and the digest it
+// resolved to, empty when unknown
+type snapshotContainer struct {
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// snapshotContainers record digests of given containers, from pinned spec
+// images or running pods
+func snapshotContainers(resource string, containers []v1.Container, running map[string]map[string]string) []snapshotContainer {
+	result := make([]snapshotContainer, 0, len(containers))
+	for _, container := range containers {
+		digest := currentDigest(container.Image, running[container.Name])
+		if digest == "" {
+			log.Printf("%s: digest of container %s is unknown, no pod is running", resource, container.Name)
+		}
+		result = append(result, snapshotContainer{container.Name, container.Image, digest})
+	}
+	return result
+}
+
+func snapshotCommand(args []string) {
+	var selection selectionFlags
+	var output string
+	flags := newCommandFlags("snapshot", &selection)
+	flags.StringVar(&output, "o", "imago-snapshot.json", "snapshot file to write")
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	report := NewReport()
+	s := &snapshot{Created: time.Now().UTC(), Workloads: make([]snapshotWorkload, 0)}
+	forEachWorkload(&selection, report, func(c *Config, w workload) error {
+		resource := fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)
+		c.checkpods = true
+		runningInitContainers, runningContainers, err := c.getRunningContainers(w.kind, w.meta, w.template)
+		if err != nil {
+			return err
+		}
+		s.Workloads = append(s.Workloads, snapshotWorkload{
+			Namespace:      w.meta.Namespace,
+			Kind:           w.kind,
+			Name:           w.meta.Name,
+			InitContainers: snapshotContainers(resource, w.template.Spec.InitContainers, runningInitContainers),
+			Containers:     snapshotContainers(resource, w.template.Spec.Containers, runningContainers),
+		})
+		return nil
+	})
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		exit(exitError, err)
+	}
+	if err := ioutil.WriteFile(output, append(data, '\n'), 0644); err != nil {
+		exit(exitError, err)
+	}
+	log.Printf("wrote snapshot of %d workloads to %s", len(s.Workloads), output)
+	finish(report)
+}
+
+// restoreImages return images to set on given containers to restore them to
+// the snapshot, indexed by container name
+func restoreImages(resource string, containers []v1.Container, snapshot []snapshotContainer) (map[string]string, error) {
+	images := make(map[string]string)
+	for _, container := range containers {
+		for _, s := range snapshot {
+			if s.Name != container.Name {
+				continue
+			}
+			if s.Digest == "" {
+				log.Printf("%s: digest of container %s is unknown in snapshot, not restoring it", resource, container.Name)
+				break
+			}
+			ref, err := reference.ParseNormalizedNamed(s.Image)
+			if err != nil {
+				return nil, err
+			}
+			image := reference.FamiliarName(ref) + "@" + s.Digest
+			if image != container.Image {
+				log.Printf("%s: restoring container %s from %s to %s", resource, container.Name, container.Image, image)
+				images[container.Name] = image
+			}
+		}
+	}
+	return images, nil
+}
+
+func restoreCommand(args []string) {
+	var selection selectionFlags
+	var dryRun bool
+	flags := newCommandFlags("restore", &selection)
+	flags.BoolVar(&dryRun, "dry-run", false, "only show images that would be restored (default false)")
+	usage := flags.Usage
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s restore <snapshot> [flags]\n", os.Args[0])
+		usage()
+	}
+	// allow flags after the snapshot file
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+	path := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		exit(exitConfigError, err)
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	s := &snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		exit(exitConfigError, fmt.Errorf("invalid snapshot %s: %w", path, err))
+	}
+	snapshots := make(map[string]*snapshotWorkload, len(s.Workloads))
+	for i, w := range s.Workloads {
+		snapshots[fmt.Sprintf("%s/%s/%s", w.Namespace, w.Kind, w.Name)] = &s.Workloads[i]
+	}
+	report := NewReport()
+	forEachWorkload(&selection, report, func(c *Config, w workload) error {
+		resource := fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)
+		snapshot, ok := snapshots[resource]
+		if !ok {
+			log.Printf("%s: not in snapshot", resource)
+			return nil
+		}
+		initImages, err := restoreImages(resource, w.template.Spec.InitContainers, snapshot.InitContainers)
+		if err != nil {
+			return err
+		}
+		images, err := restoreImages(resource, w.template.Spec.Containers, snapshot.Containers)
+		if err != nil {
+			return err
+		}
+		if dryRun || (len(initImages) == 0 && len(images) == 0) {
+			return nil
+		}
+		return c.updateWorkload(w.kind, w.meta.Namespace, w.meta.Name, func(meta *metav1.ObjectMeta, template *v1.PodTemplateSpec) error {
+			// keep track of tags of containers pinned by the restore
+			config, err := c.getConfigAnnotation(meta, &template.Spec)
+			if err != nil {
+				return err
+			}
+			if err := c.storeConfigAnnotation(w.kind, meta, config); err != nil {
+				return err
+			}
+			restore := func(containers []v1.Container, images map[string]string) {
+				for i, container := range containers {
+					if image, ok := images[container.Name]; ok {
+						containers[i].Image = image
+					}
+				}
+			}
+			restore(template.Spec.InitContainers, initImages)
+			restore(template.Spec.Containers, images)
+			return nil
+		})
+	})
+	finish(report)
+}
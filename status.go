@@ -0,0 +1,172 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// containerStatus is the status of a container shown by the status command
+type containerStatus struct {
+	Workload  string `json:"workload"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	// Pinned is set when the spec image has a digest
+	Pinned bool `json:"pinned"`
+	// Tag is the image the container follows, pins are derived from it
+	Tag           string    `json:"tag"`
+	CurrentDigest string    `json:"currentDigest,omitempty"`
+	LatestDigest  string    `json:"latestDigest,omitempty"`
+	UpToDate      bool      `json:"upToDate"`
+	Checked       time.Time `json:"checked"`
+}
+
+// workloadStatus check given workload and return the status of its
+// containers, nothing is modified
+func (c *Config) workloadStatus(w workload) ([]containerStatus, error) {
+	resource := fmt.Sprintf("%s/%s/%s", w.meta.Namespace, w.kind, w.meta.Name)
+	config, err := c.getConfigAnnotation(w.meta, &w.template.Spec)
+	if err != nil {
+		return nil, err
+	}
+	checked := time.Now().UTC()
+	start := len(c.report.tracked)
+	if err := c.process(w.kind, w.meta, w.template); err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]trackedImage)
+	for _, t := range c.report.tracked[start:] {
+		tracked[t.container] = t
+	}
+	statuses := make([]containerStatus, 0)
+	add := func(containers []v1.Container, entries []configAnnotationImageSpec) {
+		for _, container := range containers {
+			s := containerStatus{
+				Workload:  resource,
+				Container: container.Name,
+				Image:     container.Image,
+				Pinned:    strings.Contains(container.Image, "@"),
+				Checked:   checked,
+			}
+			for _, entry := range entries {
+				if entry.Name == container.Name {
+					s.Tag = entry.Image
+				}
+			}
+			if t, ok := tracked[container.Name]; ok {
+				s.Tag = t.source
+				s.CurrentDigest, s.LatestDigest = t.currentDigest, t.latestDigest
+				s.UpToDate = t.currentDigest == t.latestDigest
+			}
+			statuses = append(statuses, s)
+		}
+	}
+	add(w.template.Spec.InitContainers, config.InitContainers)
+	add(w.template.Spec.Containers, config.Containers)
+	return statuses, nil
+}
+
+// shortDigest return the first 12 hexadecimal characters of given digest
+func shortDigest(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	if digest == "" {
+		return "-"
+	}
+	return digest
+}
+
+// writeStatusTable write given statuses as an aligned table
+func writeStatusTable(out io.Writer, statuses []containerStatus) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKLOAD\tCONTAINER\tPINNED\tTAG\tCURRENT\tLATEST\tUP TO DATE\tCHECKED")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\t%t\t%s\n", s.Workload, s.Container, s.Pinned, s.Tag, shortDigest(s.CurrentDigest), shortDigest(s.LatestDigest), s.UpToDate, s.Checked.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func statusCommand(args []string) {
+	var selection selectionFlags
+	var registry registryFlags
+	var policies policyFlags
+	var checkpods bool
+	var output string
+	flags := newCommandFlags("status", &selection)
+	flags.BoolVar(&checkpods, "check-pods", false, "compare with image digests of running pods (default false)")
+	flags.StringVar(&output, "output", "table", "output format: table or json")
+	flags.StringVar(&output, "o", "table", "output format (shorthand)")
+	registry.register(flags)
+	policies.register(flags)
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	if output != "table" && output != "json" {
+		exit(exitConfigError, fmt.Errorf("unsupported output format %s, expected table or json", output))
+	}
+	report := NewReport()
+	configs, err := selection.configs("", checkpods, report)
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	if _, err := registry.setup(configs); err != nil {
+		exit(exitConfigError, err)
+	}
+	if err := policies.setup(configs); err != nil {
+		exit(exitConfigError, err)
+	}
+	statuses := make([]containerStatus, 0)
+	for _, c := range configs {
+		workloads, listErrors := c.listWorkloads(selection.fieldSelector, selection.labelSelector)
+		for _, err := range listErrors {
+			report.AddError(classifyError(err), err)
+		}
+		c.precheckRegistries(workloads)
+		prioritized := make([]prioritizedWorkload, 0, len(workloads))
+		for _, w := range workloads {
+			prioritized = append(prioritized, prioritizedWorkload{c, w, 0})
+		}
+		prefetchDigests(prioritized, c.concurrency)
+		for _, w := range workloads {
+			s, err := c.workloadStatus(w)
+			if err != nil {
+				err = fmt.Errorf("%s/%s/%s: %w", w.meta.Namespace, w.kind, w.meta.Name, err)
+				report.AddError(classifyError(err), err)
+				continue
+			}
+			statuses = append(statuses, s...)
+		}
+	}
+	if output == "json" {
+		data, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			exit(exitConfigError, err)
+		}
+		fmt.Println(string(data))
+	} else if err := writeStatusTable(os.Stdout, statuses); err != nil {
+		exit(exitConfigError, err)
+	}
+	finish(report)
+}
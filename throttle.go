@@ -0,0 +1,249 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxThrottleRetries is the number of times a throttled request is retried
+	maxThrottleRetries = 3
+	// maxRetryAfter bound the time we wait for a throttled request
+	maxRetryAfter = 2 * time.Minute
+	// maxRequestInterval bound the delay between two requests on a host
+	maxRequestInterval = 10 * time.Second
+	// maxServerErrorRetries is the number of times a GET request failing
+	// with a server error (500, 502 or 504) is retried
+	maxServerErrorRetries = 2
+	// rateLimitWarning is the share of the rate limit of a registry left
+	// under which we warn
+	rateLimitWarning = 0.1
+)
+
+// hostPacer space requests sent to a registry host, the interval grows each
+// time the host throttle us and is kept for the remainder of the run
+type hostPacer struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	next      time.Time
+	throttled int
+	// rateLimit and rateRemaining are the last rate limit reported by
+	// the host (e.g. Docker Hub pull limits), with its window
+	rateLimit     int
+	rateRemaining int
+	rateWindow    time.Duration
+	rateWarned    bool
+	// slots bound concurrent requests to the host
+	slots chan struct{}
+}
+
+func (p *hostPacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	now := time.Now()
+	start := p.next
+	if start.Before(now) {
+		start = now
+	}
+	p.next = start.Add(p.interval)
+	p.mu.Unlock()
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+func (p *hostPacer) slowDown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.throttled++
+	if p.interval == 0 {
+		p.interval = 100 * time.Millisecond
+	} else {
+		p.interval *= 2
+	}
+	if p.interval > maxRequestInterval {
+		p.interval = maxRequestInterval
+	}
+}
+
+// parseRetryAfter return the delay requested by a Retry-After header, in
+// seconds or HTTP-date format
+func parseRetryAfter(header string, fallback time.Duration) time.Duration {
+	if header == "" {
+		return fallback
+	}
+	delay := fallback
+	if seconds, err := strconv.Atoi(header); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = time.Until(date)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
+
+// parseRateLimit parse RateLimit-Limit and RateLimit-Remaining headers as
+// sent by Docker Hub, e.g. "100;w=21600"
+func parseRateLimit(header string) (int, time.Duration, bool) {
+	parts := strings.Split(header, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, param := range parts[1:] {
+		if seconds := strings.TrimPrefix(strings.TrimSpace(param), "w="); seconds != strings.TrimSpace(param) {
+			if s, err := strconv.Atoi(seconds); err == nil {
+				window = time.Duration(s) * time.Second
+			}
+		}
+	}
+	return n, window, true
+}
+
+// recordRateLimit keep the rate limit reported by a response and warn when
+// few requests are left
+func (p *hostPacer) recordRateLimit(host string, resp *http.Response) {
+	limit, window, ok := parseRateLimit(resp.Header.Get("RateLimit-Limit"))
+	if !ok {
+		return
+	}
+	remaining, _, ok := parseRateLimit(resp.Header.Get("RateLimit-Remaining"))
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rateLimit, p.rateRemaining, p.rateWindow = limit, remaining, window
+	if !p.rateWarned && float64(remaining) <= float64(limit)*rateLimitWarning {
+		p.rateWarned = true
+		log.Printf("    %s rate limit almost reached: %s", host, p.rateLimitString())
+	}
+}
+
+// rateLimitString describe the last rate limit reported by the host
+func (p *hostPacer) rateLimitString() string {
+	s := fmt.Sprintf("%d of %d requests left", p.rateRemaining, p.rateLimit)
+	if p.rateWindow > 0 {
+		s += fmt.Sprintf(" per %s", p.rateWindow)
+	}
+	return s
+}
+
+func (r *RegistryClient) getPacer(host string) *hostPacer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pacers[host] == nil {
+		r.pacers[host] = &hostPacer{slots: make(chan struct{}, maxRequestsPerRegistry)}
+	}
+	return r.pacers[host]
+}
+
+// send paces requests per host and retry throttled requests (429 or 503)
+// honoring the Retry-After header, GET requests failing with a server
+// error (500, 502 or 504) are retried with an exponential backoff
+func (r *RegistryClient) send(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	pacer := r.getPacer(req.URL.Host)
+	backoff := time.Second
+	serverErrors := 0
+	for attempt := 0; ; attempt++ {
+		if err := pacer.wait(ctx); err != nil {
+			return nil, err
+		}
+		select {
+		case pacer.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		resp, err := r.clientFor(req.URL.Host).Do(req.Clone(ctx))
+		<-pacer.slots
+		if err != nil {
+			return nil, err
+		}
+		pacer.recordRateLimit(req.URL.Host, resp)
+		var delay time.Duration
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			pacer.slowDown()
+			if attempt >= maxThrottleRetries {
+				return resp, nil
+			}
+			delay = parseRetryAfter(resp.Header.Get("Retry-After"), backoff)
+			log.Printf("    %s throttled by %s, retrying in %s", req.URL.Path, req.URL.Host, delay)
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+			if req.Method != http.MethodGet || serverErrors >= maxServerErrorRetries {
+				return resp, nil
+			}
+			serverErrors++
+			delay = backoff
+			log.Printf("    %s failed on %s: %s, retrying in %s", req.URL.Path, req.URL.Host, resp.Status, delay)
+		default:
+			return resp, nil
+		}
+		closeResource(resp.Body)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
+
+// ThrottlingSummary describe registries that throttled us during the run
+// and the rate limit left on registries reporting one
+func (r *RegistryClient) ThrottlingSummary() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts := make([]string, 0, len(r.pacers))
+	for host := range r.pacers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	summary := make([]string, 0)
+	for _, host := range hosts {
+		pacer := r.pacers[host]
+		pacer.mu.Lock()
+		if pacer.throttled > 0 {
+			summary = append(summary, fmt.Sprintf("%s throttled %d times, requests were spaced by %s", host, pacer.throttled, pacer.interval))
+		}
+		if pacer.rateLimit > 0 {
+			summary = append(summary, fmt.Sprintf("%s rate limit: %s", host, pacer.rateLimitString()))
+		}
+		pacer.mu.Unlock()
+	}
+	return summary
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// runReport is the machine readable report of a run
+type runReport struct {
+	Run          string        `json:"run"`
+	Cluster      string        `json:"cluster"`
+	Started      time.Time     `json:"started"`
+	Finished     time.Time     `json:"finished"`
+	ExitCode     int           `json:"exitCode"`
+	Errors       []reportError `json:"errors"`
+	Outdated     []reportImage `json:"outdated"`
+	Dependencies []*dependency `json:"dependencies"`
+	Skews        []*digestSkew `json:"skews"`
+}
+
+type reportError struct {
+	Class   string `json:"class"`
+	Message string `json:"message"`
+}
+
+type reportImage struct {
+	Workload  string `json:"workload"`
+	Container string `json:"container"`
+	Current   string `json:"current"`
+	Image     string `json:"image"`
+	Details   string `json:"details"`
+}
+
+// newRunID return a unique identifier of the run, sortable by date
+func newRunID(started time.Time) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return started.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// runReport return the machine readable report of the run
+func (r *Report) runReport() *runReport {
+	report := &runReport{
+		Run:          r.run,
+		Cluster:      r.cluster,
+		Started:      r.started,
+		Finished:     time.Now().UTC(),
+		ExitCode:     r.ExitCode(),
+		Errors:       make([]reportError, 0),
+		Outdated:     make([]reportImage, 0),
+		Dependencies: r.dependencies(),
+		Skews:        r.digestSkews(),
+	}
+	for _, c := range errorClasses {
+		for _, err := range r.errors[c.class] {
+			report.Errors = append(report.Errors, reportError{c.class, err})
+		}
+	}
+	for _, o := range r.outdated {
+		report.Outdated = append(report.Outdated, reportImage{o.resource, o.container, o.current, o.image, o.details()})
+	}
+	return report
+}
+
+// uploadKey expand {cluster}, {date}, {time} and {run} in given template
+func (r *Report) uploadKey(template string) string {
+	return strings.NewReplacer(
+		"{cluster}", r.cluster,
+		"{date}", r.started.UTC().Format("2006-01-02"),
+		"{time}", r.started.UTC().Format("150405"),
+		"{run}", r.run,
+	).Replace(template)
+}
+
+// upload store the run report to given destination: s3://bucket/key,
+// gs://bucket/key or an http(s) URL receiving a PUT (e.g. an Azure Blob
+// container URL with a SAS token)
+func (r *Report) upload(ctx context.Context, destination string) error {
+	data, err := json.MarshalIndent(r.runReport(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.uploadObject(ctx, destination, data, "application/json")
+}
+
+// auditEntry is a line of the audit log, an update found, applied or
+// failed during the run
+type auditEntry struct {
+	Run     string `json:"run"`
+	Cluster string `json:"cluster"`
+	*updateEvent
+}
+
+// auditLog return updates of the run as JSON lines
+func (r *Report) auditLog() ([]byte, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	for _, e := range r.events {
+		if err := encoder.Encode(auditEntry{r.run, r.cluster, e}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// uploadAuditLog store the audit log of the run to given destination, as
+// the run report
+func (r *Report) uploadAuditLog(ctx context.Context, destination string) error {
+	data, err := r.auditLog()
+	if err != nil {
+		return err
+	}
+	return r.uploadObject(ctx, destination, data, "application/x-ndjson")
+}
+
+// uploadObject store data to given destination, after expanding
+// placeholders of uploadKey
+func (r *Report) uploadObject(ctx context.Context, destination string, data []byte, contentType string) error {
+	destination = r.uploadKey(destination)
+	u, err := url.Parse(destination)
+	if err != nil {
+		return err
+	}
+	var req *http.Request
+	switch u.Scheme {
+	case "s3":
+		req, err = newS3PutRequest(ctx, u.Host, strings.TrimPrefix(u.Path, "/"), data, contentType)
+	case "gs":
+		req, err = newGCSPutRequest(ctx, u.Host, strings.TrimPrefix(u.Path, "/"), data, contentType)
+	case "http", "https":
+		req, err = newUploadRequest(ctx, http.MethodPut, destination, data, contentType)
+		if err == nil && strings.HasSuffix(u.Hostname(), ".blob.core.windows.net") {
+			req.Header.Set("x-ms-blob-type", "BlockBlob")
+		}
+	default:
+		return fmt.Errorf("unsupported report destination %s, expected s3://, gs:// or https://", destination)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return err
+	}
+	closeResource(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response from %s: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// newUploadRequest return a request uploading data of given content type,
+// headers of the request are set before it is signed
+func newUploadRequest(ctx context.Context, method string, u string, data []byte, contentType string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "imago")
+	return req, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// newS3PutRequest return a PUT object request signed with AWS signature
+// version 4, using credentials and region from environment variables (see
+// awsEnvCredentials). With AWS_ENDPOINT_URL_S3 (e.g. MinIO), objects are
+// addressed path-style.
+func newS3PutRequest(ctx context.Context, bucket string, key string, data []byte, contentType string) (*http.Request, error) {
+	creds, err := awsEnvCredentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to upload to S3: %w", err)
+	}
+	region := awsRegion()
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, region)
+	if custom := os.Getenv("AWS_ENDPOINT_URL_S3"); custom != "" {
+		endpoint = strings.TrimSuffix(custom, "/") + "/" + bucket + "/"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path += key
+	req, err := newUploadRequest(ctx, http.MethodPut, u.String(), data, contentType)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(data))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signAWSv4(req, creds, region, "s3", payloadHash, time.Now())
+	return req, nil
+}
+
+// gceMetadataTokenURL is the URL of access tokens of the default service
+// account on GCE and GKE (with workload identity)
+const gceMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// googleAccessToken return an OAuth2 access token from
+// GOOGLE_OAUTH_ACCESS_TOKEN or the GCE metadata server. Other Application
+// Default Credentials, such as service account key files of
+// GOOGLE_APPLICATION_CREDENTIALS, aren't supported.
+func googleAccessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gceMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to get access token from metadata server: %s", err)
+	}
+	defer closeResource(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get access token from metadata server: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// newGCSPutRequest return a media upload request of given object
+func newGCSPutRequest(ctx context.Context, bucket string, object string, data []byte, contentType string) (*http.Request, error) {
+	token, err := googleAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s", url.PathEscape(bucket), url.QueryEscape(object))
+	req, err := newUploadRequest(ctx, http.MethodPost, u, data, contentType)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
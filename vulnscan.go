@@ -0,0 +1,177 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// Scanners of -vuln-scanner
+const (
+	scannerHarbor = "harbor"
+	scannerQuay   = "quay"
+)
+
+// severities in increasing order
+var severities = []string{"unknown", "negligible", "low", "medium", "high", "critical"}
+
+// parseSeverity return the rank of given severity in severities
+func parseSeverity(severity string) (int, error) {
+	for i, s := range severities {
+		if strings.EqualFold(s, severity) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid severity %s, expected one of %s", severity, strings.Join(severities, ", "))
+}
+
+// severityRank return the rank of a severity reported by a scanner, unknown
+// severities rank lowest
+func severityRank(severity string) int {
+	rank, _ := parseSeverity(severity)
+	return rank
+}
+
+// Vulnerabilities return vulnerabilities of the image of given digest found
+// by the scanner of given kind, which is the registry API itself, by id
+// with their severity
+func (r *RegistryClient) Vulnerabilities(ctx context.Context, scanner string, ref reference.Named, digest string, auth *DockerRegistryCredentials) (map[string]string, error) {
+	host, path := reference.Domain(ref), reference.Path(ref)
+	var u string
+	switch scanner {
+	case scannerHarbor:
+		parts := strings.SplitN(path, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s is not a harbor project repository", path)
+		}
+		// harbor expect slashes of repository names to be encoded twice
+		u = fmt.Sprintf("%s/api/v2.0/projects/%s/repositories/%s/artifacts/%s/additions/vulnerabilities", r.registryEndpoint(host), url.PathEscape(parts[0]), url.PathEscape(url.PathEscape(parts[1])), digest)
+	case scannerQuay:
+		u = fmt.Sprintf("%s/api/v1/repository/%s/manifest/%s/security?vulnerabilities=true", r.registryEndpoint(host), path, digest)
+	default:
+		return nil, fmt.Errorf("unknown scanner %s", scanner)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "imago")
+	req.Header.Set("Accept", "application/json")
+	if scanner == scannerHarbor {
+		req.Header.Set("X-Accept-Vulnerabilities", "application/vnd.security.vulnerability.report; version=1.1")
+		if auth != nil {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+	resp, err := r.send(req)
+	if err != nil {
+		return nil, &RequestError{Host: host, Image: path + "@" + digest, Err: err}
+	}
+	defer closeResource(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RequestError{Host: host, Image: path + "@" + digest, Status: resp.StatusCode}
+	}
+	body := io.LimitReader(resp.Body, 64*maxManifestSize)
+	vulnerabilities := make(map[string]string)
+	switch scanner {
+	case scannerHarbor:
+		var reports map[string]struct {
+			Vulnerabilities []struct {
+				ID       string `json:"id"`
+				Package  string `json:"package"`
+				Severity string `json:"severity"`
+			} `json:"vulnerabilities"`
+		}
+		if err := json.NewDecoder(body).Decode(&reports); err != nil {
+			return nil, err
+		}
+		if len(reports) == 0 {
+			return nil, fmt.Errorf("%s@%s has not been scanned", path, digest)
+		}
+		for _, report := range reports {
+			for _, v := range report.Vulnerabilities {
+				vulnerabilities[v.ID+" ("+v.Package+")"] = v.Severity
+			}
+		}
+	case scannerQuay:
+		var report struct {
+			Status string `json:"status"`
+			Data   struct {
+				Layer struct {
+					Features []struct {
+						Name            string `json:"Name"`
+						Vulnerabilities []struct {
+							Name     string `json:"Name"`
+							Severity string `json:"Severity"`
+						} `json:"Vulnerabilities"`
+					} `json:"Features"`
+				} `json:"Layer"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(body).Decode(&report); err != nil {
+			return nil, err
+		}
+		if report.Status != "scanned" {
+			return nil, fmt.Errorf("%s@%s has not been scanned (%s)", path, digest, report.Status)
+		}
+		for _, feature := range report.Data.Layer.Features {
+			for _, v := range feature.Vulnerabilities {
+				vulnerabilities[v.Name+" ("+feature.Name+")"] = v.Severity
+			}
+		}
+	}
+	return vulnerabilities, nil
+}
+
+// checkVulnerabilities return an error listing vulnerabilities of at least
+// -vuln-severity the image of given digest introduce, compared to the image
+// of current digest when known
+func (c *Config) checkVulnerabilities(scanner string, image string, current string, digest string, auth *DockerRegistryCredentials) error {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return err
+	}
+	ref := reference.TrimNamed(named)
+	found, err := c.reg.Vulnerabilities(c.context, scanner, ref, digest, auth)
+	if err != nil {
+		return fmt.Errorf("unable to get vulnerabilities: %w", err)
+	}
+	known := make(map[string]string)
+	if current != "" && current != digest {
+		if known, err = c.reg.Vulnerabilities(c.context, scanner, ref, current, auth); err != nil {
+			return fmt.Errorf("unable to get vulnerabilities of current image: %w", err)
+		}
+	}
+	introduced := make([]string, 0)
+	for id, severity := range found {
+		if _, ok := known[id]; !ok && severityRank(severity) >= c.vulnSeverity {
+			introduced = append(introduced, fmt.Sprintf("%s %s", strings.ToLower(severity), id))
+		}
+	}
+	if len(introduced) == 0 {
+		return nil
+	}
+	sort.Strings(introduced)
+	return fmt.Errorf("%d new vulnerabilities of severity %s or higher: %s", len(introduced), severities[c.vulnSeverity], strings.Join(introduced, ", "))
+}
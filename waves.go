@@ -0,0 +1,95 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// updateWave is a set of namespaces updated at once, rollouts of a wave
+// complete before updating namespaces of the next wave
+type updateWave struct {
+	size    int
+	timeout time.Duration
+	// namespaces of the current wave
+	namespaces map[string]bool
+	// workloads updated in the current wave
+	workloads []waveWorkload
+	// failed is set when rollouts of a wave didn't complete, no more
+	// namespace is updated
+	failed bool
+}
+
+type waveWorkload struct {
+	c         *Config
+	kind      string
+	namespace string
+	name      string
+}
+
+// admitWave return why workloads of given namespace can't be updated yet,
+// or an empty string. When the current wave is full, wait for its rollouts
+// to complete and start a new wave.
+func (c *Config) admitWave(namespace string) string {
+	if c.run == nil || c.run.wave == nil {
+		return ""
+	}
+	w := c.run.wave
+	if w.failed {
+		return "rollouts of a previous wave didn't complete"
+	}
+	if w.namespaces[namespace] || len(w.namespaces) < w.size {
+		w.namespaces[namespace] = true
+		return ""
+	}
+	namespaces := make([]string, 0, len(w.namespaces))
+	for ns := range w.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	log.Printf("waiting for rollouts of namespaces %s to complete", strings.Join(namespaces, ", "))
+	for _, workload := range w.workloads {
+		err := wait.PollImmediate(5*time.Second, w.timeout, func() (bool, error) {
+			return workload.c.workloadHealthy(workload.kind, workload.namespace, workload.name)
+		})
+		if err != nil {
+			w.failed = true
+			err = fmt.Errorf("rollout of %s/%s/%s didn't complete: %w", workload.namespace, workload.kind, workload.name, err)
+			log.Print(err)
+			c.report.AddError(classifyError(err), err)
+			return "rollouts of a previous wave didn't complete"
+		}
+	}
+	w.namespaces = map[string]bool{namespace: true}
+	w.workloads = nil
+	return ""
+}
+
+// addToWave record an updated workload, waited for before the next wave
+func (c *Config) addToWave(kind string, meta *metav1.ObjectMeta) {
+	if c.run == nil || c.run.wave == nil {
+		return
+	}
+	w := c.run.wave
+	w.namespaces[meta.Namespace] = true
+	w.workloads = append(w.workloads, waveWorkload{c, kind, meta.Namespace, meta.Name})
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2019 Philippe Pepiot <phil@philpep.org>
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// imagoAdmissionWarningAnnotation record why images of a workload admitted
+// unchanged weren't pinned
+const imagoAdmissionWarningAnnotation = "imago/admission-warning"
+
+// maxAdmissionReviewSize bound the size of admission requests
+const maxAdmissionReviewSize = 8 * 1024 * 1024
+
+// defaultAdmissionTimeout is the timeoutSeconds of webhooks when the API
+// server doesn't give the timeout of a request
+const defaultAdmissionTimeout = 10 * time.Second
+
+// jsonPatchOperation is an operation of a JSON patch (RFC 6902)
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// admissionWebhook pin images of workloads to their digest at admission
+type admissionWebhook struct {
+	c *Config
+	// failurePolicy is Fail to reject workloads having images which
+	// can't be resolved, with Ignore they're admitted unchanged with the
+	// imago/admission-warning annotation
+	failurePolicy admissionregistrationv1.FailurePolicyType
+	// namespaces, labelSelector and fieldSelector restrict admitted
+	// workloads, like workloads checked by imago
+	namespaces    arrayFlags
+	labelSelector labels.Selector
+	fieldSelector fields.Selector
+}
+
+// pullSecrets return credentials of image pull secrets of given pod spec
+// and of its service account, read again for each admission request
+// without going through the caches of c
+func (h *admissionWebhook) pullSecrets(ctx context.Context, namespace string, spec *v1.PodSpec) *dockerConfig {
+	client := h.c.cluster.CoreV1()
+	return readPullSecrets(namespace, spec, func(namespace string, name string) (*v1.ServiceAccount, error) {
+		return client.ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	}, func(namespace string, name string) (*v1.Secret, error) {
+		return client.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+// admissionContext return the context of an admission request, canceled
+// before the API server gives up on the webhook so that registry retries
+// don't outlive the request and the failure policy applies on time
+func admissionContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := defaultAdmissionTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			timeout = d
+		}
+	}
+	return context.WithTimeout(r.Context(), timeout*3/4)
+}
+
+// decodeWorkload return the kind, metadata, pod template and path of the
+// pod template of an admitted object, or an empty kind for other objects
+func decodeWorkload(kind string, raw []byte) (string, *metav1.ObjectMeta, *v1.PodTemplateSpec, string, error) {
+	switch kind {
+	case "Deployment":
+		var d appsv1.Deployment
+		err := json.Unmarshal(raw, &d)
+		return kind, &d.ObjectMeta, &d.Spec.Template, "/spec/template", err
+	case "DaemonSet":
+		var ds appsv1.DaemonSet
+		err := json.Unmarshal(raw, &ds)
+		return kind, &ds.ObjectMeta, &ds.Spec.Template, "/spec/template", err
+	case "StatefulSet":
+		var sts appsv1.StatefulSet
+		err := json.Unmarshal(raw, &sts)
+		return kind, &sts.ObjectMeta, &sts.Spec.Template, "/spec/template", err
+	case "CronJob":
+		var cron batchv1beta1.CronJob
+		err := json.Unmarshal(raw, &cron)
+		return kind, &cron.ObjectMeta, &cron.Spec.JobTemplate.Spec.Template, "/spec/jobTemplate/spec/template", err
+	}
+	return "", nil, nil, "", nil
+}
+
+// pinContainers resolve images of given containers which aren't pinned yet
+// and return patch operations pinning them
+func (h *admissionWebhook) pinContainers(ctx context.Context, resource string, path string, containers []v1.Container, pullSecrets *dockerConfig) ([]jsonPatchOperation, error) {
+	patch := make([]jsonPatchOperation, 0)
+	for i, container := range containers {
+		if strings.Contains(container.Image, "@") {
+			continue
+		}
+		auth, err := h.c.registryCredentials(container.Image, pullSecrets)
+		if err != nil {
+			return nil, fmt.Errorf("%s: unable to get registry credentials: %w", container.Name, err)
+		}
+		digest, err := h.c.resolveDigest(ctx, container.Image, auth, pullSecrets)
+		if err != nil {
+			return nil, fmt.Errorf("%s: unable to get digest of %s: %w", container.Name, container.Image, err)
+		}
+		image := h.c.pinImage(container.Image, container.Image, digest)
+		log.Printf("%s: pinning %s to %s", resource, container.Name, image)
+		patch = append(patch, jsonPatchOperation{"replace", fmt.Sprintf("%s/%d/image", path, i), image})
+	}
+	return patch, nil
+}
+
+// admit return the patch pinning images of an admitted workload and
+// recording their tags in the imago-config-spec annotation. Admission has
+// no side effects (the webhook is declared with sideEffects None and
+// dry-run requests are patched like others): when the imago-config-spec
+// doesn't fit in the annotation, the workload is admitted unchanged and
+// left to imago runs which store it in a ConfigMap owned by the workload.
+func (h *admissionWebhook) admit(ctx context.Context, req *admissionv1.AdmissionRequest) ([]jsonPatchOperation, error) {
+	kind, meta, template, templatePath, err := decodeWorkload(req.Kind.Kind, req.Object.Raw)
+	if err != nil || kind == "" {
+		return nil, err
+	}
+	if meta.Namespace == "" {
+		meta.Namespace = req.Namespace
+	}
+	if meta.Name == "" {
+		meta.Name = req.Name
+	}
+	if !h.selected(meta) {
+		return nil, nil
+	}
+	resource := fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name)
+	if req.DryRun != nil && *req.DryRun {
+		resource += " (dry run)"
+	}
+	patch, err := h.pin(ctx, resource, meta, template, templatePath)
+	if err != nil && h.failurePolicy != admissionregistrationv1.Fail {
+		log.Printf("%s: admitted unchanged: %s", resource, err)
+		annotations := copyAnnotations(meta)
+		annotations[imagoAdmissionWarningAnnotation] = err.Error()
+		return []jsonPatchOperation{{"add", "/metadata/annotations", annotations}}, nil
+	}
+	return patch, err
+}
+
+// selected return true if given workload is selected by -n, -x, -l and
+// --field-selector
+func (h *admissionWebhook) selected(meta *metav1.ObjectMeta) bool {
+	if h.c.xnamespace.Contains(meta.Namespace) {
+		return false
+	}
+	if len(h.namespaces) > 0 && !h.namespaces.Contains(meta.Namespace) {
+		return false
+	}
+	if h.labelSelector != nil && !h.labelSelector.Matches(labels.Set(meta.Labels)) {
+		return false
+	}
+	if h.fieldSelector != nil && !h.fieldSelector.Matches(fields.Set{"metadata.name": meta.Name, "metadata.namespace": meta.Namespace}) {
+		return false
+	}
+	return true
+}
+
+// copyAnnotations return a copy of annotations of given workload without
+// the warning of a previous admission
+func copyAnnotations(meta *metav1.ObjectMeta) map[string]string {
+	annotations := make(map[string]string)
+	for key, value := range meta.Annotations {
+		if key != imagoAdmissionWarningAnnotation {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// pin return the patch pinning images of given workload
+func (h *admissionWebhook) pin(ctx context.Context, resource string, meta *metav1.ObjectMeta, template *v1.PodTemplateSpec, templatePath string) ([]jsonPatchOperation, error) {
+	config, err := h.c.getConfigAnnotation(meta, &template.Spec)
+	if err != nil {
+		return nil, err
+	}
+	pullSecrets := h.pullSecrets(ctx, meta.Namespace, &template.Spec)
+	initPatch, err := h.pinContainers(ctx, resource, templatePath+"/spec/initContainers", template.Spec.InitContainers, pullSecrets)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := h.pinContainers(ctx, resource, templatePath+"/spec/containers", template.Spec.Containers, pullSecrets)
+	if err != nil {
+		return nil, err
+	}
+	patch = append(initPatch, patch...)
+	if len(patch) == 0 {
+		if _, ok := meta.Annotations[imagoAdmissionWarningAnnotation]; ok {
+			return []jsonPatchOperation{{"add", "/metadata/annotations", copyAnnotations(meta)}}, nil
+		}
+		return nil, nil
+	}
+	jsonConfig, err := encodeConfigAnnotation(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(jsonConfig) > maxConfigAnnotationSize {
+		log.Printf("%s: %s is too large for an annotation, admitted unchanged", resource, imagoConfigAnnotation)
+		return nil, nil
+	}
+	annotations := copyAnnotations(meta)
+	annotations[imagoConfigAnnotation] = string(jsonConfig)
+	return append(patch, jsonPatchOperation{"add", "/metadata/annotations", annotations}), nil
+}
+
+// ServeHTTP answer an AdmissionReview
+func (h *admissionWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAdmissionReviewSize)).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+	response := &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	ctx, cancel := admissionContext(r)
+	defer cancel()
+	patch, err := h.admit(ctx, review.Request)
+	switch {
+	case err != nil && h.failurePolicy == admissionregistrationv1.Fail:
+		log.Printf("%s/%s/%s: denied: %s", review.Request.Namespace, review.Request.Kind.Kind, review.Request.Name, err)
+		response.Allowed = false
+		response.Result = &metav1.Status{Status: metav1.StatusFailure, Message: fmt.Sprintf("imago: %s", err)}
+	case err != nil:
+		log.Printf("%s/%s/%s: admitted unchanged: %s", review.Request.Namespace, review.Request.Kind.Kind, review.Request.Name, err)
+	case len(patch) > 0:
+		b, err := json.Marshal(patch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		patchType := admissionv1.PatchTypeJSONPatch
+		response.Patch, response.PatchType = b, &patchType
+	}
+	review.Request, review.Response = nil, response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&review); err != nil {
+		log.Print(err)
+	}
+}
+
+// servingCertificate serve the certificate of given files, loaded again
+// when they change (e.g. renewed by cert-manager in a mounted secret)
+type servingCertificate struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// load read the certificate again if its files changed since last load
+func (s *servingCertificate) load() (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var modTime time.Time
+	for _, path := range []string{s.certFile, s.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return s.cert, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if s.cert != nil && modTime.Equal(s.modTime) {
+		return s.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		// files may be half written, keep serving the previous one
+		return s.cert, err
+	}
+	if s.cert != nil {
+		log.Printf("loaded renewed certificate %s", s.certFile)
+	}
+	s.cert, s.modTime = &cert, modTime
+	return s.cert, nil
+}
+
+// GetCertificate implement tls.Config.GetCertificate
+func (s *servingCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := s.load()
+	if err != nil && cert != nil {
+		log.Printf("unable to load renewed certificate %s: %s", s.certFile, err)
+		return cert, nil
+	}
+	return cert, err
+}
+
+func webhookCommand(args []string) {
+	var selection selectionFlags
+	var registry registryFlags
+	var policies policyFlags
+	var listen, tlsCert, tlsKey, failurePolicy string
+	var denyUnresolved bool
+	flags := newCommandFlags("webhook", &selection)
+	flags.StringVar(&listen, "listen", ":8443", "address to listen on")
+	flags.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file of the webhook server, loaded again when renewed")
+	flags.StringVar(&tlsKey, "tls-key", "", "TLS private key file of the webhook server")
+	flags.StringVar(&failurePolicy, "failure-policy", "Ignore", "Ignore to admit workloads whose images can't be resolved unchanged with the imago/admission-warning annotation, Fail to reject them")
+	flags.BoolVar(&denyUnresolved, "deny-unresolved", false, "same as -failure-policy Fail (default false)")
+	registry.register(flags)
+	policies.register(flags)
+	if err := flags.Parse(args); err != nil {
+		exit(exitConfigError, err)
+	}
+	h := &admissionWebhook{namespaces: selection.namespace}
+	switch strings.ToLower(failurePolicy) {
+	case "ignore":
+		h.failurePolicy = admissionregistrationv1.Ignore
+	case "fail":
+		h.failurePolicy = admissionregistrationv1.Fail
+	default:
+		exit(exitConfigError, fmt.Errorf("invalid -failure-policy %s, expected Ignore or Fail", failurePolicy))
+	}
+	if denyUnresolved {
+		h.failurePolicy = admissionregistrationv1.Fail
+	}
+	var err error
+	if h.labelSelector, err = labels.Parse(selection.labelSelector); err != nil {
+		exit(exitConfigError, fmt.Errorf("invalid -l: %w", err))
+	}
+	if h.fieldSelector, err = fields.ParseSelector(selection.fieldSelector); err != nil {
+		exit(exitConfigError, fmt.Errorf("invalid --field-selector: %w", err))
+	}
+	if tlsCert == "" || tlsKey == "" {
+		exit(exitConfigError, fmt.Errorf("-tls-cert and -tls-key are required, the API server only calls webhooks over HTTPS"))
+	}
+	// the webhook admit workloads of all namespaces, secrets of
+	// -docker-config are read in their own namespace
+	c, err := NewConfig(selection.kubeconfig, "", true, &selection.xnamespace, "", false, context.Background())
+	if err != nil {
+		exit(exitConfigError, err)
+	}
+	c.report = NewReport()
+	configs := []*Config{c}
+	if _, err := registry.setup(configs); err != nil {
+		exit(exitConfigError, err)
+	}
+	if err := policies.setup(configs); err != nil {
+		exit(exitConfigError, err)
+	}
+	mux := http.NewServeMux()
+	h.c = c
+	mux.Handle("/mutate", h)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+	cert := &servingCertificate{certFile: tlsCert, keyFile: tlsKey}
+	if _, err := cert.load(); err != nil {
+		exit(exitConfigError, err)
+	}
+	server := &http.Server{Addr: listen, Handler: mux, TLSConfig: &tls.Config{GetCertificate: cert.GetCertificate}}
+	log.Printf("listening on %s", listen)
+	err = server.ListenAndServeTLS("", "")
+	log.Print(err)
+	os.Exit(exitError)
+}